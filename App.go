@@ -94,6 +94,16 @@ func (this *App) SendEmail(msg *gomail.Message) {
 }
 
 
+//================================================
+// OpenID Connect login, routes are added by RegisterRouter
+//================================================
+func (this *App) UseOIDC(config OIDCConfig) *OIDCClient {
+	client := NewOIDCClient(config)
+	this.AddHandler(client, "oidc_" + config.Name)
+	return client
+}
+
+
 //================================================
 // Sever static resources
 //================================================
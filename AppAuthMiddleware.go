@@ -0,0 +1,263 @@
+package gocore
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+const (
+	// echo context key of authenticated UserAuthData
+	AUTH_CONTEXT_KEY = "auth_user"
+)
+
+var (
+	ErrAuthMissing = errors.New("auth: missing credentials")
+	ErrAuthInvalid = errors.New("auth: invalid credentials")
+)
+
+// AuthCredentials extracted from request
+type AuthCredentials struct {
+	// empty when request do not send it
+	UserID 						string
+	Token 						string
+	IP 							string
+}
+
+// AuthValidator check credentials and return the authenticated user
+type AuthValidator interface {
+	ValidateCredentials(credentials AuthCredentials) (*UserAuthData, error)
+}
+
+type (
+	// AuthConfig defines the config for authentication middleware.
+	AuthConfig struct {
+		// Skipper defines a function to skip middleware.
+		Skipper 				middleware.Skipper
+
+		// Validator check credentials. Optional. Default TokkorRedis() sessions.
+		Validator 				AuthValidator
+
+		// TokenLookup is a comma separated list of "<source>:<name>" where token is searched in order.
+		// source: header, cookie, query or form
+		// Optional. Default value "header:Authorization,cookie:access_token".
+		TokenLookup 			string
+
+		// AuthScheme stripped from Authorization header. Optional. Default value "Bearer".
+		AuthScheme 				string
+
+		// UserIDLookup same format as TokenLookup, user id is optional for sessions
+		// but required to accept authentication stored before sessions.
+		// Optional. Default value "header:X-User-ID".
+		UserIDLookup 			string
+
+		// PublicRoutes are not authenticated, entries are route paths as registered ( c.Path() )
+		// optionally prefixed by method: "/login", "GET /products/:id"
+		PublicRoutes 			[]string
+
+		// Optional authenticate request when credentials are sent but let anonymous request pass
+		Optional 				bool
+
+		// ErrorHandler write response on failure.
+		// Optional. Default write authFail response with ErrorMessage and status 401.
+		ErrorHandler 			func(c echo.Context, err error) error
+
+		// ErrorMessage of default ErrorHandler. Optional. Default value "unauthorized".
+		ErrorMessage 			string
+
+		tokenExtractors 		[]authExtractor
+		userIDExtractors 		[]authExtractor
+		publicRoutes 			map[string]bool
+	}
+
+	authExtractor func(c echo.Context) string
+)
+
+var (
+	// DefaultAuthConfig is the default authentication middleware config.
+	DefaultAuthConfig = AuthConfig{
+		Skipper: middleware.DefaultSkipper,
+		TokenLookup: "header:" + echo.HeaderAuthorization + ",cookie:access_token",
+		AuthScheme: "Bearer",
+		UserIDLookup: "header:X-User-ID",
+		ErrorMessage: "unauthorized",
+	}
+)
+
+// Auth returns a middleware that authenticate request with TokkorRedis() sessions.
+func Auth() echo.MiddlewareFunc {
+	return AuthWithConfig(DefaultAuthConfig)
+}
+
+// AuthWithConfig returns an authentication middleware with config.
+// See: `Auth()`.
+func AuthWithConfig(config AuthConfig) echo.MiddlewareFunc {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultAuthConfig.Skipper
+	}
+	if config.Validator == nil {
+		config.Validator = TokkorRedis()
+	}
+	if config.TokenLookup == "" {
+		config.TokenLookup = DefaultAuthConfig.TokenLookup
+	}
+	if config.AuthScheme == "" {
+		config.AuthScheme = DefaultAuthConfig.AuthScheme
+	}
+	if config.UserIDLookup == "" {
+		config.UserIDLookup = DefaultAuthConfig.UserIDLookup
+	}
+	if config.ErrorMessage == "" {
+		config.ErrorMessage = DefaultAuthConfig.ErrorMessage
+	}
+	if config.ErrorHandler == nil {
+		message := config.ErrorMessage
+		config.ErrorHandler = func(c echo.Context, err error) error {
+			return authFail(c, http.StatusUnauthorized, message)
+		}
+	}
+	config.tokenExtractors = authExtractors(config.TokenLookup, config.AuthScheme)
+	config.userIDExtractors = authExtractors(config.UserIDLookup, "")
+	config.publicRoutes = make(map[string]bool)
+	for _, route := range config.PublicRoutes {
+		config.publicRoutes[route] = true
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if config.Skipper(c) || config.isPublic(c) {
+				return next(c)
+			}
+			credentials := AuthCredentials{
+				Token: authExtract(c, config.tokenExtractors),
+				UserID: authExtract(c, config.userIDExtractors),
+				IP: c.RealIP(),
+			}
+			if credentials.Token == "" {
+				if config.Optional {
+					return next(c)
+				}
+				return config.ErrorHandler(c, ErrAuthMissing)
+			}
+			user, err := config.Validator.ValidateCredentials(credentials)
+			if err != nil || user == nil {
+				if err == nil {
+					err = ErrAuthInvalid
+				}
+				return config.ErrorHandler(c, err)
+			}
+			c.Set(AUTH_CONTEXT_KEY, user)
+			return next(c)
+		}
+	}
+}
+
+func (config *AuthConfig) isPublic(c echo.Context) bool {
+	if len(config.publicRoutes) == 0 {
+		return false
+	}
+	path := c.Path()
+	return config.publicRoutes[path] || config.publicRoutes[c.Request().Method + " " + path]
+}
+
+func authExtractors(lookup string, scheme string) []authExtractor {
+	var extractors []authExtractor
+	for _, part := range strings.Split(lookup, ",") {
+		parts := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := parts[1]
+		switch parts[0] {
+		case "header":
+			extractors = append(extractors, func(c echo.Context) string {
+				value := c.Request().Header.Get(name)
+				if scheme != "" && len(value) > len(scheme) + 1 && strings.EqualFold(value[:len(scheme)], scheme) && value[len(scheme)] == ' ' {
+					return strings.TrimSpace(value[len(scheme) + 1:])
+				}
+				return value
+			})
+		case "cookie":
+			extractors = append(extractors, func(c echo.Context) string {
+				cookie, err := c.Cookie(name)
+				if err != nil {
+					return ""
+				}
+				return cookie.Value
+			})
+		case "query":
+			extractors = append(extractors, func(c echo.Context) string {
+				return c.QueryParam(name)
+			})
+		case "form":
+			extractors = append(extractors, func(c echo.Context) string {
+				return c.FormValue(name)
+			})
+		}
+	}
+	return extractors
+}
+
+func authExtract(c echo.Context, extractors []authExtractor) string {
+	for _, extractor := range extractors {
+		if value := extractor(c); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// AuthUser return user authenticated by Auth middleware, nil when anonymous
+func AuthUser(c echo.Context) *UserAuthData {
+	user, _ := c.Get(AUTH_CONTEXT_KEY).(*UserAuthData)
+	return user
+}
+
+// authFail write default response of auth and authorization failures, a ResultFail payload
+// {"code": -1, "msg": message, "data": null} with a real error status so failures are never cached as success
+func authFail(c echo.Context, status int, message string) error {
+	return c.JSON(status, echo.Map{
+		"code": -1,
+		"msg": message,
+		"data": nil,
+	})
+}
+
+//--------------------------------------------------------------------------------------
+// Validators
+//--------------------------------------------------------------------------------------
+
+// ValidateCredentials check access token of a session, user id is checked when sent
+func (this *SessionStore) ValidateCredentials(credentials AuthCredentials) (*UserAuthData, error) {
+	session, err := this.Validate(credentials.Token, credentials.IP)
+	if err != nil {
+		return nil, err
+	}
+	if credentials.UserID != "" && credentials.UserID != session.UserID {
+		return nil, ErrAuthInvalid
+	}
+	return &session.Auth, nil
+}
+
+// ValidateCredentials check sessions then authentication stored before sessions
+func (this *TokkorRedisCommon) ValidateCredentials(credentials AuthCredentials) (*UserAuthData, error) {
+	user, err := this.Sessions().ValidateCredentials(credentials)
+	if err != ErrSessionNotFound || credentials.UserID == "" {
+		return user, err
+	}
+	ip := ""
+	if this.Sessions().Config().BindIP {
+		ip = credentials.IP
+	}
+	if user = this.validateLegacyAuthentication(credentials.UserID, credentials.Token, ip); user != nil {
+		return user, nil
+	}
+	return nil, err
+}
+
+var _ AuthValidator = (*SessionStore)(nil)
+var _ AuthValidator = (*TokkorRedisCommon)(nil)
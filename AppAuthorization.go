@@ -0,0 +1,231 @@
+package gocore
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+var ErrForbidden = errors.New("auth: forbidden")
+
+// AuthPolicy decide if user can access request, user is never nil
+type AuthPolicy func(c echo.Context, user *UserAuthData) bool
+
+// OwnerResolver return id of user owning the resource targeted by request
+type OwnerResolver func(c echo.Context) (string, error)
+
+// Authorizer keep roles, policies and ownership rules used by Require* guards.
+// guards must run after Auth middleware
+type Authorizer struct {
+	lock 						sync.RWMutex
+	roles 						map[string][]string
+	policies 					map[string]AuthPolicy
+	owners 						map[string]OwnerResolver
+
+	// ErrorHandler write response when user is anonymous ( ErrAuthMissing ) or not allowed ( ErrForbidden ).
+	// default write authFail response with status 401 for anonymous user, 403 otherwise
+	ErrorHandler 				func(c echo.Context, err error) error
+}
+
+var _sharedAuthorizer *Authorizer
+var _sharedAuthorizerOnce sync.Once
+
+// Authorization return shared authorizer used by package level guards
+func Authorization() *Authorizer {
+	_sharedAuthorizerOnce.Do(func() {
+		_sharedAuthorizer = NewAuthorizer()
+	})
+	return _sharedAuthorizer
+}
+
+func NewAuthorizer() *Authorizer {
+	return &Authorizer{
+		roles: make(map[string][]string),
+		policies: make(map[string]AuthPolicy),
+		owners: make(map[string]OwnerResolver),
+		ErrorHandler: authorizationFail,
+	}
+}
+
+func authorizationFail(c echo.Context, err error) error {
+	if err == ErrAuthMissing {
+		return authFail(c, http.StatusUnauthorized, "unauthorized")
+	}
+	return authFail(c, http.StatusForbidden, "forbidden")
+}
+
+// DefineRole grant permissions to role, ex: DefineRole("editor", "posts:*", "comments:read")
+func (this *Authorizer) DefineRole(role string, permissions ...string) {
+	this.lock.Lock()
+	this.roles[role] = append(this.roles[role], permissions...)
+	this.lock.Unlock()
+}
+
+func (this *Authorizer) DefinePolicy(name string, policy AuthPolicy) {
+	this.lock.Lock()
+	this.policies[name] = policy
+	this.lock.Unlock()
+}
+
+// DefineOwner register how to find owner of a resource for RequireOwner
+func (this *Authorizer) DefineOwner(resource string, resolver OwnerResolver) {
+	this.lock.Lock()
+	this.owners[resource] = resolver
+	this.lock.Unlock()
+}
+
+// Permissions of user, granted directly and by roles
+func (this *Authorizer) Permissions(user *UserAuthData) []string {
+	if user == nil {
+		return nil
+	}
+	permissions := append([]string(nil), user.Permissions...)
+	this.lock.RLock()
+	for _, role := range user.Roles {
+		permissions = append(permissions, this.roles[role]...)
+	}
+	this.lock.RUnlock()
+	return permissions
+}
+
+// HasPermission check a granted permission match. grants support wildcards:
+// "*" match everything, "orders:*" match "orders:write" and "orders:items:read"
+func (this *Authorizer) HasPermission(user *UserAuthData, permission string) bool {
+	for _, granted := range this.Permissions(user) {
+		if permissionMatch(granted, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole check user has one of roles
+func (this *Authorizer) HasRole(user *UserAuthData, roles ...string) bool {
+	if user == nil {
+		return false
+	}
+	for _, has := range user.Roles {
+		for _, role := range roles {
+			if has == role {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Can evaluate named policy, unknown policy deny
+func (this *Authorizer) Can(c echo.Context, user *UserAuthData, policy string) bool {
+	if user == nil {
+		return false
+	}
+	this.lock.RLock()
+	fn := this.policies[policy]
+	this.lock.RUnlock()
+	return fn != nil && fn(c, user)
+}
+
+// IsOwner check user own resource targeted by request
+func (this *Authorizer) IsOwner(c echo.Context, user *UserAuthData, resource string) bool {
+	if user == nil {
+		return false
+	}
+	this.lock.RLock()
+	resolver := this.owners[resource]
+	this.lock.RUnlock()
+	if resolver == nil {
+		Log().Error().Str("resource", resource).Msg("No owner resolver defined for resource")
+		return false
+	}
+	owner, err := resolver(c)
+	if err != nil {
+		Log().Error().Err(err).Str("resource", resource).Msg("Error when resolve resource owner")
+		return false
+	}
+	return owner != "" && owner == user.UserID
+}
+
+// RequirePermission allow user having all permissions
+func (this *Authorizer) RequirePermission(permissions ...string) echo.MiddlewareFunc {
+	return this.guard(func(c echo.Context, user *UserAuthData) bool {
+		for _, permission := range permissions {
+			if !this.HasPermission(user, permission) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// RequireRole allow user having one of roles
+func (this *Authorizer) RequireRole(roles ...string) echo.MiddlewareFunc {
+	return this.guard(func(c echo.Context, user *UserAuthData) bool {
+		return this.HasRole(user, roles...)
+	})
+}
+
+// RequirePolicy allow user passing named policy
+func (this *Authorizer) RequirePolicy(policy string) echo.MiddlewareFunc {
+	return this.guard(func(c echo.Context, user *UserAuthData) bool {
+		return this.Can(c, user, policy)
+	})
+}
+
+// RequireOwner allow owner of resource or user having one of bypass permissions ( ex: "orders:*" for staff )
+func (this *Authorizer) RequireOwner(resource string, bypass ...string) echo.MiddlewareFunc {
+	return this.guard(func(c echo.Context, user *UserAuthData) bool {
+		for _, permission := range bypass {
+			if this.HasPermission(user, permission) {
+				return true
+			}
+		}
+		return this.IsOwner(c, user, resource)
+	})
+}
+
+func (this *Authorizer) guard(allow AuthPolicy) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user := AuthUser(c)
+			if user == nil {
+				return this.ErrorHandler(c, ErrAuthMissing)
+			}
+			if !allow(c, user) {
+				return this.ErrorHandler(c, ErrForbidden)
+			}
+			return next(c)
+		}
+	}
+}
+
+func permissionMatch(granted string, permission string) bool {
+	if granted == "*" || granted == permission {
+		return true
+	}
+	if strings.HasSuffix(granted, ":*") {
+		return strings.HasPrefix(permission, granted[:len(granted) - 1])
+	}
+	return false
+}
+
+//--------------------------------------------------------------------------------------
+// Guards of shared authorizer, ex: api.Group("/orders", Auth(), RequirePermission("orders:write"))
+//--------------------------------------------------------------------------------------
+func RequirePermission(permissions ...string) echo.MiddlewareFunc {
+	return Authorization().RequirePermission(permissions...)
+}
+
+func RequireRole(roles ...string) echo.MiddlewareFunc {
+	return Authorization().RequireRole(roles...)
+}
+
+func RequirePolicy(policy string) echo.MiddlewareFunc {
+	return Authorization().RequirePolicy(policy)
+}
+
+func RequireOwner(resource string, bypass ...string) echo.MiddlewareFunc {
+	return Authorization().RequireOwner(resource, bypass...)
+}
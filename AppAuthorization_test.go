@@ -0,0 +1,92 @@
+package gocore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+type testAuthValidator map[string]*UserAuthData
+
+func (this testAuthValidator) ValidateCredentials(credentials AuthCredentials) (*UserAuthData, error) {
+	if user := this[credentials.Token]; user != nil {
+		return user, nil
+	}
+	return nil, ErrAuthInvalid
+}
+
+func TestAuthorizationGuards(t *testing.T) {
+	authorizer := NewAuthorizer()
+	authorizer.DefineRole("editor", "posts:*")
+	authorizer.DefinePolicy("even", func(c echo.Context, user *UserAuthData) bool {
+		return len(user.UserID) % 2 == 0
+	})
+	authorizer.DefineOwner("post", func(c echo.Context) (string, error) {
+		if c.Param("id") == "broken" {
+			return "", errors.New("lookup failed")
+		}
+		return "owner-" + c.Param("id"), nil
+	})
+
+	e := echo.New()
+	validator := testAuthValidator{
+		"admin": {UserID: "admin", Permissions: []string{"*"}},
+		"editor": {UserID: "ed", Roles: []string{"editor"}},
+		"owner": {UserID: "owner-1"},
+		"guest": {UserID: "guest"},
+	}
+	auth := AuthWithConfig(AuthConfig{Validator: validator, Optional: true})
+	ok := func(c echo.Context) error { return c.String(http.StatusOK, "ok") }
+	e.GET("/write", ok, auth, authorizer.RequirePermission("posts:write"))
+	e.GET("/role", ok, auth, authorizer.RequireRole("editor", "admin"))
+	e.GET("/policy", ok, auth, authorizer.RequirePolicy("even"))
+	e.GET("/posts/:id", ok, auth, authorizer.RequireOwner("post", "posts:read"))
+
+	tests := []struct {
+		target 					string
+		token 					string
+		status 					int
+	}{
+		{"/write", "", http.StatusUnauthorized},
+		{"/write", "guest", http.StatusForbidden},
+		{"/write", "editor", http.StatusOK},
+		{"/write", "admin", http.StatusOK},
+		{"/role", "editor", http.StatusOK},
+		{"/role", "admin", http.StatusForbidden},
+		{"/policy", "ed", http.StatusUnauthorized},
+		{"/policy", "editor", http.StatusOK},
+		{"/policy", "guest", http.StatusForbidden},
+		{"/posts/1", "owner", http.StatusOK},
+		{"/posts/2", "owner", http.StatusForbidden},
+		{"/posts/2", "editor", http.StatusOK},
+		{"/posts/broken", "guest", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer " + tt.token)
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s as %q: status %d, want %d %s", tt.target, tt.token, w.Code, tt.status, w.Body.String())
+		}
+	}
+}
+
+func TestAuthorizationErrorHandler(t *testing.T) {
+	authorizer := NewAuthorizer()
+	authorizer.ErrorHandler = func(c echo.Context, err error) error {
+		return echo.NewHTTPError(http.StatusTeapot, err.Error())
+	}
+	e := echo.New()
+	e.GET("/", func(c echo.Context) error { return c.String(http.StatusOK, "ok") }, authorizer.RequireRole("admin"))
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusTeapot {
+		t.Errorf("status %d", w.Code)
+	}
+}
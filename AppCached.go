@@ -2,32 +2,64 @@ package gocore
 
 import (
 	"time"
-	"github.com/akyoto/cache"
+
+	"github.com/go-redis/redis/v7"
 )
 
 type AppCached struct {
-	items 				*cache.Cache
+	items 				CacheStore
+	loads 				cacheLoadGroup
 }
 var _sharedAppCached *AppCached
 func Cache() *AppCached {
 	if _sharedAppCached == nil {
-		_sharedAppCached = &AppCached{
-			items: cache.New(6 * time.Hour),
-		}
+		_sharedAppCached = NewAppCached(AppCachedConfig{})
 	}
 	return _sharedAppCached
 }
 
+// SetupCache replace shared cache with a bounded one. call it once at startup
+func SetupCache(config AppCachedConfig) *AppCached {
+	if _sharedAppCached != nil {
+		_sharedAppCached.Close()
+	}
+	_sharedAppCached = NewAppCached(config)
+	return _sharedAppCached
+}
+
+func NewAppCached(config AppCachedConfig) *AppCached {
+	return NewAppCachedWithStore(NewCacheMemoryStore(config))
+}
+
+// NewRedisAppCached create a cache shared between instances through redis
+func NewRedisAppCached(client redis.Cmdable, prefix string) *AppCached {
+	return NewAppCachedWithStore(NewCacheRedisStore(client, prefix))
+}
+
+func NewAppCachedWithStore(store CacheStore) *AppCached {
+	return &AppCached{
+		items: store,
+	}
+}
+
+func(c*AppCached) Store() CacheStore {
+	return c.items
+}
 
 func(c*AppCached) Has(key interface{}) bool {
-	_, found := c.items.Get(key)
+	obj, found := c.items.Get(key)
+	if found {
+		_, found = cacheUnwrap(obj)
+	}
 	return found
 }
 
 func(c*AppCached) Get(key interface{}) CacheAny {
 	obj, found := c.items.Get(key)
 	if found {
-		return as(obj)
+		if obj, found = cacheUnwrap(obj); found {
+			return as(obj)
+		}
 	}
 	return CacheAny{}
 }
@@ -41,6 +73,54 @@ func(c*AppCached) Set(key interface{}, value interface{}, dur time.Duration) {
 	c.items.Set(key, value, dur)
 }
 
+// SetWithTags set value and attach tags so it can be removed by InvalidateTag
+func(c*AppCached) SetWithTags(key interface{}, value interface{}, dur time.Duration, tags ...string) {
+	c.items.SetWithTags(key, value, dur, tags)
+}
+
+// InvalidateTag delete every entry having one of tags
+func(c*AppCached) InvalidateTag(tags ...string) int {
+	return c.items.InvalidateTag(tags...)
+}
+
+// DeletePrefix delete every string key starting with prefix, ex: "user|42|"
+func(c*AppCached) DeletePrefix(prefix string) int {
+	return c.items.DeletePrefix(prefix)
+}
+
+// Scan iterate keys starting with prefix until callback return false
+func(c*AppCached) Scan(prefix string, callback func(key interface{}) bool) {
+	c.items.Scan(prefix, callback)
+}
+
+func(c*AppCached) Keys(prefix string) []interface{} {
+	var keys []interface{}
+	c.items.Scan(prefix, func(key interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func(c*AppCached) Len() int {
+	return c.items.Len()
+}
+
+func(c*AppCached) Clear() {
+	c.items.Clear()
+}
+
+// Stats return hits, misses, evictions and size for monitoring
+func(c*AppCached) Stats() CacheStats {
+	return c.items.Stats()
+}
+
+func(c*AppCached) Close() {
+	c.items.Close()
+}
+
+// CacheAny wrap a cached value. accessors never panic, on missing value or
+// incompatible type they return zero value. use ToXXX variants to know if conversion succeed
 type CacheAny struct {
 	value 			interface{}
 	good			bool
@@ -53,66 +133,76 @@ func as(value interface{}) CacheAny {
 	}
 }
 
+// Found report if value exist in cache
+func (a CacheAny) Found() bool {
+	return a.good
+}
+
 func (a CacheAny) String() string{
-	if(!a.good) { return "" }
-	return a.value.(string)
+	v, _ := a.ToString()
+	return v
 }
 
-func (a*CacheAny) Int8() int8{
-	if(!a.good) { return 0 }
-	return a.value.(int8)
+func (a CacheAny) Int8() int8{
+	v, _ := a.ToInt8()
+	return v
 }
 
 func (a CacheAny) Int16() int16{
-	if(!a.good) { return 0 }
-	return a.value.(int16)
+	v, _ := a.ToInt16()
+	return v
 }
 
-func (a*CacheAny) Int32() int32{
-	if(!a.good) { return 0 }
-	return a.value.(int32)
+func (a CacheAny) Int32() int32{
+	v, _ := a.ToInt32()
+	return v
 }
 
 func (a CacheAny) Int64() int64{
-	if(!a.good) { return 0 }
-	return a.value.(int64)
+	v, _ := a.ToInt64()
+	return v
 }
 
 func (a CacheAny) Int() int{
-	if(!a.good) { return 0 }
-	return a.value.(int)
+	v, _ := a.ToInt()
+	return v
 }
 
 func (a CacheAny) Float64() float64{
-	if(!a.good) { return 0 }
-	return a.value.(float64)
+	v, _ := a.ToFloat64()
+	return v
 }
 
 func (a CacheAny) Float32() float32{
-	if(!a.good) { return 0 }
-	return a.value.(float32)
+	v, _ := a.ToFloat32()
+	return v
 }
 
 func (a CacheAny) Bool() bool{
-	if(!a.good) { return false }
-	return a.value.(bool)
+	v, _ := a.ToBool()
+	return v
 }
 
 func (a CacheAny) Byte() byte{
-	if(!a.good) { return 0 }
-	return a.value.(byte)
+	v, _ := a.ToByte()
+	return v
 }
 
 func (a CacheAny) Rune() rune{
-	if(!a.good) { return 0 }
-	return a.value.(rune)
+	v, _ := a.ToRune()
+	return v
 }
 
-func (a CacheAny) As(data interface{}){
-	if(!a.good) { return }
-	data = a.value
+func (a CacheAny) Bytes() []byte{
+	v, _ := a.ToBytes()
+	return v
+}
+
+// As fill target ( must be a pointer ) with cached value, return false if it can't
+func (a CacheAny) As(target interface{}) bool{
+	return a.Decode(target) == nil
 }
 
 func (a CacheAny) V() interface{}{
 	return a.value
-}
\ No newline at end of file
+}
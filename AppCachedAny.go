@@ -0,0 +1,267 @@
+package gocore
+
+import (
+	stdjson "encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+var ErrCacheInvalidTarget = errors.New("cache: decode target must be a non-nil pointer")
+
+//-------------------------------------------------------------
+// Safe accessors, return ok = false when value is missing
+// or can't convert to requested type
+//-------------------------------------------------------------
+func (a CacheAny) ToString() (string, bool) {
+	if !a.good { return "", false }
+	switch v := a.value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	case stdjson.Number:
+		return string(v), true
+	}
+	return "", false
+}
+
+func (a CacheAny) ToBytes() ([]byte, bool) {
+	if !a.good { return nil, false }
+	switch v := a.value.(type) {
+	case []byte:
+		return v, true
+	case stdjson.RawMessage:
+		return v, true
+	case string:
+		return []byte(v), true
+	}
+	return nil, false
+}
+
+func (a CacheAny) ToBool() (bool, bool) {
+	if !a.good { return false, false }
+	switch v := a.value.(type) {
+	case bool:
+		return v, true
+	case string:
+		b, err := strconv.ParseBool(v)
+		return b, err == nil
+	case []byte:
+		b, err := strconv.ParseBool(string(v))
+		return b, err == nil
+	}
+	return false, false
+}
+
+func (a CacheAny) ToInt64() (int64, bool) {
+	if !a.good { return 0, false }
+	return cacheToInt64(a.value)
+}
+
+func (a CacheAny) ToInt() (int, bool) {
+	v, ok := a.ToInt64()
+	if !ok || int64(int(v)) != v {
+		return 0, false
+	}
+	return int(v), true
+}
+
+func (a CacheAny) ToInt32() (int32, bool) {
+	v, ok := a.ToInt64()
+	if !ok || v < math.MinInt32 || v > math.MaxInt32 {
+		return 0, false
+	}
+	return int32(v), true
+}
+
+func (a CacheAny) ToInt16() (int16, bool) {
+	v, ok := a.ToInt64()
+	if !ok || v < math.MinInt16 || v > math.MaxInt16 {
+		return 0, false
+	}
+	return int16(v), true
+}
+
+func (a CacheAny) ToInt8() (int8, bool) {
+	v, ok := a.ToInt64()
+	if !ok || v < math.MinInt8 || v > math.MaxInt8 {
+		return 0, false
+	}
+	return int8(v), true
+}
+
+func (a CacheAny) ToByte() (byte, bool) {
+	v, ok := a.ToInt64()
+	if !ok || v < 0 || v > math.MaxUint8 {
+		return 0, false
+	}
+	return byte(v), true
+}
+
+func (a CacheAny) ToRune() (rune, bool) {
+	return a.ToInt32()
+}
+
+func (a CacheAny) ToFloat64() (float64, bool) {
+	if !a.good { return 0, false }
+	return cacheToFloat64(a.value)
+}
+
+func (a CacheAny) ToFloat32() (float32, bool) {
+	v, ok := a.ToFloat64()
+	if !ok || math.Abs(v) > math.MaxFloat32 {
+		return 0, false
+	}
+	return float32(v), true
+}
+
+// Decode fill target ( must be a pointer ) with cached value.
+// value is copied when types are compatible, numbers are converted,
+// otherwise value is decoded from json ( []byte / string ) or re-encoded through json.
+// this way values loaded from an external store like redis decode the same way.
+func (a CacheAny) Decode(target interface{}) error {
+	if !a.good {
+		return ErrCacheNotFound
+	}
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return ErrCacheInvalidTarget
+	}
+	dst := rv.Elem()
+	src := reflect.ValueOf(a.value)
+	if !src.IsValid() {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	// direct copy
+	if src.Type().AssignableTo(dst.Type()) {
+		dst.Set(src)
+		return nil
+	}
+	if src.Kind() == reflect.Ptr && !src.IsNil() && src.Elem().Type().AssignableTo(dst.Type()) {
+		dst.Set(src.Elem())
+		return nil
+	}
+	// numbers
+	switch dst.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v, ok := cacheToInt64(a.value); ok && !dst.OverflowInt(v) {
+			dst.SetInt(v)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v, ok := cacheToInt64(a.value); ok && v >= 0 && !dst.OverflowUint(uint64(v)) {
+			dst.SetUint(uint64(v))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if v, ok := cacheToFloat64(a.value); ok && !dst.OverflowFloat(v) {
+			dst.SetFloat(v)
+			return nil
+		}
+	case reflect.String:
+		if v, ok := a.ToString(); ok {
+			dst.SetString(v)
+			return nil
+		}
+	}
+	// encoded value
+	switch v := a.value.(type) {
+	case []byte:
+		return json.Unmarshal(v, target)
+	case stdjson.RawMessage:
+		return json.Unmarshal(v, target)
+	case string:
+		return json.Unmarshal([]byte(v), target)
+	}
+	// convert through json, ex: map[string]interface{} -> struct
+	b, err := json.Marshal(a.value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, target)
+}
+
+func cacheToInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		if uint64(v) > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	case float32:
+		return cacheFloatToInt64(float64(v))
+	case float64:
+		return cacheFloatToInt64(v)
+	case stdjson.Number:
+		return cacheParseInt64(string(v))
+	case string:
+		return cacheParseInt64(v)
+	case []byte:
+		return cacheParseInt64(string(v))
+	}
+	return 0, false
+}
+
+func cacheToFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case stdjson.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	}
+	if i, ok := cacheToInt64(value); ok {
+		return float64(i), true
+	}
+	return 0, false
+}
+
+// float only convert when it is a whole number
+func cacheFloatToInt64(v float64) (int64, bool) {
+	if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(v), true
+}
+
+func cacheParseInt64(s string) (int64, bool) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return cacheFloatToInt64(f)
+	}
+	return 0, false
+}
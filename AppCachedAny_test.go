@@ -0,0 +1,133 @@
+package gocore
+
+import (
+	stdjson "encoding/json"
+	"math"
+	"testing"
+)
+
+func TestCacheAnyToInt64(t *testing.T) {
+	tests := []struct {
+		name 					string
+		value 					interface{}
+		want 					int64
+		ok 						bool
+	}{
+		{"int", 42, 42, true},
+		{"int8", int8(-8), -8, true},
+		{"uint32", uint32(7), 7, true},
+		{"uint64 overflow", uint64(math.MaxUint64), 0, false},
+		{"whole float", 3.0, 3, true},
+		{"fraction", 3.5, 0, false},
+		{"huge float", 1e20, 0, false},
+		{"json number", stdjson.Number("12"), 12, true},
+		{"string", "-5", -5, true},
+		{"float string", "6.0", 6, true},
+		{"bytes", []byte("9"), 9, true},
+		{"not a number", "abc", 0, false},
+		{"bool", true, 0, false},
+	}
+	for _, tt := range tests {
+		if v, ok := as(tt.value).ToInt64(); v != tt.want || ok != tt.ok {
+			t.Errorf("%s: ToInt64 = %d %v, want %d %v", tt.name, v, ok, tt.want, tt.ok)
+		}
+	}
+	if _, ok := (CacheAny{}).ToInt64(); ok {
+		t.Errorf("missing value converted")
+	}
+}
+
+func TestCacheAnyNarrowing(t *testing.T) {
+	tests := []struct {
+		name 					string
+		convert 				func(a CacheAny) bool
+		value 					interface{}
+		ok 						bool
+	}{
+		{"int8", func(a CacheAny) bool { _, ok := a.ToInt8(); return ok }, 127, true},
+		{"int8 overflow", func(a CacheAny) bool { _, ok := a.ToInt8(); return ok }, 128, false},
+		{"int16 overflow", func(a CacheAny) bool { _, ok := a.ToInt16(); return ok }, -40000, false},
+		{"int32", func(a CacheAny) bool { _, ok := a.ToInt32(); return ok }, "2147483647", true},
+		{"int32 overflow", func(a CacheAny) bool { _, ok := a.ToInt32(); return ok }, int64(math.MaxInt32) + 1, false},
+		{"byte negative", func(a CacheAny) bool { _, ok := a.ToByte(); return ok }, -1, false},
+		{"byte", func(a CacheAny) bool { _, ok := a.ToByte(); return ok }, 255, true},
+		{"float32 overflow", func(a CacheAny) bool { _, ok := a.ToFloat32(); return ok }, math.MaxFloat64, false},
+		{"float64 from int", func(a CacheAny) bool { v, ok := a.ToFloat64(); return ok && v == 3 }, 3, true},
+		{"float64 from string", func(a CacheAny) bool { v, ok := a.ToFloat64(); return ok && v == 1.5 }, "1.5", true},
+		{"bool from string", func(a CacheAny) bool { v, ok := a.ToBool(); return ok && v }, "true", true},
+		{"bool from int", func(a CacheAny) bool { _, ok := a.ToBool(); return ok }, 1, false},
+		{"string from bytes", func(a CacheAny) bool { v, ok := a.ToString(); return ok && v == "x" }, []byte("x"), true},
+		{"string from int", func(a CacheAny) bool { _, ok := a.ToString(); return ok }, 1, false},
+		{"bytes from string", func(a CacheAny) bool { v, ok := a.ToBytes(); return ok && string(v) == "x" }, "x", true},
+	}
+	for _, tt := range tests {
+		if ok := tt.convert(as(tt.value)); ok != tt.ok {
+			t.Errorf("%s: ok %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+}
+
+type cacheAnyUser struct {
+	Name 						string			`json:"name"`
+	Age 						int				`json:"age"`
+}
+
+func TestCacheAnyDecode(t *testing.T) {
+	user := cacheAnyUser{Name: "bob", Age: 30}
+	tests := []struct {
+		name 					string
+		value 					interface{}
+	}{
+		{"struct", user},
+		{"pointer", &user},
+		{"json bytes", []byte(`{"name":"bob","age":30}`)},
+		{"json string", `{"name":"bob","age":30}`},
+		// other type re-encoded through json
+		{"other struct", struct {
+			Name 				string			`json:"name"`
+			Age 				int64			`json:"age"`
+		}{"bob", 30}},
+	}
+	for _, tt := range tests {
+		var got cacheAnyUser
+		if err := as(tt.value).Decode(&got); err != nil || got != user {
+			t.Errorf("%s: Decode = %+v %v", tt.name, got, err)
+		}
+	}
+
+	var small int8
+	if err := as(int64(42)).Decode(&small); err != nil || small != 42 {
+		t.Errorf("int64 to int8: %d %v", small, err)
+	}
+	var unsigned uint
+	if err := as(-1).Decode(&unsigned); err == nil {
+		t.Errorf("negative to uint accepted: %d", unsigned)
+	}
+	var f float64
+	if err := as(stdjson.Number("2.5")).Decode(&f); err != nil || f != 2.5 {
+		t.Errorf("json number to float: %v %v", f, err)
+	}
+	var s string
+	if err := as([]byte("raw")).Decode(&s); err != nil || s != "raw" {
+		t.Errorf("bytes to string: %q %v", s, err)
+	}
+
+	// error paths
+	if err := (CacheAny{}).Decode(&s); err != ErrCacheNotFound {
+		t.Errorf("missing value: %v", err)
+	}
+	if err := as(1).Decode(s); err != ErrCacheInvalidTarget {
+		t.Errorf("non pointer target: %v", err)
+	}
+	var nilTarget *cacheAnyUser
+	if err := as(user).Decode(nilTarget); err != ErrCacheInvalidTarget {
+		t.Errorf("nil target: %v", err)
+	}
+	var got cacheAnyUser
+	if err := as(`{"name":`).Decode(&got); err == nil {
+		t.Errorf("broken json accepted")
+	}
+	if err := as(make(chan int)).Decode(&got); err == nil {
+		t.Errorf("unencodable value accepted")
+	}
+}
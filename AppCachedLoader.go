@@ -0,0 +1,156 @@
+package gocore
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCacheNotFound should be returned by a loader when the value does not exist.
+// with NegativeTTL it is remembered so the source is not queried again for a while
+var ErrCacheNotFound = errors.New("cache: not found")
+
+type CacheLoader func() (interface{}, error)
+
+type CacheLoadOptions struct {
+	// how long a loaded value is fresh
+	TTL 					time.Duration
+	// after TTL the value is still served for StaleTTL while it refresh in background
+	StaleTTL 				time.Duration
+	// how long ErrCacheNotFound from loader is cached, 0 to disable
+	NegativeTTL 			time.Duration
+	// tags attached to loaded value
+	Tags 					[]string
+}
+
+// value stored by GetOrLoad, it keep freshness info beside the value
+type cacheLoaded struct {
+	Value 					interface{}		`json:"v"`
+	FreshUntil 				int64			`json:"f"`
+	NotFound 				bool			`json:"n"`
+}
+
+type cacheCall struct {
+	wg 						sync.WaitGroup
+	value 					interface{}
+	err 					error
+}
+
+type cacheLoadGroup struct {
+	lock 					sync.Mutex
+	calls 					map[interface{}]*cacheCall
+}
+
+// do run fn once for all concurrent callers of the same key, a panic of fn is returned as error
+func (g *cacheLoadGroup) do(key interface{}, fn func() (interface{}, error)) (value interface{}, err error) {
+	g.lock.Lock()
+	if g.calls == nil {
+		g.calls = make(map[interface{}]*cacheCall)
+	}
+	if call, has := g.calls[key]; has {
+		g.lock.Unlock()
+		call.wg.Wait()
+		return call.value, call.err
+	}
+	call := &cacheCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.lock.Unlock()
+
+	defer func() {
+		if r := recover(); r != nil {
+			call.value, call.err = nil, fmt.Errorf("cache: loader panic: %v", r)
+			value, err = call.value, call.err
+		}
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+		call.wg.Done()
+	}()
+	call.value, call.err = fn()
+	return call.value, call.err
+}
+
+func (g *cacheLoadGroup) loading(key interface{}) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	_, has := g.calls[key]
+	return has
+}
+
+// GetOrLoad return cached value of key or call loader to fill it.
+// concurrent calls for the same key share a single loader call.
+// loader errors are returned and never cached.
+func (c *AppCached) GetOrLoad(key interface{}, ttl time.Duration, loader CacheLoader) (CacheAny, error) {
+	return c.GetOrLoadWith(key, CacheLoadOptions{TTL: ttl}, loader)
+}
+
+func (c *AppCached) GetOrLoadWith(key interface{}, options CacheLoadOptions, loader CacheLoader) (CacheAny, error) {
+	if raw, found := c.items.Get(key); found {
+		loaded, isLoaded := raw.(*cacheLoaded)
+		if !isLoaded {
+			return as(raw), nil
+		}
+		if loaded.NotFound {
+			return CacheAny{}, ErrCacheNotFound
+		}
+		if time.Now().UnixNano() < loaded.FreshUntil {
+			return as(loaded.Value), nil
+		}
+		// stale: serve old value and refresh in background, load recover loader panics
+		if !c.loads.loading(key) {
+			go func() {
+				if _, err := c.load(key, options, loader); err != nil && err != ErrCacheNotFound {
+					Log().Error().Err(err).Interface("key", key).Msg("Error when refresh stale cache")
+				}
+			}()
+		}
+		return as(loaded.Value), nil
+	}
+
+	value, err := c.load(key, options, loader)
+	if err != nil {
+		return CacheAny{}, err
+	}
+	return as(value), nil
+}
+
+func (c *AppCached) load(key interface{}, options CacheLoadOptions, loader CacheLoader) (interface{}, error) {
+	return c.loads.do(key, func() (interface{}, error) {
+		value, err := loader()
+		if err == ErrCacheNotFound {
+			if options.NegativeTTL > 0 {
+				c.items.SetWithTags(key, &cacheLoaded{NotFound: true}, options.NegativeTTL, options.Tags)
+			}
+			return nil, err
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry := &cacheLoaded{
+			Value: value,
+		}
+		dur := time.Duration(0)
+		if options.TTL > 0 {
+			entry.FreshUntil = time.Now().Add(options.TTL).UnixNano()
+			dur = options.TTL + options.StaleTTL
+		} else {
+			// never expire
+			entry.FreshUntil = 1<<63 - 1
+		}
+		c.items.SetWithTags(key, entry, dur, options.Tags)
+		return value, nil
+	})
+}
+
+// unwrap value stored by GetOrLoad
+func cacheUnwrap(raw interface{}) (interface{}, bool) {
+	if loaded, isLoaded := raw.(*cacheLoaded); isLoaded {
+		if loaded.NotFound {
+			return nil, false
+		}
+		return loaded.Value, true
+	}
+	return raw, true
+}
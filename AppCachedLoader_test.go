@@ -0,0 +1,109 @@
+package gocore
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheLoadGroup(t *testing.T) {
+	failed := errors.New("failed")
+	tests := []struct {
+		name 					string
+		fn 						func() (interface{}, error)
+		value 					interface{}
+		err 					string
+	}{
+		{"value", func() (interface{}, error) { return 42, nil }, 42, ""},
+		{"error", func() (interface{}, error) { return nil, failed }, nil, "failed"},
+		{"panic", func() (interface{}, error) { panic("boom") }, nil, "cache: loader panic: boom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var group cacheLoadGroup
+			var calls int32
+			release := make(chan struct{})
+			fn := func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return tt.fn()
+			}
+
+			const callers = 8
+			var wg sync.WaitGroup
+			values := make([]interface{}, callers)
+			errs := make([]error, callers)
+			for i := 0; i < callers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					values[i], errs[i] = group.do("key", fn)
+				}(i)
+			}
+			// let callers join the running call
+			for !group.loading("key") {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(10 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			if calls != 1 {
+				t.Errorf("fn called %d times", calls)
+			}
+			for i := 0; i < callers; i++ {
+				if values[i] != tt.value {
+					t.Errorf("value %v, want %v", values[i], tt.value)
+				}
+				if (errs[i] == nil) != (tt.err == "") || (errs[i] != nil && !strings.Contains(errs[i].Error(), tt.err)) {
+					t.Errorf("err %v, want %q", errs[i], tt.err)
+				}
+			}
+			if group.loading("key") {
+				t.Errorf("call not removed")
+			}
+			// next call run again
+			value, _ := group.do("key", func() (interface{}, error) { return "again", nil })
+			if value != "again" {
+				t.Errorf("next value %v", value)
+			}
+		})
+	}
+}
+
+func TestGetOrLoad(t *testing.T) {
+	cache := NewAppCached(AppCachedConfig{})
+	defer cache.Close()
+
+	var calls int32
+	loader := func() (interface{}, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	}
+	for i := 0; i < 3; i++ {
+		value, err := cache.GetOrLoad("key", time.Minute, loader)
+		if err != nil || value.Int() != 1 {
+			t.Fatalf("value %v err %v", value.Int(), err)
+		}
+	}
+
+	options := CacheLoadOptions{NegativeTTL: time.Minute}
+	missing := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, ErrCacheNotFound
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cache.GetOrLoadWith("missing", options, missing); err != ErrCacheNotFound {
+			t.Fatalf("err %v", err)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("loader called %d times", calls)
+	}
+
+	if _, err := cache.GetOrLoad("panic", time.Minute, func() (interface{}, error) { panic("boom") }); err == nil {
+		t.Errorf("panic not returned")
+	}
+}
@@ -0,0 +1,501 @@
+package gocore
+
+import (
+	"container/heap"
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CACHE_EVICT_LRU = 0
+	CACHE_EVICT_LFU = 1
+
+	CACHE_REASON_CAPACITY = 0
+	CACHE_REASON_EXPIRED  = 1
+	CACHE_REASON_REPLACED = 2
+	CACHE_REASON_DELETED  = 3
+
+	// size counted by CacheSizeOf for values it can not measure
+	CACHE_SIZE_UNKNOWN = 64
+)
+
+type AppCachedConfig struct {
+	// maximum number of entries, 0 for unlimited
+	MaxEntries 				int
+	// approximate byte budget of keys + values, 0 for unlimited
+	MaxBytes 				int64
+	// CACHE_EVICT_LRU or CACHE_EVICT_LFU
+	Policy 					int
+	// how often expired entries are swept ( default: 1 minute )
+	CleanupInterval 		time.Duration
+	// size of an entry, only called when MaxBytes is set ( default: CacheSizeOf ).
+	// set it when values are structs, CacheSizeOf only measure basic types
+	Sizer 					func(key interface{}, value interface{}) int64
+	// called ( outside of cache lock ) each time an entry leave the cache,
+	// reason is one of CACHE_REASON_*. Clear does not call it
+	OnEvicted 				func(key interface{}, value interface{}, reason int)
+}
+
+type CacheStats struct {
+	Hits 					uint64			`json:"hits"`
+	Misses 					uint64			`json:"misses"`
+	Evictions 				uint64			`json:"evictions"`
+	Expired 				uint64			`json:"expired"`
+	Entries 				int				`json:"entries"`
+	Bytes 					int64			`json:"bytes"`
+	MaxEntries 				int				`json:"max_entries"`
+	MaxBytes 				int64			`json:"max_bytes"`
+}
+
+// CacheStore is the storage behind AppCached
+type CacheStore interface {
+	Get(key interface{}) (interface{}, bool)
+	Set(key interface{}, value interface{}, dur time.Duration)
+	SetWithTags(key interface{}, value interface{}, dur time.Duration, tags []string)
+	Delete(key interface{}) bool
+	// InvalidateTag delete all entries having one of tags, return number of deleted entries
+	InvalidateTag(tags ...string) int
+	// DeletePrefix delete all string keys starting with prefix
+	DeletePrefix(prefix string) int
+	// Scan call callback for each key starting with prefix until it return false.
+	// empty prefix iterate all keys
+	Scan(prefix string, callback func(key interface{}) bool)
+	Len() int
+	Clear()
+	Stats() CacheStats
+	Close()
+}
+
+//-------------------------------------------------------------
+// Memory store
+//-------------------------------------------------------------
+type cacheEntry struct {
+	key 					interface{}
+	value 					interface{}
+	expires 				int64
+	size 					int64
+	tags 					[]string
+	freq 					uint64
+	tick 					uint64
+
+	// LRU position
+	element 				*list.Element
+	// LFU position
+	index 					int
+}
+
+type cacheEvicted struct {
+	key 					interface{}
+	value 					interface{}
+	reason 					int
+}
+
+type CacheMemoryStore struct {
+	lock 					sync.Mutex
+	config 					AppCachedConfig
+	items 					map[interface{}]*cacheEntry
+	tags 					map[string]map[interface{}]struct{}
+	bytes 					int64
+	tick 					uint64
+
+	lru 					*list.List
+	lfu 					cacheFrequencyHeap
+
+	stats 					CacheStats
+	close 					chan struct{}
+	closeOnce 				sync.Once
+}
+
+func NewCacheMemoryStore(config AppCachedConfig) *CacheMemoryStore {
+	if config.CleanupInterval <= 0 {
+		config.CleanupInterval = time.Minute
+	}
+	if config.Sizer == nil {
+		config.Sizer = CacheSizeOf
+	}
+	instance := &CacheMemoryStore{
+		config: config,
+		items: make(map[interface{}]*cacheEntry),
+		tags: make(map[string]map[interface{}]struct{}),
+		lru: list.New(),
+		close: make(chan struct{}),
+	}
+	go instance.janitor()
+	return instance
+}
+
+func (this *CacheMemoryStore) janitor() {
+	ticker := time.NewTicker(this.config.CleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			this.DeleteExpired()
+		case <-this.close:
+			return
+		}
+	}
+}
+
+func (this *CacheMemoryStore) Close() {
+	this.closeOnce.Do(func() {
+		close(this.close)
+	})
+}
+
+// DeleteExpired removes all expired entries immediately
+func (this *CacheMemoryStore) DeleteExpired() {
+	now := time.Now().UnixNano()
+	var evicted []cacheEvicted
+	this.lock.Lock()
+	for _, e := range this.items {
+		if e.expires > 0 && e.expires < now {
+			this.removeEntry(e)
+			this.stats.Expired++
+			evicted = append(evicted, cacheEvicted{e.key, e.value, CACHE_REASON_EXPIRED})
+		}
+	}
+	this.lock.Unlock()
+	this.notify(evicted)
+}
+
+func (this *CacheMemoryStore) Get(key interface{}) (interface{}, bool) {
+	var evicted []cacheEvicted
+	this.lock.Lock()
+	e, found := this.items[key]
+	if found && e.expires > 0 && e.expires < time.Now().UnixNano() {
+		this.removeEntry(e)
+		this.stats.Expired++
+		evicted = append(evicted, cacheEvicted{e.key, e.value, CACHE_REASON_EXPIRED})
+		found = false
+	}
+	if !found {
+		this.stats.Misses++
+		this.lock.Unlock()
+		this.notify(evicted)
+		return nil, false
+	}
+	this.stats.Hits++
+	this.touch(e)
+	value := e.value
+	this.lock.Unlock()
+	return value, true
+}
+
+// Peek return value without update hits or eviction order
+func (this *CacheMemoryStore) Peek(key interface{}) (interface{}, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	e, found := this.items[key]
+	if !found || (e.expires > 0 && e.expires < time.Now().UnixNano()) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (this *CacheMemoryStore) Set(key interface{}, value interface{}, dur time.Duration) {
+	this.SetWithTags(key, value, dur, nil)
+}
+
+func (this *CacheMemoryStore) SetWithTags(key interface{}, value interface{}, dur time.Duration, tags []string) {
+	var expires int64
+	if dur > 0 {
+		expires = time.Now().Add(dur).UnixNano()
+	}
+	var size int64
+	if this.config.MaxBytes > 0 {
+		size = this.config.Sizer(key, value)
+	}
+
+	var evicted []cacheEvicted
+	this.lock.Lock()
+	if old, has := this.items[key]; has {
+		this.removeEntry(old)
+		evicted = append(evicted, cacheEvicted{old.key, old.value, CACHE_REASON_REPLACED})
+	}
+	// entry bigger than whole budget will never fit
+	if this.config.MaxBytes > 0 && size > this.config.MaxBytes {
+		this.stats.Evictions++
+		this.lock.Unlock()
+		this.notify(append(evicted, cacheEvicted{key, value, CACHE_REASON_CAPACITY}))
+		return
+	}
+	e := &cacheEntry{
+		key: key,
+		value: value,
+		expires: expires,
+		size: size,
+		tags: tags,
+	}
+	this.items[key] = e
+	for _, tag := range tags {
+		if this.tags[tag] == nil {
+			this.tags[tag] = make(map[interface{}]struct{})
+		}
+		this.tags[tag][key] = struct{}{}
+	}
+	this.bytes += size
+	this.touch(e)
+	if this.config.Policy == CACHE_EVICT_LFU {
+		heap.Push(&this.lfu, e)
+	} else {
+		e.element = this.lru.PushFront(e)
+	}
+	evicted = append(evicted, this.shrink(e)...)
+	this.lock.Unlock()
+	this.notify(evicted)
+}
+
+func (this *CacheMemoryStore) Delete(key interface{}) bool {
+	var evicted []cacheEvicted
+	this.lock.Lock()
+	e, found := this.items[key]
+	if found {
+		this.removeEntry(e)
+		evicted = append(evicted, cacheEvicted{e.key, e.value, CACHE_REASON_DELETED})
+	}
+	this.lock.Unlock()
+	this.notify(evicted)
+	return found
+}
+
+func (this *CacheMemoryStore) InvalidateTag(tags ...string) int {
+	var evicted []cacheEvicted
+	this.lock.Lock()
+	for _, tag := range tags {
+		for key := range this.tags[tag] {
+			if e, found := this.items[key]; found {
+				this.removeEntry(e)
+				evicted = append(evicted, cacheEvicted{e.key, e.value, CACHE_REASON_DELETED})
+			}
+		}
+	}
+	this.lock.Unlock()
+	this.notify(evicted)
+	return len(evicted)
+}
+
+func (this *CacheMemoryStore) DeletePrefix(prefix string) int {
+	var evicted []cacheEvicted
+	this.lock.Lock()
+	for key, e := range this.items {
+		if cacheKeyHasPrefix(key, prefix) {
+			this.removeEntry(e)
+			evicted = append(evicted, cacheEvicted{e.key, e.value, CACHE_REASON_DELETED})
+		}
+	}
+	this.lock.Unlock()
+	this.notify(evicted)
+	return len(evicted)
+}
+
+func (this *CacheMemoryStore) Scan(prefix string, callback func(key interface{}) bool) {
+	now := time.Now().UnixNano()
+	this.lock.Lock()
+	keys := make([]interface{}, 0, len(this.items))
+	for key, e := range this.items {
+		if (e.expires == 0 || e.expires >= now) && cacheKeyHasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	this.lock.Unlock()
+	// callback run outside lock so it can modify cache
+	for _, key := range keys {
+		if !callback(key) {
+			return
+		}
+	}
+}
+
+func cacheKeyHasPrefix(key interface{}, prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	s, isString := key.(string)
+	return isString && strings.HasPrefix(s, prefix)
+}
+
+func (this *CacheMemoryStore) Len() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.items)
+}
+
+func (this *CacheMemoryStore) Clear() {
+	this.lock.Lock()
+	this.items = make(map[interface{}]*cacheEntry)
+	this.tags = make(map[string]map[interface{}]struct{})
+	this.lru.Init()
+	this.lfu = nil
+	this.bytes = 0
+	this.lock.Unlock()
+}
+
+func (this *CacheMemoryStore) Stats() CacheStats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	stats := this.stats
+	stats.Entries = len(this.items)
+	stats.Bytes = this.bytes
+	stats.MaxEntries = this.config.MaxEntries
+	stats.MaxBytes = this.config.MaxBytes
+	return stats
+}
+
+// must hold lock
+func (this *CacheMemoryStore) touch(e *cacheEntry) {
+	this.tick++
+	e.tick = this.tick
+	e.freq++
+	if this.config.Policy == CACHE_EVICT_LFU {
+		if e.index >= 0 && e.index < len(this.lfu) && this.lfu[e.index] == e {
+			heap.Fix(&this.lfu, e.index)
+		}
+	} else if e.element != nil {
+		this.lru.MoveToFront(e.element)
+	}
+}
+
+// must hold lock
+func (this *CacheMemoryStore) removeEntry(e *cacheEntry) {
+	delete(this.items, e.key)
+	this.bytes -= e.size
+	for _, tag := range e.tags {
+		if keys, has := this.tags[tag]; has {
+			delete(keys, e.key)
+			if len(keys) == 0 {
+				delete(this.tags, tag)
+			}
+		}
+	}
+	if e.element != nil {
+		this.lru.Remove(e.element)
+		e.element = nil
+	}
+	if e.index >= 0 && e.index < len(this.lfu) && this.lfu[e.index] == e {
+		heap.Remove(&this.lfu, e.index)
+	}
+}
+
+// must hold lock, evict until cache fit in its limits. keep is never evicted
+func (this *CacheMemoryStore) shrink(keep *cacheEntry) []cacheEvicted {
+	var evicted []cacheEvicted
+	for this.overLimit() {
+		victim := this.victim(keep)
+		if victim == nil {
+			break
+		}
+		this.removeEntry(victim)
+		this.stats.Evictions++
+		evicted = append(evicted, cacheEvicted{victim.key, victim.value, CACHE_REASON_CAPACITY})
+	}
+	return evicted
+}
+
+func (this *CacheMemoryStore) overLimit() bool {
+	if this.config.MaxEntries > 0 && len(this.items) > this.config.MaxEntries {
+		return true
+	}
+	if this.config.MaxBytes > 0 && this.bytes > this.config.MaxBytes {
+		return true
+	}
+	return false
+}
+
+func (this *CacheMemoryStore) victim(keep *cacheEntry) *cacheEntry {
+	if this.config.Policy == CACHE_EVICT_LFU {
+		if len(this.lfu) == 0 {
+			return nil
+		}
+		if this.lfu[0] != keep {
+			return this.lfu[0]
+		}
+		// newest entry has lowest frequency, take next smallest child
+		var next *cacheEntry
+		for _, i := range []int{1, 2} {
+			if i < len(this.lfu) && (next == nil || this.lfu.Less(i, next.index)) {
+				next = this.lfu[i]
+			}
+		}
+		return next
+	}
+	for el := this.lru.Back(); el != nil; el = el.Prev() {
+		if e := el.Value.(*cacheEntry); e != keep {
+			return e
+		}
+	}
+	return nil
+}
+
+func (this *CacheMemoryStore) notify(evicted []cacheEvicted) {
+	if this.config.OnEvicted == nil {
+		return
+	}
+	for _, e := range evicted {
+		this.config.OnEvicted(e.key, e.value, e.reason)
+	}
+}
+
+//-------------------------------------------------------------
+// LFU heap: lowest frequency first, oldest access break ties
+//-------------------------------------------------------------
+type cacheFrequencyHeap []*cacheEntry
+
+func (h cacheFrequencyHeap) Len() int { return len(h) }
+func (h cacheFrequencyHeap) Less(i, j int) bool {
+	if h[i].freq == h[j].freq {
+		return h[i].tick < h[j].tick
+	}
+	return h[i].freq < h[j].freq
+}
+func (h cacheFrequencyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *cacheFrequencyHeap) Push(x interface{}) {
+	e := x.(*cacheEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *cacheFrequencyHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+	return e
+}
+
+//-------------------------------------------------------------
+// Size estimation
+//-------------------------------------------------------------
+
+// CacheSizeOf return approximate memory used by key and value.
+// Basic types are counted directly, other values count as CACHE_SIZE_UNKNOWN.
+func CacheSizeOf(key interface{}, value interface{}) int64 {
+	return cacheValueSize(key) + cacheValueSize(value)
+}
+
+func cacheValueSize(v interface{}) int64 {
+	switch t := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(t))
+	case []byte:
+		return int64(len(t))
+	case bool, int8, uint8:
+		return 1
+	case int16, uint16:
+		return 2
+	case int32, uint32, float32:
+		return 4
+	case int, uint, int64, uint64, float64, uintptr:
+		return 8
+	}
+	return CACHE_SIZE_UNKNOWN
+}
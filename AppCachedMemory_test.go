@@ -0,0 +1,142 @@
+package gocore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheMemoryStoreEviction(t *testing.T) {
+	tests := []struct {
+		name 					string
+		config 					AppCachedConfig
+		// keys read after all sets, before the last one
+		read 					[]string
+		keep 					[]string
+		gone 					[]string
+	}{
+		{
+			name: "lru evict least recently used",
+			config: AppCachedConfig{MaxEntries: 3, Policy: CACHE_EVICT_LRU},
+			read: []string{"a"},
+			keep: []string{"a", "c", "d"},
+			gone: []string{"b"},
+		},
+		{
+			name: "lfu evict least frequently used",
+			config: AppCachedConfig{MaxEntries: 3, Policy: CACHE_EVICT_LFU},
+			read: []string{"a", "a", "c"},
+			keep: []string{"a", "c", "d"},
+			gone: []string{"b"},
+		},
+		{
+			name: "bytes budget",
+			config: AppCachedConfig{MaxBytes: 6, Policy: CACHE_EVICT_LRU},
+			keep: []string{"c", "d"},
+			gone: []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reasons []int
+			tt.config.OnEvicted = func(key interface{}, value interface{}, reason int) {
+				reasons = append(reasons, reason)
+			}
+			store := NewCacheMemoryStore(tt.config)
+			defer store.Close()
+			for _, key := range []string{"a", "b", "c"} {
+				store.Set(key, "xx", 0)
+			}
+			for _, key := range tt.read {
+				store.Get(key)
+			}
+			store.Set("d", "xx", 0)
+			for _, key := range tt.keep {
+				if _, found := store.Peek(key); !found {
+					t.Errorf("%s evicted", key)
+				}
+			}
+			for _, key := range tt.gone {
+				if _, found := store.Peek(key); found {
+					t.Errorf("%s not evicted", key)
+				}
+			}
+			if len(reasons) != len(tt.gone) {
+				t.Fatalf("evicted %d entries, want %d", len(reasons), len(tt.gone))
+			}
+			for _, reason := range reasons {
+				if reason != CACHE_REASON_CAPACITY {
+					t.Errorf("reason %d, want capacity", reason)
+				}
+			}
+			if stats := store.Stats(); stats.Evictions != uint64(len(tt.gone)) {
+				t.Errorf("stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestCacheMemoryStoreReasons(t *testing.T) {
+	reasons := map[interface{}]int{}
+	store := NewCacheMemoryStore(AppCachedConfig{
+		OnEvicted: func(key interface{}, value interface{}, reason int) {
+			reasons[key] = reason
+		},
+	})
+	defer store.Close()
+
+	store.Set("replaced", 1, 0)
+	store.Set("replaced", 2, 0)
+	store.Set("deleted", 1, 0)
+	store.Delete("deleted")
+	store.SetWithTags("tagged", 1, 0, []string{"t"})
+	store.Set("prefix|1", 1, 0)
+	store.Set("expired", 1, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	if count := store.InvalidateTag("t"); count != 1 {
+		t.Errorf("InvalidateTag deleted %d", count)
+	}
+	if count := store.DeletePrefix("prefix|"); count != 1 {
+		t.Errorf("DeletePrefix deleted %d", count)
+	}
+	if _, found := store.Get("expired"); found {
+		t.Errorf("expired entry found")
+	}
+	if value, _ := store.Get("replaced"); value != 2 {
+		t.Errorf("replaced value %v", value)
+	}
+
+	want := map[interface{}]int{
+		"replaced": CACHE_REASON_REPLACED,
+		"deleted": CACHE_REASON_DELETED,
+		"tagged": CACHE_REASON_DELETED,
+		"prefix|1": CACHE_REASON_DELETED,
+		"expired": CACHE_REASON_EXPIRED,
+	}
+	for key, reason := range want {
+		if got, has := reasons[key]; !has || got != reason {
+			t.Errorf("%v reason %d, want %d", key, got, reason)
+		}
+	}
+	if store.Len() != 1 {
+		t.Errorf("len %d", store.Len())
+	}
+}
+
+func TestCacheSizeOf(t *testing.T) {
+	tests := []struct {
+		key 					interface{}
+		value 					interface{}
+		size 					int64
+	}{
+		{"key", "value", 8},
+		{"key", []byte("ab"), 5},
+		{1, int32(1), 12},
+		{"key", struct{ A string }{"a"}, 3 + CACHE_SIZE_UNKNOWN},
+	}
+	for _, tt := range tests {
+		if size := CacheSizeOf(tt.key, tt.value); size != tt.size {
+			t.Errorf("CacheSizeOf(%v, %v) = %d, want %d", tt.key, tt.value, size, tt.size)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package gocore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// add key to tag set, tag set live as long as its longest entry
+var cacheRedisTagScript = redis.NewScript(`
+local created = redis.call('SCARD', KEYS[1]) == 0
+redis.call('SADD', KEYS[1], ARGV[1])
+local want = tonumber(ARGV[2])
+local ttl = redis.call('PTTL', KEYS[1])
+if want <= 0 then
+	redis.call('PERSIST', KEYS[1])
+elseif created or (ttl >= 0 and ttl < want) then
+	redis.call('PEXPIRE', KEYS[1], want)
+end
+return 1
+`)
+
+// CacheRedisStore keep cache entries in redis so they are shared between instances.
+// keys are converted to string, values are stored as json and decoded back to
+// generic values ( string, json.Number, bool, map, slice ), use CacheAny.Decode to get structs.
+type CacheRedisStore struct {
+	client 					redis.Cmdable
+	prefix 					string
+
+	hits 					uint64
+	misses 					uint64
+}
+
+// cacheRedisItem is json stored for each entry
+type cacheRedisItem struct {
+	Value 					interface{}		`json:"v"`
+	Loaded 					bool			`json:"l,omitempty"`
+	FreshUntil 				int64			`json:"f,omitempty"`
+	NotFound 				bool			`json:"n,omitempty"`
+}
+
+// prefix format: "cache|", empty prefix is replaced by "cache|" so Clear never touch other keys
+func NewCacheRedisStore(client redis.Cmdable, prefix string) *CacheRedisStore {
+	if prefix == "" {
+		prefix = "cache|"
+	}
+	return &CacheRedisStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (this *CacheRedisStore) key(key interface{}) string {
+	if s, isString := key.(string); isString {
+		return this.prefix + s
+	}
+	return this.prefix + fmt.Sprint(key)
+}
+
+func (this *CacheRedisStore) tagKey(tag string) string {
+	return this.prefix + "tag|" + tag
+}
+
+func (this *CacheRedisStore) Get(key interface{}) (interface{}, bool) {
+	data, err := this.client.Get(this.key(key)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			Log().Error().Err(err).Interface("key", key).Msg("Error when get cache from redis")
+		}
+		atomic.AddUint64(&this.misses, 1)
+		return nil, false
+	}
+	var item cacheRedisItem
+	if err = json.Unmarshal(data, &item); err != nil {
+		Log().Error().Err(err).Interface("key", key).Msg("Error when decode cache from redis")
+		atomic.AddUint64(&this.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&this.hits, 1)
+	if item.Loaded {
+		return &cacheLoaded{
+			Value: item.Value,
+			FreshUntil: item.FreshUntil,
+			NotFound: item.NotFound,
+		}, true
+	}
+	return item.Value, true
+}
+
+func (this *CacheRedisStore) Set(key interface{}, value interface{}, dur time.Duration) {
+	this.SetWithTags(key, value, dur, nil)
+}
+
+func (this *CacheRedisStore) SetWithTags(key interface{}, value interface{}, dur time.Duration, tags []string) {
+	item := cacheRedisItem{
+		Value: value,
+	}
+	if loaded, isLoaded := value.(*cacheLoaded); isLoaded {
+		item.Value = loaded.Value
+		item.Loaded = true
+		item.FreshUntil = loaded.FreshUntil
+		item.NotFound = loaded.NotFound
+	}
+	data, err := json.Marshal(&item)
+	if err != nil {
+		Log().Error().Err(err).Interface("key", key).Msg("Error when encode cache for redis")
+		return
+	}
+	if dur < 0 {
+		dur = 0
+	}
+	redisKey := this.key(key)
+	if err = this.client.Set(redisKey, data, dur).Err(); err != nil {
+		Log().Error().Err(err).Interface("key", key).Msg("Error when set cache to redis")
+		return
+	}
+	for _, tag := range tags {
+		err = cacheRedisTagScript.Run(this.client, []string{this.tagKey(tag)}, redisKey, int64(dur/time.Millisecond)).Err()
+		if err != nil {
+			Log().Error().Err(err).Str("tag", tag).Msg("Error when tag cache in redis")
+		}
+	}
+}
+
+func (this *CacheRedisStore) Delete(key interface{}) bool {
+	n, err := this.client.Del(this.key(key)).Result()
+	return err == nil && n > 0
+}
+
+func (this *CacheRedisStore) InvalidateTag(tags ...string) int {
+	count := 0
+	for _, tag := range tags {
+		tagKey := this.tagKey(tag)
+		keys, err := this.client.SMembers(tagKey).Result()
+		if err != nil {
+			Log().Error().Err(err).Str("tag", tag).Msg("Error when read cache tag from redis")
+			continue
+		}
+		count += this.deleteKeys(keys)
+		this.client.Del(tagKey)
+	}
+	return count
+}
+
+func (this *CacheRedisStore) DeletePrefix(prefix string) int {
+	var keys []string
+	this.scanRaw(prefix, func(redisKey string) bool {
+		keys = append(keys, redisKey)
+		return true
+	})
+	return this.deleteKeys(keys)
+}
+
+func (this *CacheRedisStore) Scan(prefix string, callback func(key interface{}) bool) {
+	this.scanRaw(prefix, func(redisKey string) bool {
+		return callback(strings.TrimPrefix(redisKey, this.prefix))
+	})
+}
+
+// scan redis keys under store prefix, tag sets are skipped
+func (this *CacheRedisStore) scanRaw(prefix string, callback func(redisKey string) bool) {
+	tagPrefix := this.prefix + "tag|"
+	this.scanPattern(cacheRedisEscapePattern(this.prefix + prefix) + "*", func(redisKey string) bool {
+		if strings.HasPrefix(redisKey, tagPrefix) {
+			return true
+		}
+		return callback(redisKey)
+	})
+}
+
+// SCAN only walk one node, on cluster every master is scanned
+func (this *CacheRedisStore) scanPattern(match string, callback func(redisKey string) bool) {
+	scanNode := func(client redis.Cmdable) bool {
+		iter := client.Scan(0, match, 500).Iterator()
+		for iter.Next() {
+			if !callback(iter.Val()) {
+				return false
+			}
+		}
+		if err := iter.Err(); err != nil {
+			Log().Error().Err(err).Str("match", match).Msg("Error when scan cache keys in redis")
+		}
+		return true
+	}
+	cluster, isCluster := this.client.(*redis.ClusterClient)
+	if !isCluster {
+		scanNode(this.client)
+		return
+	}
+	stopped := false
+	var lock sync.Mutex
+	_ = cluster.ForEachMaster(func(client *redis.Client) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if !stopped && !scanNode(client) {
+			stopped = true
+		}
+		return nil
+	})
+}
+
+// delete one by one in a pipeline so it also work when keys live on different cluster slots
+func (this *CacheRedisStore) deleteKeys(keys []string) int {
+	if len(keys) == 0 {
+		return 0
+	}
+	pipe := this.client.Pipeline()
+	cmds := make([]*redis.IntCmd, len(keys))
+	for i, k := range keys {
+		cmds[i] = pipe.Del(k)
+	}
+	_, _ = pipe.Exec()
+	count := 0
+	for _, cmd := range cmds {
+		count += int(cmd.Val())
+	}
+	return count
+}
+
+func (this *CacheRedisStore) Len() int {
+	count := 0
+	this.scanRaw("", func(string) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+func (this *CacheRedisStore) Clear() {
+	var keys []string
+	this.scanPattern(cacheRedisEscapePattern(this.prefix) + "*", func(redisKey string) bool {
+		keys = append(keys, redisKey)
+		return true
+	})
+	this.deleteKeys(keys)
+}
+
+// Stats of redis store only count hits and misses of this instance
+func (this *CacheRedisStore) Stats() CacheStats {
+	return CacheStats{
+		Hits: atomic.LoadUint64(&this.hits),
+		Misses: atomic.LoadUint64(&this.misses),
+	}
+}
+
+func (this *CacheRedisStore) Close() {}
+
+func cacheRedisEscapePattern(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	return replacer.Replace(s)
+}
+
+var _ CacheStore = (*CacheMemoryStore)(nil)
+var _ CacheStore = (*CacheRedisStore)(nil)
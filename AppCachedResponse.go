@@ -0,0 +1,385 @@
+package gocore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+type (
+	// ResponseCacheConfig defines the config for response cache middleware.
+	ResponseCacheConfig struct {
+		// Skipper defines a function to skip middleware.
+		Skipper 				middleware.Skipper
+
+		// Cache store responses. Optional. Default value Cache().
+		Cache 					*AppCached
+
+		// TTL of cached response when handler do not send Cache-Control max-age.
+		// Optional. Default value 1 minute.
+		TTL 					time.Duration
+
+		// KeyPrefix is prepended to every cache key. Optional. Default value "http|".
+		KeyPrefix 				string
+
+		// QueryParams included in cache key. nil means whole query string.
+		QueryParams 			[]string
+
+		// Headers included in cache key, ex: Accept-Language
+		Headers 				[]string
+
+		// PerUser cache a separate response for each user returned by UserID,
+		// requests without user are not cached.
+		PerUser 				bool
+
+		// UserID return current user of request, it must not trust client headers.
+		// Optional. Default user authenticated by Auth middleware.
+		UserID 					func(c echo.Context) string
+
+		// Tags attached to cached response, used by InvalidateTag.
+		Tags 					func(c echo.Context) []string
+
+		// Statuses that can be cached. Optional. Default value [200].
+		// JSON bodies with a negative "code" ( ResultFail ) are never cached.
+		Statuses 				[]int
+	}
+
+	// cachedResponse is what stored in cache for a request
+	cachedResponse struct {
+		Status 					int				`json:"status"`
+		Header 					http.Header		`json:"header"`
+		Body 					[]byte			`json:"body"`
+		ETag 					string			`json:"etag"`
+		LastModified 			int64			`json:"last_modified"`
+	}
+
+	ResponseCache struct {
+		config 					ResponseCacheConfig
+	}
+)
+
+var (
+	// DefaultResponseCacheConfig is the default response cache middleware config.
+	DefaultResponseCacheConfig = ResponseCacheConfig{
+		Skipper: middleware.DefaultSkipper,
+		TTL: time.Minute,
+		KeyPrefix: "http|",
+		UserID: func(c echo.Context) string {
+			if user := AuthUser(c); user != nil {
+				return user.UserID
+			}
+			return ""
+		},
+		Statuses: []int{http.StatusOK},
+	}
+)
+
+func NewResponseCache(config ResponseCacheConfig) *ResponseCache {
+	// Defaults
+	if config.Skipper == nil {
+		config.Skipper = DefaultResponseCacheConfig.Skipper
+	}
+	if config.Cache == nil {
+		config.Cache = Cache()
+	}
+	if config.TTL <= 0 {
+		config.TTL = DefaultResponseCacheConfig.TTL
+	}
+	if config.KeyPrefix == "" {
+		config.KeyPrefix = DefaultResponseCacheConfig.KeyPrefix
+	}
+	if config.UserID == nil {
+		config.UserID = DefaultResponseCacheConfig.UserID
+	}
+	if len(config.Statuses) == 0 {
+		config.Statuses = DefaultResponseCacheConfig.Statuses
+	}
+	return &ResponseCache{
+		config: config,
+	}
+}
+
+// Middleware cache GET and HEAD responses
+func (this *ResponseCache) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if this.config.Skipper(c) || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+				return next(c)
+			}
+			reqControl := parseCacheControl(req.Header.Get("Cache-Control"))
+			if _, noStore := reqControl["no-store"]; noStore {
+				return next(c)
+			}
+			if this.config.PerUser && this.config.UserID(c) == "" {
+				return next(c)
+			}
+
+			key := this.Key(c)
+			if _, noCache := reqControl["no-cache"]; !noCache {
+				if cached, found := this.load(key); found {
+					c.Response().Header().Set("X-Cache", "HIT")
+					return cached.write(c)
+				}
+			}
+
+			// record response while write it to client
+			c.Response().Header().Set("X-Cache", "MISS")
+			recorder := &responseCacheRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = recorder
+			err := next(c)
+			c.Response().Writer = recorder.ResponseWriter
+			// HEAD has no body to share with GET
+			if err != nil || req.Method == http.MethodHead {
+				return err
+			}
+			this.store(c, key, recorder.body.Bytes())
+			return nil
+		}
+	}
+}
+
+// InvalidateOnSuccess is a middleware for write handlers, it invalidate tags
+// when handler finish without error and with non error status
+func (this *ResponseCache) InvalidateOnSuccess(tags ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			if err == nil && c.Response().Status < http.StatusBadRequest {
+				this.InvalidateTag(tags...)
+			}
+			return err
+		}
+	}
+}
+
+// InvalidateTag remove every cached entry having one of tags
+func (this *ResponseCache) InvalidateTag(tags ...string) {
+	this.config.Cache.InvalidateTag(tags...)
+}
+
+// InvalidatePath remove cached responses of path for all query, headers and users
+func (this *ResponseCache) InvalidatePath(path string) {
+	path = url.PathEscape(path)
+	this.config.Cache.DeletePrefix(this.config.KeyPrefix + http.MethodGet + " " + path + "|")
+	this.config.Cache.Delete(this.config.KeyPrefix + http.MethodGet + " " + path)
+}
+
+// Key build cache key of request from method, path, selected query params, headers and user.
+// every part is escaped so separators sent by client can not make two requests share a key
+func (this *ResponseCache) Key(c echo.Context) string {
+	req := c.Request()
+	var b strings.Builder
+	b.WriteString(this.config.KeyPrefix)
+	// HEAD share cached GET response
+	b.WriteString(http.MethodGet)
+	b.WriteString(" ")
+	b.WriteString(url.PathEscape(req.URL.Path))
+	query := req.URL.Query()
+	if this.config.QueryParams == nil {
+		names := make([]string, 0, len(query))
+		for name := range query {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			writeCacheKeyPart(&b, "q:", name, query[name])
+		}
+	} else {
+		for _, name := range this.config.QueryParams {
+			writeCacheKeyPart(&b, "q:", name, query[name])
+		}
+	}
+	for _, name := range this.config.Headers {
+		writeCacheKeyPart(&b, "h:", name, req.Header[http.CanonicalHeaderKey(name)])
+	}
+	if this.config.PerUser {
+		writeCacheKeyPart(&b, "u:", "", []string{this.config.UserID(c)})
+	}
+	return b.String()
+}
+
+func writeCacheKeyPart(b *strings.Builder, kind string, name string, values []string) {
+	b.WriteString("|")
+	b.WriteString(kind)
+	b.WriteString(url.QueryEscape(name))
+	b.WriteString("=")
+	for i, value := range values {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(url.QueryEscape(value))
+	}
+}
+
+func (this *ResponseCache) load(key string) (*cachedResponse, bool) {
+	var cached cachedResponse
+	if err := this.config.Cache.Get(key).Decode(&cached); err != nil {
+		return nil, false
+	}
+	return &cached, true
+}
+
+func (this *ResponseCache) store(c echo.Context, key string, body []byte) {
+	res := c.Response()
+	if !this.cacheableStatus(res.Status) || res.Header().Get("Set-Cookie") != "" || failedResult(res.Header(), body) {
+		return
+	}
+	ttl := this.config.TTL
+	resControl := parseCacheControl(res.Header().Get("Cache-Control"))
+	if _, noStore := resControl["no-store"]; noStore {
+		return
+	}
+	if _, private := resControl["private"]; private && !this.config.PerUser {
+		return
+	}
+	if age, has := resControl["s-maxage"]; has {
+		ttl = parseCacheControlSeconds(age, ttl)
+	} else if age, has := resControl["max-age"]; has {
+		ttl = parseCacheControlSeconds(age, ttl)
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	cached := &cachedResponse{
+		Status: res.Status,
+		Header: http.Header{},
+		Body: body,
+		ETag: res.Header().Get("ETag"),
+		LastModified: time.Now().Unix(),
+	}
+	for name, values := range res.Header() {
+		if name == "X-Cache" {
+			continue
+		}
+		cached.Header[name] = append([]string(nil), values...)
+	}
+	if cached.ETag == "" {
+		sum := sha1.Sum(body)
+		cached.ETag = `"` + hex.EncodeToString(sum[:]) + `"`
+	}
+	if lm := res.Header().Get("Last-Modified"); lm != "" {
+		if t, err := http.ParseTime(lm); err == nil {
+			cached.LastModified = t.Unix()
+		}
+	}
+	var tags []string
+	if this.config.Tags != nil {
+		tags = this.config.Tags(c)
+	}
+	this.config.Cache.SetWithTags(key, cached, ttl, tags...)
+}
+
+func (this *ResponseCache) cacheableStatus(status int) bool {
+	for _, s := range this.config.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// failedResult detect ResultFail payloads sent with status 200
+func failedResult(header http.Header, body []byte) bool {
+	if !strings.HasPrefix(header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		return false
+	}
+	var result struct {
+		Code 					*int			`json:"code"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return false
+	}
+	return result.Code != nil && *result.Code < 0
+}
+
+// write cached response or 304 when client already have it
+func (this *cachedResponse) write(c echo.Context) error {
+	req := c.Request()
+	header := c.Response().Header()
+	for name, values := range this.Header {
+		header[name] = values
+	}
+	header.Set("ETag", this.ETag)
+	header.Set("Last-Modified", time.Unix(this.LastModified, 0).UTC().Format(http.TimeFormat))
+
+	if this.notModified(req) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	c.Response().WriteHeader(this.Status)
+	if req.Method == http.MethodHead {
+		return nil
+	}
+	_, err := c.Response().Write(this.Body)
+	return err
+}
+
+func (this *cachedResponse) notModified(req *http.Request) bool {
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(this.ETag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if since := req.Header.Get("If-Modified-Since"); since != "" {
+		if t, err := http.ParseTime(since); err == nil {
+			return this.LastModified <= t.Unix()
+		}
+	}
+	return false
+}
+
+// parse Cache-Control header into directive -> value
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value := part, ""
+		if i := strings.Index(part, "="); i >= 0 {
+			name, value = part[:i], strings.Trim(part[i+1:], `"`)
+		}
+		directives[strings.ToLower(name)] = value
+	}
+	return directives
+}
+
+func parseCacheControlSeconds(value string, fallback time.Duration) time.Duration {
+	seconds, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// responseCacheRecorder copy body while writing it to the client
+type responseCacheRecorder struct {
+	http.ResponseWriter
+	body 						bytes.Buffer
+}
+
+func (w *responseCacheRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseCacheRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
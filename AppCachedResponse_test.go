@@ -0,0 +1,130 @@
+package gocore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestResponseCacheKey(t *testing.T) {
+	e := echo.New()
+	cache := NewResponseCache(ResponseCacheConfig{
+		Cache: NewAppCached(AppCachedConfig{}),
+		Headers: []string{"Accept-Language"},
+		PerUser: true,
+		UserID: func(c echo.Context) string { return c.Request().Header.Get("X-Test-User") },
+	})
+	key := func(target string, user string) string {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-Test-User", user)
+		return cache.Key(e.NewContext(req, httptest.NewRecorder()))
+	}
+	tests := []struct {
+		name 					string
+		a 						string
+		b 						string
+	}{
+		{"separator in value", "/p?a=1%7Cq:b%3D2", "/p?a=1&b=2"},
+		{"comma in value", "/p?a=x,y", "/p?a=x&a=y"},
+		{"separator in name", "/p?a%3D1%7Cq:b=2", "/p?a=1&b=2"},
+		{"separator in path", "/p%7Cq:a=1", "/p?a=1"},
+	}
+	for _, tt := range tests {
+		if key(tt.a, "u1") == key(tt.b, "u1") {
+			t.Errorf("%s: %s and %s share key %s", tt.name, tt.a, tt.b, key(tt.a, "u1"))
+		}
+	}
+	if key("/p?b=2&a=1", "u1") != key("/p?a=1&b=2", "u1") {
+		t.Errorf("query order change key")
+	}
+	if key("/p", "u1") == key("/p", "u1|u:u2") || key("/p", "u1") == key("/p", "u2") {
+		t.Errorf("users share key")
+	}
+}
+
+func TestResponseCacheMiddleware(t *testing.T) {
+	e := echo.New()
+	cache := NewResponseCache(ResponseCacheConfig{Cache: NewAppCached(AppCachedConfig{})})
+	calls := 0
+	handler := func(c echo.Context) error {
+		calls++
+		switch c.QueryParam("mode") {
+		case "no-store":
+			c.Response().Header().Set("Cache-Control", "no-store")
+		case "cookie":
+			c.SetCookie(&http.Cookie{Name: "s", Value: "1"})
+		case "fail":
+			return c.JSON(http.StatusOK, echo.Map{"code": -1, "msg": "denied", "data": nil})
+		case "error":
+			return c.String(http.StatusInternalServerError, "boom")
+		}
+		return c.String(http.StatusOK, "body")
+	}
+	e.GET("/r", handler, cache.Middleware())
+	serve := func(target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("/r", nil)
+	if w.Header().Get("X-Cache") != "MISS" || w.Body.String() != "body" {
+		t.Fatalf("first request %s %q", w.Header().Get("X-Cache"), w.Body.String())
+	}
+	w = serve("/r", nil)
+	if w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "body" || calls != 1 {
+		t.Fatalf("second request %s %q calls %d", w.Header().Get("X-Cache"), w.Body.String(), calls)
+	}
+	etag := w.Header().Get("ETag")
+	if w = serve("/r", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("If-None-Match: %d", w.Code)
+	}
+	if w = serve("/r", http.Header{"Cache-Control": {"no-cache"}}); w.Header().Get("X-Cache") != "MISS" || calls != 2 {
+		t.Errorf("request no-cache: %s calls %d", w.Header().Get("X-Cache"), calls)
+	}
+	if w = serve("/r", http.Header{"Cache-Control": {"no-store"}}); w.Header().Get("X-Cache") != "" || calls != 3 {
+		t.Errorf("request no-store: %s calls %d", w.Header().Get("X-Cache"), calls)
+	}
+
+	// responses never stored
+	for _, mode := range []string{"no-store", "cookie", "fail", "error"} {
+		before := calls
+		serve("/r?mode=" + mode, nil)
+		if w = serve("/r?mode=" + mode, nil); w.Header().Get("X-Cache") != "MISS" || calls != before + 2 {
+			t.Errorf("%s response was cached", mode)
+		}
+	}
+}
+
+func TestResponseCachePerUser(t *testing.T) {
+	e := echo.New()
+	cache := NewResponseCache(ResponseCacheConfig{
+		Cache: NewAppCached(AppCachedConfig{}),
+		PerUser: true,
+		UserID: func(c echo.Context) string { return c.Request().Header.Get("X-Test-User") },
+	})
+	e.GET("/me", func(c echo.Context) error {
+		return c.String(http.StatusOK, "hello " + c.Request().Header.Get("X-Test-User"))
+	}, cache.Middleware())
+	serve := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("X-Test-User", user)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		return w
+	}
+	serve("u1")
+	if w := serve("u2"); w.Body.String() != "hello u2" {
+		t.Errorf("u2 got %q", w.Body.String())
+	}
+	// anonymous requests bypass cache
+	if w := serve(""); w.Header().Get("X-Cache") != "" {
+		t.Errorf("anonymous request cached: %s", w.Header().Get("X-Cache"))
+	}
+}
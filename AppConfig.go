@@ -14,7 +14,6 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
-	"math/rand"
 	"net"
 	"net/http"
 	"os"
@@ -148,54 +147,25 @@ func FileIsExists(location string) bool {
 
 
 const TL_API_letterBytes = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+// Deprecated: codes are generated from crypto/rand, these constants are kept for existing callers
 const (
 	TL_API_letterIdxBits = 6                    // 6 bits to represent a letter index
 	TL_API_letterIdxMask = 1<<TL_API_letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
 	TL_API_letterIdxMax  = 63 / TL_API_letterIdxBits   // # of letter indices fitting in 63 bits
 )
+// GetUniqueCode return random code of digits and upper case letters from crypto/rand
 func GetUniqueCode(length int) string {
-	//===============================================================================
-	// We using this method:
-	// source: https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-golang
-	// NOTE:
-	// If using it on multi-threads or goroutine better pass each thread/goroutine 1 Random source
-	// or for simple just add Mutex lock here to lock source when using it.
-	//===============================================================================
-	var TL_API_SRC_RANDOM = rand.NewSource(time.Now().UnixNano())
-	b := make([]byte, length)
-	for i, cache, remain := length-1, TL_API_SRC_RANDOM.Int63(), TL_API_letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = TL_API_SRC_RANDOM.Int63(), TL_API_letterIdxMax
-		}
-		if idx := int(cache & TL_API_letterIdxMask); idx < len(TL_API_letterBytes) {
-			b[i] = TL_API_letterBytes[idx]
-			i--
-		}
-		cache >>= TL_API_letterIdxBits
-		remain--
-	}
-	return string(b)
+	return secureString(TL_API_letterBytes, length)
 }
 
 const TL_API_numberBytes = "0123456789"
+// GetUniqueNumberCode return random code of digits from crypto/rand, safe for OTP
 func GetUniqueNumberCode(length int) string {
-	b := make([]byte, length)
-	var TL_API_SRC_RANDOM = rand.NewSource(time.Now().UnixNano())
-	for i, cache, remain := length-1, TL_API_SRC_RANDOM.Int63(), TL_API_letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = TL_API_SRC_RANDOM.Int63(), TL_API_letterIdxMax
-		}
-		if idx := int(cache & TL_API_letterIdxMask); idx < len(TL_API_numberBytes) {
-			b[i] = TL_API_numberBytes[idx]
-			i--
-		}
-		cache >>= TL_API_letterIdxBits
-		remain--
-	}
-	return string(b)
+	return secureString(TL_API_numberBytes, length)
 }
 
 
+// MD5Hash is not safe for passwords, use PasswordHasher
 func MD5Hash(text string) string {
 	hasher := md5.New()
 	hasher.Write([]byte(text))
@@ -0,0 +1,416 @@
+package gocore
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-redis/redis/v7"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PASSWORD_ARGON2ID = "argon2id"
+	PASSWORD_BCRYPT = "bcrypt"
+
+	KEY_LOGIN_FAIL = "k_login_fail|"
+	KEY_LOGIN_LOCK = "k_login_lock|"
+
+	BCRYPT_MAX_PASSWORD = 72
+
+	// password policy violations
+	PASSWORD_TOO_SHORT = "too_short"
+	PASSWORD_TOO_LONG = "too_long"
+	PASSWORD_NEED_UPPER = "need_upper"
+	PASSWORD_NEED_LOWER = "need_lower"
+	PASSWORD_NEED_DIGIT = "need_digit"
+	PASSWORD_NEED_SYMBOL = "need_symbol"
+	PASSWORD_TOO_COMMON = "too_common"
+	PASSWORD_CONTAIN_USER_DATA = "contain_user_data"
+)
+
+var ErrPasswordFormat = errors.New("password: unknown hash format")
+
+//======================================================================================
+// Hashing
+//======================================================================================
+
+type PasswordHasherConfig struct {
+	// PASSWORD_ARGON2ID ( default ) or PASSWORD_BCRYPT, used for new hashes
+	Algorithm 					string
+	// argon2id parameters ( default: 3 passes, 64 MiB, 2 threads, 32 bytes key, 16 bytes salt )
+	Time 						uint32
+	MemoryKiB 					uint32
+	Threads 					uint8
+	KeyLength 					uint32
+	SaltLength 					int
+	// bcrypt cost ( default: 12 )
+	BcryptCost 					int
+	// accept unsalted md5 hex hashes made by MD5Hash, they are rehashed on successful login
+	AllowLegacyMD5 				bool
+}
+
+var DefaultPasswordHasherConfig = PasswordHasherConfig{
+	Algorithm: PASSWORD_ARGON2ID,
+	Time: 3,
+	MemoryKiB: 64 * 1024,
+	Threads: 2,
+	KeyLength: 32,
+	SaltLength: 16,
+	BcryptCost: 12,
+}
+
+type PasswordHasher struct {
+	config 						PasswordHasherConfig
+}
+
+func NewPasswordHasher(config PasswordHasherConfig) *PasswordHasher {
+	if config.Algorithm == "" {
+		config.Algorithm = DefaultPasswordHasherConfig.Algorithm
+	}
+	if config.Time == 0 {
+		config.Time = DefaultPasswordHasherConfig.Time
+	}
+	if config.MemoryKiB == 0 {
+		config.MemoryKiB = DefaultPasswordHasherConfig.MemoryKiB
+	}
+	if config.Threads == 0 {
+		config.Threads = DefaultPasswordHasherConfig.Threads
+	}
+	if config.KeyLength == 0 {
+		config.KeyLength = DefaultPasswordHasherConfig.KeyLength
+	}
+	if config.SaltLength <= 0 {
+		config.SaltLength = DefaultPasswordHasherConfig.SaltLength
+	}
+	if config.BcryptCost <= 0 {
+		config.BcryptCost = DefaultPasswordHasherConfig.BcryptCost
+	}
+	return &PasswordHasher{
+		config: config,
+	}
+}
+
+// Hash password with configured algorithm, result embed algorithm and parameters
+// ex: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func (this *PasswordHasher) Hash(password string) (string, error) {
+	if this.config.Algorithm == PASSWORD_BCRYPT {
+		hash, err := bcrypt.GenerateFromPassword(bcryptPassword(password), this.config.BcryptCost)
+		return string(hash), err
+	}
+	salt := secureRandom(this.config.SaltLength)
+	key := argon2.IDKey([]byte(password), salt, this.config.Time, this.config.MemoryKiB, this.config.Threads, this.config.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, this.config.MemoryKiB, this.config.Time, this.config.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify password against encoded hash. when hash use old algorithm or parameters
+// rehashed is the new hash to store, empty otherwise
+func (this *PasswordHasher) Verify(password string, encoded string) (ok bool, rehashed string, err error) {
+	upgrade := false
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		var params argon2Params
+		if params, err = parseArgon2(encoded); err != nil {
+			return false, "", err
+		}
+		key := argon2.IDKey([]byte(password), params.salt, params.time, params.memory, params.threads, uint32(len(params.key)))
+		ok = subtle.ConstantTimeCompare(key, params.key) == 1
+		upgrade = this.config.Algorithm != PASSWORD_ARGON2ID || params.time != this.config.Time ||
+			params.memory != this.config.MemoryKiB || params.threads != this.config.Threads ||
+			uint32(len(params.key)) != this.config.KeyLength || len(params.salt) != this.config.SaltLength
+	case strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$"):
+		err = bcrypt.CompareHashAndPassword([]byte(encoded), bcryptPassword(password))
+		legacy := false
+		if err == bcrypt.ErrMismatchedHashAndPassword && len(password) > BCRYPT_MAX_PASSWORD {
+			// hashed before pre-hashing, bcrypt only used the first 72 bytes
+			err = bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password[:BCRYPT_MAX_PASSWORD]))
+			legacy = true
+		}
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, "", nil
+		}
+		if err != nil {
+			return false, "", err
+		}
+		ok = true
+		cost, _ := bcrypt.Cost([]byte(encoded))
+		upgrade = legacy || this.config.Algorithm != PASSWORD_BCRYPT || cost != this.config.BcryptCost
+	case this.config.AllowLegacyMD5 && len(encoded) == 32:
+		ok = TokenEqual(MD5Hash(password), strings.ToLower(encoded))
+		upgrade = true
+	default:
+		return false, "", ErrPasswordFormat
+	}
+	if ok && upgrade {
+		if rehashed, err = this.Hash(password); err != nil {
+			Log().Error().Err(err).Msg("Error when rehash password")
+			return true, "", nil
+		}
+	}
+	return ok, rehashed, nil
+}
+
+// bcryptPassword pre-hash password longer than the 72 bytes bcrypt use, so every byte count
+func bcryptPassword(password string) []byte {
+	if len(password) <= BCRYPT_MAX_PASSWORD {
+		return []byte(password)
+	}
+	sum := sha256.Sum256([]byte(password))
+	return []byte(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+type argon2Params struct {
+	memory 						uint32
+	time 						uint32
+	threads 					uint8
+	salt 						[]byte
+	key 						[]byte
+}
+
+func parseArgon2(encoded string) (argon2Params, error) {
+	var params argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return params, ErrPasswordFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, ErrPasswordFormat
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, ErrPasswordFormat
+	}
+	var err1, err2 error
+	params.salt, err1 = base64.RawStdEncoding.DecodeString(parts[4])
+	params.key, err2 = base64.RawStdEncoding.DecodeString(parts[5])
+	if err1 != nil || err2 != nil || len(params.key) == 0 {
+		return params, ErrPasswordFormat
+	}
+	return params, nil
+}
+
+//======================================================================================
+// Failed attempts and lockout
+//======================================================================================
+
+// count failure and return counter, counter expire Window after first failure
+var loginFailScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+if n >= tonumber(ARGV[2]) then
+	redis.call('SET', KEYS[2], 1, 'PX', ARGV[3])
+	redis.call('DEL', KEYS[1])
+end
+return n
+`)
+
+type LoginLimiterConfig struct {
+	// failures of one account before it is locked ( default: 5 )
+	MaxUserAttempts 			int
+	// failures from one ip, whatever account, before it is locked ( default: 20 )
+	MaxIPAttempts 				int
+	// failures are counted during Window since first one ( default: 15 minutes )
+	Window 						time.Duration
+	// how long account or ip stay locked ( default: 15 minutes )
+	Lockout 					time.Duration
+	// Optional. Default TokkorRedis()
+	Redis 						redis.UniversalClient
+}
+
+var DefaultLoginLimiterConfig = LoginLimiterConfig{
+	MaxUserAttempts: 5,
+	MaxIPAttempts: 20,
+	Window: 15 * time.Minute,
+	Lockout: 15 * time.Minute,
+}
+
+type LoginLimiter struct {
+	config 						LoginLimiterConfig
+}
+
+func NewLoginLimiter(config LoginLimiterConfig) *LoginLimiter {
+	if config.MaxUserAttempts <= 0 {
+		config.MaxUserAttempts = DefaultLoginLimiterConfig.MaxUserAttempts
+	}
+	if config.MaxIPAttempts <= 0 {
+		config.MaxIPAttempts = DefaultLoginLimiterConfig.MaxIPAttempts
+	}
+	if config.Window <= 0 {
+		config.Window = DefaultLoginLimiterConfig.Window
+	}
+	if config.Lockout <= 0 {
+		config.Lockout = DefaultLoginLimiterConfig.Lockout
+	}
+	return &LoginLimiter{
+		config: config,
+	}
+}
+
+func (this *LoginLimiter) redis() redis.UniversalClient {
+	if this.config.Redis != nil {
+		return this.config.Redis
+	}
+	return TokkorRedis().Do()
+}
+
+// loginKeys return fail and lock keys of an account or ip, hash tag keep both in one cluster slot
+func loginKeys(kind string, id string) (fail string, lock string) {
+	tag := "{" + kind + "|" + id + "}"
+	return KEY_LOGIN_FAIL + tag, KEY_LOGIN_LOCK + tag
+}
+
+// Locked check account and ip before verifying password, retryAfter is remaining lock time.
+// it fail closed, locked is true with the error when lock state can not be read
+func (this *LoginLimiter) Locked(account string, ip string) (locked bool, retryAfter time.Duration, err error) {
+	_, userLock := loginKeys("u", account)
+	_, ipLock := loginKeys("ip", ip)
+	pipe := this.redis().Pipeline()
+	user := pipe.PTTL(userLock)
+	addr := pipe.PTTL(ipLock)
+	if _, err = pipe.Exec(); err != nil {
+		Log().Error().Err(err).Str("account", account).Msg("Error when check login lock")
+		return true, 0, err
+	}
+	for _, ttl := range []time.Duration{user.Val(), addr.Val()} {
+		if ttl > retryAfter {
+			retryAfter = ttl
+		}
+	}
+	return retryAfter > 0, retryAfter, nil
+}
+
+// Fail count a failed login, return true when account or ip became locked
+func (this *LoginLimiter) Fail(account string, ip string) bool {
+	window := int64(this.config.Window / time.Millisecond)
+	lockout := int64(this.config.Lockout / time.Millisecond)
+	client := this.redis()
+	locked := false
+	fail, lock := loginKeys("u", account)
+	n, err := loginFailScript.Run(client, []string{fail, lock},
+		window, this.config.MaxUserAttempts, lockout).Int()
+	if err != nil {
+		Log().Error().Err(err).Str("account", account).Msg("Error when count login failure")
+	} else if n >= this.config.MaxUserAttempts {
+		locked = true
+		Log().Warn().Str("account", account).Str("ip", ip).Msg("Account locked after failed logins")
+	}
+	if ip == "" {
+		return locked
+	}
+	fail, lock = loginKeys("ip", ip)
+	n, err = loginFailScript.Run(client, []string{fail, lock},
+		window, this.config.MaxIPAttempts, lockout).Int()
+	if err != nil {
+		Log().Error().Err(err).Str("ip", ip).Msg("Error when count login failure")
+	} else if n >= this.config.MaxIPAttempts {
+		locked = true
+		Log().Warn().Str("ip", ip).Msg("IP locked after failed logins")
+	}
+	return locked
+}
+
+// Succeed reset failures of account, ip counter keep running so one valid account can not hide a brute force
+func (this *LoginLimiter) Succeed(account string) {
+	fail, _ := loginKeys("u", account)
+	this.redis().Del(fail)
+}
+
+// Unlock account, ex: from admin tool or after password reset
+func (this *LoginLimiter) Unlock(account string) {
+	this.redis().Del(loginKeys("u", account))
+}
+
+//======================================================================================
+// Policy
+//======================================================================================
+
+type PasswordPolicy struct {
+	MinLength 					int
+	MaxLength 					int
+	RequireUpper 				bool
+	RequireLower 				bool
+	RequireDigit 				bool
+	RequireSymbol 				bool
+	// rejected passwords, compared case insensitive
+	Common 						[]string
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength: 8,
+	MaxLength: 128,
+	RequireLower: true,
+	RequireDigit: true,
+	Common: []string{"password", "12345678", "123456789", "1234567890", "qwertyuiop", "iloveyou", "password1", "abc12345", "11111111", "00000000"},
+}
+
+// PasswordPolicyError list violated rules ( PASSWORD_* constants )
+type PasswordPolicyError struct {
+	Violations 					[]string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return "password: " + strings.Join(e.Violations, ", ")
+}
+
+// Check password, userInputs ( name, email... ) must not be part of password
+func (this PasswordPolicy) Check(password string, userInputs ...string) error {
+	var violations []string
+	length := len([]rune(password))
+	if length < this.MinLength {
+		violations = append(violations, PASSWORD_TOO_SHORT)
+	}
+	if this.MaxLength > 0 && length > this.MaxLength {
+		violations = append(violations, PASSWORD_TOO_LONG)
+	}
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if this.RequireUpper && !upper {
+		violations = append(violations, PASSWORD_NEED_UPPER)
+	}
+	if this.RequireLower && !lower {
+		violations = append(violations, PASSWORD_NEED_LOWER)
+	}
+	if this.RequireDigit && !digit {
+		violations = append(violations, PASSWORD_NEED_DIGIT)
+	}
+	if this.RequireSymbol && !symbol {
+		violations = append(violations, PASSWORD_NEED_SYMBOL)
+	}
+	lowered := strings.ToLower(password)
+	for _, common := range this.Common {
+		if lowered == strings.ToLower(common) {
+			violations = append(violations, PASSWORD_TOO_COMMON)
+			break
+		}
+	}
+	for _, input := range userInputs {
+		if len(input) >= 3 && strings.Contains(lowered, strings.ToLower(input)) {
+			violations = append(violations, PASSWORD_CONTAIN_USER_DATA)
+			break
+		}
+	}
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package gocore
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHasherBcryptLong(t *testing.T) {
+	hasher := NewPasswordHasher(PasswordHasherConfig{Algorithm: PASSWORD_BCRYPT, BcryptCost: 4})
+	long := strings.Repeat("a", 100)
+	hash, err := hasher.Hash(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		password 				string
+		ok 						bool
+	}{
+		{long, true},
+		// same first 72 bytes must not match
+		{strings.Repeat("a", 72) + "b", false},
+		{strings.Repeat("a", 72), false},
+	}
+	for _, tt := range tests {
+		if ok, _, err := hasher.Verify(tt.password, hash); err != nil || ok != tt.ok {
+			t.Errorf("Verify %d bytes = %v %v, want %v", len(tt.password), ok, err, tt.ok)
+		}
+	}
+
+	// hash stored before pre-hashing was made from the first 72 bytes
+	legacy, err := bcrypt.GenerateFromPassword([]byte(long[:BCRYPT_MAX_PASSWORD]), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, rehashed, err := hasher.Verify(long, string(legacy))
+	if err != nil || !ok || rehashed == "" {
+		t.Fatalf("Verify legacy hash = %v %q %v", ok, rehashed, err)
+	}
+	if ok, _, _ = hasher.Verify(long, rehashed); !ok {
+		t.Errorf("rehashed legacy password rejected")
+	}
+	if ok, _, _ = hasher.Verify(strings.Repeat("a", 72) + "b", rehashed); ok {
+		t.Errorf("rehashed legacy hash match on first 72 bytes")
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	limiter := NewLoginLimiter(LoginLimiterConfig{MaxUserAttempts: 3, MaxIPAttempts: 10, Lockout: time.Minute, Redis: client})
+
+	for i := 1; i <= 3; i++ {
+		if locked := limiter.Fail("bob", "1.2.3.4"); locked != (i == 3) {
+			t.Fatalf("failure %d locked = %v", i, locked)
+		}
+	}
+	if locked, retryAfter, err := limiter.Locked("bob", "5.6.7.8"); !locked || retryAfter <= 0 || retryAfter > time.Minute || err != nil {
+		t.Errorf("Locked = %v %v %v", locked, retryAfter, err)
+	}
+	if locked, _, _ := limiter.Locked("alice", "5.6.7.8"); locked {
+		t.Errorf("other account locked")
+	}
+	limiter.Unlock("bob")
+	if locked, _, _ := limiter.Locked("bob", "5.6.7.8"); locked {
+		t.Errorf("still locked after Unlock")
+	}
+	for _, key := range mr.Keys() {
+		if !strings.Contains(key, "{") {
+			t.Errorf("key %s without hash tag", key)
+		}
+	}
+
+	// redis down, login stay locked
+	mr.Close()
+	if locked, _, err := limiter.Locked("alice", "5.6.7.8"); !locked || err == nil {
+		t.Errorf("Locked without redis = %v %v", locked, err)
+	}
+}
@@ -0,0 +1,499 @@
+package gocore
+
+import (
+	"crypto"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	JWT_ALG_HS256 = "HS256"
+	JWT_ALG_RS256 = "RS256"
+	JWT_ALG_EDDSA = "EdDSA"
+
+	KEY_JWT_REVOKED = "k_jwt_revoked|"
+	KEY_JWT_USER_REVOKED = "k_jwt_user_revoked|"
+)
+
+var (
+	ErrJWTMalformed = errors.New("jwt: malformed token")
+	ErrJWTUnknownKey = errors.New("jwt: unknown signing key")
+	ErrJWTSignature = errors.New("jwt: invalid signature")
+	ErrJWTExpired = errors.New("jwt: token expired")
+	ErrJWTNotYetValid = errors.New("jwt: token not valid yet")
+	ErrJWTClaims = errors.New("jwt: invalid issuer or audience")
+	ErrJWTRevoked = errors.New("jwt: token revoked")
+	ErrJWTLifetime = errors.New("jwt: missing exp or iat, or lifetime longer than MaxTTL")
+)
+
+// JWTKey sign or verify tokens. a key without private part only verify
+type JWTKey struct {
+	// kid header, must be unique
+	ID 							string
+	// JWT_ALG_HS256, JWT_ALG_RS256 or JWT_ALG_EDDSA
+	Algorithm 					string
+	// HS256
+	Secret 						[]byte
+	// RS256: *rsa.PrivateKey, EdDSA: ed25519.PrivateKey
+	PrivateKey 					crypto.Signer
+	// RS256: *rsa.PublicKey, EdDSA: ed25519.PublicKey. Optional when PrivateKey is set
+	PublicKey 					crypto.PublicKey
+}
+
+// JWTClaims registered claims plus the ones mapped to UserAuthData.
+// other claims are kept in Extra
+type JWTClaims struct {
+	Issuer 						string					`json:"iss,omitempty"`
+	// user id
+	Subject 					string					`json:"sub,omitempty"`
+	Audience 					JWTAudience				`json:"aud,omitempty"`
+	// unix seconds
+	ExpiresAt 					int64					`json:"exp,omitempty"`
+	NotBefore 					int64					`json:"nbf,omitempty"`
+	IssuedAt 					int64					`json:"iat,omitempty"`
+	ID 							string					`json:"jti,omitempty"`
+
+	Name 						string					`json:"name,omitempty"`
+	Picture 					string					`json:"picture,omitempty"`
+	Roles 						[]string				`json:"roles,omitempty"`
+	Permissions 				[]string				`json:"permissions,omitempty"`
+
+	Extra 						map[string]interface{}	`json:"-"`
+}
+
+// JWTAudience accept both string and array form of aud
+type JWTAudience []string
+
+func (a *JWTAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := stdjson.Unmarshal(data, &single); err == nil {
+		*a = JWTAudience{single}
+		return nil
+	}
+	var many []string
+	if err := stdjson.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a JWTAudience) Contains(audience string) bool {
+	for _, aud := range a {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// claims encoded by JWTClaims.MarshalJSON
+var jwtRegisteredClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "name", "picture", "roles", "permissions"}
+
+type jwtClaimsAlias JWTClaims
+
+func (this JWTClaims) MarshalJSON() ([]byte, error) {
+	data, err := stdjson.Marshal(jwtClaimsAlias(this))
+	if err != nil || len(this.Extra) == 0 {
+		return data, err
+	}
+	merged := make(map[string]interface{}, len(this.Extra) + 8)
+	for k, v := range this.Extra {
+		merged[k] = v
+	}
+	var registered map[string]interface{}
+	if err = stdjson.Unmarshal(data, &registered); err != nil {
+		return nil, err
+	}
+	for k, v := range registered {
+		merged[k] = v
+	}
+	return stdjson.Marshal(merged)
+}
+
+func (this *JWTClaims) UnmarshalJSON(data []byte) error {
+	var alias jwtClaimsAlias
+	if err := stdjson.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+	var all map[string]interface{}
+	if err := stdjson.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for _, k := range jwtRegisteredClaims {
+		delete(all, k)
+	}
+	*this = JWTClaims(alias)
+	if len(all) > 0 {
+		this.Extra = all
+	}
+	return nil
+}
+
+// User map claims to UserAuthData
+func (this *JWTClaims) User() *UserAuthData {
+	return &UserAuthData{
+		UserID: this.Subject,
+		UserName: this.Name,
+		Avatar: this.Picture,
+		Roles: this.Roles,
+		Permissions: this.Permissions,
+	}
+}
+
+type JWTConfig struct {
+	// iss of issued tokens, verified when set
+	Issuer 						string
+	// aud of issued tokens, verified when set
+	Audience 					string
+	// lifetime of issued tokens ( default: 1 hour )
+	TTL 						time.Duration
+	// longest lifetime ( exp - iat ) of a token, Sign refuse longer ones and Parse reject them.
+	// RevokeUser keep its marker this long ( default: TTL )
+	MaxTTL 						time.Duration
+	// clock skew tolerated on exp and nbf ( default: 1 minute )
+	Leeway 						time.Duration
+	// revocation list, nil only check signature and claims so no redis round-trip
+	Redis 						redis.UniversalClient
+}
+
+var DefaultJWTConfig = JWTConfig{
+	TTL: time.Hour,
+	Leeway: time.Minute,
+}
+
+type JWTManager struct {
+	config 						JWTConfig
+
+	lock 						sync.RWMutex
+	keys 						map[string]*JWTKey
+	signingKey 					*JWTKey
+}
+
+func NewJWTManager(config JWTConfig) *JWTManager {
+	if config.TTL <= 0 {
+		config.TTL = DefaultJWTConfig.TTL
+	}
+	if config.Leeway <= 0 {
+		config.Leeway = DefaultJWTConfig.Leeway
+	}
+	if config.MaxTTL < config.TTL {
+		config.MaxTTL = config.TTL
+	}
+	return &JWTManager{
+		config: config,
+		keys: make(map[string]*JWTKey),
+	}
+}
+
+// AddKey register a key for verification, first key with private part become signing key
+func (this *JWTManager) AddKey(key JWTKey) error {
+	if key.ID == "" {
+		return errors.New("jwt: key id is required")
+	}
+	switch key.Algorithm {
+	case JWT_ALG_HS256:
+		if len(key.Secret) < 32 {
+			return errors.New("jwt: HS256 secret must be at least 32 bytes")
+		}
+	case JWT_ALG_RS256:
+		if private, isRSA := key.PrivateKey.(*rsa.PrivateKey); isRSA && key.PublicKey == nil {
+			key.PublicKey = &private.PublicKey
+		}
+		if _, isRSA := key.PublicKey.(*rsa.PublicKey); !isRSA {
+			return errors.New("jwt: RS256 key need *rsa.PublicKey or *rsa.PrivateKey")
+		}
+	case JWT_ALG_EDDSA:
+		if private, isEd := key.PrivateKey.(ed25519.PrivateKey); isEd {
+			if len(private) != ed25519.PrivateKeySize {
+				return errors.New("jwt: EdDSA private key has wrong size")
+			}
+			if key.PublicKey == nil {
+				key.PublicKey = private.Public()
+			}
+		}
+		// ed25519.Verify panic on a public key of wrong size
+		if public, isEd := key.PublicKey.(ed25519.PublicKey); !isEd || len(public) != ed25519.PublicKeySize {
+			return errors.New("jwt: EdDSA key need ed25519.PublicKey or ed25519.PrivateKey")
+		}
+	default:
+		return fmt.Errorf("jwt: unsupported algorithm %s", key.Algorithm)
+	}
+	this.lock.Lock()
+	this.keys[key.ID] = &key
+	if this.signingKey == nil && key.canSign() {
+		this.signingKey = &key
+	}
+	this.lock.Unlock()
+	return nil
+}
+
+// SetSigningKey rotate key used for new tokens, tokens signed by older keys stay valid until key is removed
+func (this *JWTManager) SetSigningKey(kid string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	key, has := this.keys[kid]
+	if !has || !key.canSign() {
+		return ErrJWTUnknownKey
+	}
+	this.signingKey = key
+	return nil
+}
+
+// RemoveKey stop accepting tokens signed by key
+func (this *JWTManager) RemoveKey(kid string) {
+	this.lock.Lock()
+	delete(this.keys, kid)
+	if this.signingKey != nil && this.signingKey.ID == kid {
+		this.signingKey = nil
+	}
+	this.lock.Unlock()
+}
+
+// Issue token for user, extra claims are added to token
+func (this *JWTManager) Issue(user *UserAuthData, extra map[string]interface{}) (string, *JWTClaims, error) {
+	claims := &JWTClaims{
+		Subject: user.UserID,
+		Name: user.UserName,
+		Picture: user.Avatar,
+		Roles: user.Roles,
+		Permissions: user.Permissions,
+		Extra: extra,
+	}
+	token, err := this.Sign(claims)
+	return token, claims, err
+}
+
+// Sign claims, empty iss, aud, iat, exp and jti are filled from config
+func (this *JWTManager) Sign(claims *JWTClaims) (string, error) {
+	this.lock.RLock()
+	key := this.signingKey
+	this.lock.RUnlock()
+	if key == nil {
+		return "", ErrJWTUnknownKey
+	}
+	now := time.Now()
+	if claims.Issuer == "" {
+		claims.Issuer = this.config.Issuer
+	}
+	if len(claims.Audience) == 0 && this.config.Audience != "" {
+		claims.Audience = JWTAudience{this.config.Audience}
+	}
+	if claims.IssuedAt == 0 {
+		claims.IssuedAt = now.Unix()
+	}
+	if claims.ExpiresAt == 0 {
+		claims.ExpiresAt = now.Add(this.config.TTL).Unix()
+	}
+	if claims.ID == "" {
+		claims.ID = NewSecureToken(16)
+	}
+	if !this.validLifetime(claims) {
+		return "", ErrJWTLifetime
+	}
+
+	header, err := stdjson.Marshal(struct {
+		Alg 					string		`json:"alg"`
+		Typ 					string		`json:"typ"`
+		Kid 					string		`json:"kid"`
+	}{key.Algorithm, "JWT", key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := stdjson.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := jwtEncode(header) + "." + jwtEncode(payload)
+	signature, err := key.sign([]byte(input))
+	if err != nil {
+		Log().Error().Err(err).Str("kid", key.ID).Msg("Error when sign jwt")
+		return "", err
+	}
+	return input + "." + jwtEncode(signature), nil
+}
+
+// Parse verify signature, expiry, issuer, audience and revocation of token
+func (this *JWTManager) Parse(token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrJWTMalformed
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrJWTMalformed
+	}
+	var header struct {
+		Alg 					string		`json:"alg"`
+		Kid 					string		`json:"kid"`
+	}
+	if err = stdjson.Unmarshal(headerData, &header); err != nil {
+		return nil, ErrJWTMalformed
+	}
+	this.lock.RLock()
+	key := this.keys[header.Kid]
+	this.lock.RUnlock()
+	// algorithm come from our key, never from token header
+	if key == nil || key.Algorithm != header.Alg {
+		return nil, ErrJWTUnknownKey
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrJWTMalformed
+	}
+	if !key.verify([]byte(parts[0] + "." + parts[1]), signature) {
+		return nil, ErrJWTSignature
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrJWTMalformed
+	}
+	var claims JWTClaims
+	if err = stdjson.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrJWTMalformed
+	}
+
+	// tokens without exp would outlive every revocation
+	if !this.validLifetime(&claims) {
+		return nil, ErrJWTLifetime
+	}
+	now := time.Now()
+	leeway := int64(this.config.Leeway / time.Second)
+	if now.Unix() > claims.ExpiresAt + leeway {
+		return nil, ErrJWTExpired
+	}
+	if claims.NotBefore != 0 && now.Unix() + leeway < claims.NotBefore {
+		return nil, ErrJWTNotYetValid
+	}
+	if this.config.Issuer != "" && claims.Issuer != this.config.Issuer {
+		return nil, ErrJWTClaims
+	}
+	if this.config.Audience != "" && !claims.Audience.Contains(this.config.Audience) {
+		return nil, ErrJWTClaims
+	}
+	if this.revoked(&claims) {
+		return nil, ErrJWTRevoked
+	}
+	return &claims, nil
+}
+
+// Revoke token until it expire ( logout )
+func (this *JWTManager) Revoke(claims *JWTClaims) error {
+	if this.config.Redis == nil || claims.ID == "" {
+		return nil
+	}
+	ttl := time.Until(time.Unix(claims.ExpiresAt, 0)) + this.config.Leeway
+	if ttl <= 0 {
+		return nil
+	}
+	return this.config.Redis.Set(KEY_JWT_REVOKED + claims.ID, 1, ttl).Err()
+}
+
+// RevokeUser revoke all tokens issued to user until now ( log out everywhere ).
+// iat has second precision so a token issued in the same second is revoked too
+func (this *JWTManager) RevokeUser(userID string) error {
+	if this.config.Redis == nil {
+		return nil
+	}
+	// no accepted token live longer than MaxTTL after its iat
+	return this.config.Redis.Set(KEY_JWT_USER_REVOKED + userID, time.Now().Unix(), this.config.MaxTTL + this.config.Leeway).Err()
+}
+
+func (this *JWTManager) validLifetime(claims *JWTClaims) bool {
+	if claims.ExpiresAt == 0 || claims.IssuedAt == 0 {
+		return false
+	}
+	return claims.ExpiresAt - claims.IssuedAt <= int64(this.config.MaxTTL / time.Second)
+}
+
+func (this *JWTManager) revoked(claims *JWTClaims) bool {
+	if this.config.Redis == nil {
+		return false
+	}
+	pipe := this.config.Redis.Pipeline()
+	token := pipe.Exists(KEY_JWT_REVOKED + claims.ID)
+	user := pipe.Get(KEY_JWT_USER_REVOKED + claims.Subject)
+	_, err := pipe.Exec()
+	if err != nil && err != redis.Nil {
+		// fail closed, a revoked token must never pass because redis is down
+		Log().Error().Err(err).Msg("Error when check jwt revocation")
+		return true
+	}
+	if token.Val() > 0 {
+		return true
+	}
+	if since, err := user.Int64(); err == nil && claims.IssuedAt <= since {
+		return true
+	}
+	return false
+}
+
+// ValidateCredentials implement AuthValidator so JWTManager can back Auth middleware
+func (this *JWTManager) ValidateCredentials(credentials AuthCredentials) (*UserAuthData, error) {
+	claims, err := this.Parse(credentials.Token)
+	if err != nil {
+		return nil, err
+	}
+	if credentials.UserID != "" && credentials.UserID != claims.Subject {
+		return nil, ErrAuthInvalid
+	}
+	user := claims.User()
+	user.AccessToken = credentials.Token
+	user.IP = credentials.IP
+	return user, nil
+}
+
+func (key *JWTKey) canSign() bool {
+	if key.Algorithm == JWT_ALG_HS256 {
+		return len(key.Secret) > 0
+	}
+	return key.PrivateKey != nil
+}
+
+func (key *JWTKey) sign(input []byte) ([]byte, error) {
+	switch key.Algorithm {
+	case JWT_ALG_HS256:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	case JWT_ALG_RS256:
+		sum := sha256.Sum256(input)
+		return key.PrivateKey.Sign(crand.Reader, sum[:], crypto.SHA256)
+	case JWT_ALG_EDDSA:
+		return key.PrivateKey.Sign(crand.Reader, input, crypto.Hash(0))
+	}
+	return nil, ErrJWTUnknownKey
+}
+
+func (key *JWTKey) verify(input []byte, signature []byte) bool {
+	switch key.Algorithm {
+	case JWT_ALG_HS256:
+		mac := hmac.New(sha256.New, key.Secret)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case JWT_ALG_RS256:
+		sum := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(key.PublicKey.(*rsa.PublicKey), crypto.SHA256, sum[:], signature) == nil
+	case JWT_ALG_EDDSA:
+		return ed25519.Verify(key.PublicKey.(ed25519.PublicKey), input, signature)
+	}
+	return false
+}
+
+func jwtEncode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+var _ AuthValidator = (*JWTManager)(nil)
@@ -0,0 +1,164 @@
+package gocore
+
+import (
+	crand "crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	stdjson "encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func testJWTKeys(t *testing.T) []JWTKey {
+	rsaKey, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []JWTKey{
+		{ID: "hs", Algorithm: JWT_ALG_HS256, Secret: []byte(strings.Repeat("s", 32))},
+		{ID: "rs", Algorithm: JWT_ALG_RS256, PrivateKey: rsaKey},
+		{ID: "ed", Algorithm: JWT_ALG_EDDSA, PrivateKey: edKey},
+	}
+}
+
+// signJWT sign payload as is, so tests can build tokens Sign refuse
+func signJWT(t *testing.T, key JWTKey, header string, payload string) string {
+	input := jwtEncode([]byte(header)) + "." + jwtEncode([]byte(payload))
+	signature, err := key.sign([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + jwtEncode(signature)
+}
+
+func TestJWTVerify(t *testing.T) {
+	for _, key := range testJWTKeys(t) {
+		t.Run(key.Algorithm, func(t *testing.T) {
+			manager := NewJWTManager(JWTConfig{Issuer: "gocore", Audience: "api"})
+			if err := manager.AddKey(key); err != nil {
+				t.Fatal(err)
+			}
+			token, _, err := manager.Issue(&UserAuthData{UserID: "u1", Roles: []string{"admin"}}, map[string]interface{}{"tenant": "t1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := manager.Parse(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "u1" || len(claims.Roles) != 1 || claims.Extra["tenant"] != "t1" {
+				t.Errorf("claims %+v", claims)
+			}
+
+			now := time.Now().Unix()
+			header := `{"alg":"` + key.Algorithm + `","typ":"JWT","kid":"` + key.ID + `"}`
+			claimsJSON := func(iat int64, exp int64, iss string) string {
+				data, _ := stdjson.Marshal(map[string]interface{}{"sub": "u1", "iss": iss, "aud": "api", "iat": iat, "exp": exp})
+				return string(data)
+			}
+			parts := strings.Split(token, ".")
+			tests := []struct {
+				name 					string
+				token 					string
+				err 					error
+			}{
+				{"malformed", "a.b", ErrJWTMalformed},
+				{"tampered payload", parts[0] + "." + jwtEncode([]byte(claimsJSON(now, now + 60, "gocore"))) + "." + parts[2], ErrJWTSignature},
+				{"unknown kid", signJWT(t, key, `{"alg":"` + key.Algorithm + `","kid":"other"}`, claimsJSON(now, now + 60, "gocore")), ErrJWTUnknownKey},
+				{"alg mismatch", signJWT(t, key, `{"alg":"none","kid":"` + key.ID + `"}`, claimsJSON(now, now + 60, "gocore")), ErrJWTUnknownKey},
+				{"expired", signJWT(t, key, header, claimsJSON(now - 7200, now - 3600, "gocore")), ErrJWTExpired},
+				{"missing exp", signJWT(t, key, header, `{"sub":"u1","iss":"gocore","aud":"api","iat":1}`), ErrJWTLifetime},
+				{"too long", signJWT(t, key, header, claimsJSON(now, now + 7200, "gocore")), ErrJWTLifetime},
+				{"wrong issuer", signJWT(t, key, header, claimsJSON(now, now + 60, "other")), ErrJWTClaims},
+				{"valid", signJWT(t, key, header, claimsJSON(now, now + 60, "gocore")), nil},
+			}
+			for _, tt := range tests {
+				if _, err := manager.Parse(tt.token); err != tt.err {
+					t.Errorf("%s: err %v, want %v", tt.name, err, tt.err)
+				}
+			}
+
+			if _, err := manager.Sign(&JWTClaims{Subject: "u1", IssuedAt: now, ExpiresAt: now + 7200}); err != ErrJWTLifetime {
+				t.Errorf("Sign longer than MaxTTL: err %v", err)
+			}
+		})
+	}
+}
+
+func TestJWTRotation(t *testing.T) {
+	manager := NewJWTManager(JWTConfig{})
+	keys := testJWTKeys(t)
+	for _, key := range keys {
+		if err := manager.AddKey(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// first key with private part sign
+	old, _, err := manager.Issue(&UserAuthData{UserID: "u1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = manager.SetSigningKey("ed"); err != nil {
+		t.Fatal(err)
+	}
+	current, _, err := manager.Issue(&UserAuthData{UserID: "u1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(mustDecodeJWTHeader(t, current)), `"kid":"ed"`) {
+		t.Errorf("new token not signed by rotated key")
+	}
+	if _, err = manager.Parse(old); err != nil {
+		t.Errorf("old token rejected before key removal: %v", err)
+	}
+	manager.RemoveKey("hs")
+	if _, err = manager.Parse(old); err != ErrJWTUnknownKey {
+		t.Errorf("old token after key removal: err %v", err)
+	}
+	if _, err = manager.Parse(current); err != nil {
+		t.Errorf("current token rejected: %v", err)
+	}
+	if err = manager.SetSigningKey("missing"); err != ErrJWTUnknownKey {
+		t.Errorf("SetSigningKey missing: err %v", err)
+	}
+	manager.RemoveKey("ed")
+	if _, _, err = manager.Issue(&UserAuthData{UserID: "u1"}, nil); err != ErrJWTUnknownKey {
+		t.Errorf("Issue without signing key: err %v", err)
+	}
+}
+
+func TestJWTAddKey(t *testing.T) {
+	tests := []struct {
+		name 					string
+		key 					JWTKey
+		ok 						bool
+	}{
+		{"no id", JWTKey{Algorithm: JWT_ALG_HS256, Secret: make([]byte, 32)}, false},
+		{"short secret", JWTKey{ID: "k", Algorithm: JWT_ALG_HS256, Secret: make([]byte, 16)}, false},
+		{"unknown algorithm", JWTKey{ID: "k", Algorithm: "none"}, false},
+		{"rsa without key", JWTKey{ID: "k", Algorithm: JWT_ALG_RS256}, false},
+		{"short ed25519 public key", JWTKey{ID: "k", Algorithm: JWT_ALG_EDDSA, PublicKey: ed25519.PublicKey(make([]byte, 16))}, false},
+		{"short ed25519 private key", JWTKey{ID: "k", Algorithm: JWT_ALG_EDDSA, PrivateKey: ed25519.PrivateKey(make([]byte, 16))}, false},
+		{"ed25519 public key", JWTKey{ID: "k", Algorithm: JWT_ALG_EDDSA, PublicKey: ed25519.PublicKey(make([]byte, ed25519.PublicKeySize))}, true},
+	}
+	for _, tt := range tests {
+		if err := NewJWTManager(JWTConfig{}).AddKey(tt.key); (err == nil) != tt.ok {
+			t.Errorf("%s: err %v", tt.name, err)
+		}
+	}
+}
+
+func mustDecodeJWTHeader(t *testing.T, token string) []byte {
+	data, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -57,6 +57,15 @@ func (this *AppMailer) SendEmail(msg *gomail.Message){
 	}
 }
 
+// SendEmailNow send msg right away, even when daemon is running, and return delivery error
+func (this *AppMailer) SendEmailNow(msg *gomail.Message) error {
+	if err := this.dialer.DialAndSend(msg); err != nil {
+		Log().Error().Err(err).Str("module", "App Mailer")
+		return err
+	}
+	return nil
+}
+
 func (this *AppMailer) GetMailContentFromTemplate(path string) string{
 	content, err := ioutil.ReadFile("resources/templates/emails/" + path)
 	if err != nil {
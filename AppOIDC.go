@@ -0,0 +1,586 @@
+package gocore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	KEY_OIDC_STATE = "k_oidc_state|"
+	// cookie binding login state to the browser which started login
+	OIDC_STATE_COOKIE = "oidc_state"
+)
+
+var (
+	ErrOIDCState = errors.New("oidc: invalid or expired state")
+	ErrOIDCToken = errors.New("oidc: invalid id token")
+)
+
+// OIDCProviderError is returned when provider answer an error or an unexpected response
+type OIDCProviderError struct {
+	Reason 						string
+}
+
+func (e *OIDCProviderError) Error() string {
+	return "oidc: provider error: " + e.Reason
+}
+
+type OIDCConfig struct {
+	// provider name, routes are registered under RoutePrefix ( default: /auth/<Name> )
+	Name 						string
+	RoutePrefix 				string
+	// issuer url, discovery document is read from Issuer + /.well-known/openid-configuration
+	Issuer 						string
+	ClientID 					string
+	ClientSecret 				string
+	// full url of callback route, ex: https://api.example.com/auth/google/callback
+	RedirectURL 				string
+	// default: openid profile email
+	Scopes 						[]string
+
+	// endpoints, read from discovery when empty
+	AuthURL 					string
+	TokenURL 					string
+	JWKSURL 					string
+
+	// Optional. Default client with 10 seconds timeout
+	HTTPClient 					*http.Client
+	// store login state. Optional. Default TokkorRedis()
+	Redis 						redis.UniversalClient
+	// Optional. Default TokkorRedis().Sessions()
+	Sessions 					*SessionStore
+	// how long user has to complete login ( default: 10 minutes )
+	StateTTL 					time.Duration
+	// clock skew tolerated on id token ( default: 1 minute )
+	Leeway 						time.Duration
+
+	// MapClaims build user from id token, ex: find or create local account.
+	// Optional. Default user id is "<Name>:<iss>:<sub>" so it never match a local id
+	// or an account of another provider, name and picture come from claims
+	MapClaims 					func(claims *OIDCClaims) (*UserAuthData, error)
+	// OnLogin write response after session is created, redirect is the value given to login route.
+	// Optional. Default set access_token cookie and redirect, or ResultSuccess with tokens when no redirect
+	OnLogin 					func(c echo.Context, session *Session, redirect string) error
+	// OnError write response when login fail. Optional. Default ResultFail
+	OnError 					func(c echo.Context, err error) error
+}
+
+type OIDCClaims struct {
+	Issuer 						string					`json:"iss"`
+	Subject 					string					`json:"sub"`
+	Audience 					JWTAudience				`json:"aud"`
+	ExpiresAt 					int64					`json:"exp"`
+	IssuedAt 					int64					`json:"iat"`
+	Nonce 						string					`json:"nonce"`
+	Email 						string					`json:"email"`
+	EmailVerified 				bool					`json:"email_verified"`
+	Name 						string					`json:"name"`
+	Picture 					string					`json:"picture"`
+	// all claims of id token
+	Raw 						map[string]interface{}	`json:"-"`
+}
+
+// OIDCClient is an OpenID Connect relying party, add it to an App with AddHandler
+type OIDCClient struct {
+	config 						OIDCConfig
+
+	// guard endpoints of config filled by discovery
+	lock 						sync.Mutex
+	discovered 					bool
+	keys 						map[string]crypto.PublicKey
+	keysFetched 				time.Time
+	// closed when running discovery or keys fetch end
+	discovering 				chan struct{}
+	fetching 					chan struct{}
+}
+
+type oidcEndpoints struct {
+	AuthURL 					string
+	TokenURL 					string
+	JWKSURL 					string
+}
+
+type oidcState struct {
+	Nonce 						string		`json:"nonce"`
+	Verifier 					string		`json:"verifier"`
+	Redirect 					string		`json:"redirect"`
+}
+
+func NewOIDCClient(config OIDCConfig) *OIDCClient {
+	if config.RoutePrefix == "" {
+		config.RoutePrefix = "/auth/" + config.Name
+	}
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if config.StateTTL <= 0 {
+		config.StateTTL = 10 * time.Minute
+	}
+	if config.Leeway <= 0 {
+		config.Leeway = time.Minute
+	}
+	if config.MapClaims == nil {
+		config.MapClaims = func(claims *OIDCClaims) (*UserAuthData, error) {
+			return &UserAuthData{
+				UserID: config.Name + ":" + claims.Issuer + ":" + claims.Subject,
+				UserName: claims.Name,
+				Avatar: claims.Picture,
+			}, nil
+		}
+	}
+	if config.OnLogin == nil {
+		config.OnLogin = oidcDefaultLogin
+	}
+	if config.OnError == nil {
+		config.OnError = func(c echo.Context, err error) error {
+			base := HandlerBase{}
+			base.ResultFail(c, err.Error(), nil)
+			return nil
+		}
+	}
+	return &OIDCClient{
+		config: config,
+		keys: make(map[string]crypto.PublicKey),
+	}
+}
+
+func oidcDefaultLogin(c echo.Context, session *Session, redirect string) error {
+	if redirect != "" {
+		c.SetCookie(&http.Cookie{
+			Name: "access_token",
+			Value: session.AccessToken,
+			Path: "/",
+			HttpOnly: true,
+			Secure: oidcSecure(c),
+			SameSite: http.SameSiteLaxMode,
+		})
+		return c.Redirect(http.StatusFound, redirect)
+	}
+	base := HandlerBase{}
+	base.ResultSuccess(c, "", echo.Map{
+		"session_id": session.ID,
+		"access_token": session.AccessToken,
+		"refresh_token": session.RefreshToken,
+		"user": session.Auth,
+	})
+	return nil
+}
+
+// oidcSecure detect https, also behind a TLS terminating proxy ( X-Forwarded-Proto )
+func oidcSecure(c echo.Context) bool {
+	return c.Scheme() == "https"
+}
+
+// RegisterRouteGroup add GET <prefix>/login and GET <prefix>/callback
+func (this *OIDCClient) RegisterRouteGroup(engine *echo.Echo) {
+	group := engine.Group(this.config.RoutePrefix)
+	group.GET("/login", this.Login)
+	group.GET("/callback", this.Callback)
+}
+
+// Login redirect to provider. query "redirect" is a local path where user is sent after login
+func (this *OIDCClient) Login(c echo.Context) error {
+	endpoints, err := this.discover()
+	if err != nil {
+		return this.config.OnError(c, err)
+	}
+	redirect := c.QueryParam("redirect")
+	// only local paths so login can not be used as open redirect
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		redirect = ""
+	}
+	state := NewSecureToken(24)
+	data := oidcState{
+		Nonce: NewSecureToken(24),
+		Verifier: NewSecureToken(32),
+		Redirect: redirect,
+	}
+	value, _ := json.MarshalToString(&data)
+	if err := this.redis().Set(KEY_OIDC_STATE + state, value, this.config.StateTTL).Err(); err != nil {
+		Log().Error().Err(err).Str("provider", this.config.Name).Msg("Error when save oidc state")
+		return this.config.OnError(c, err)
+	}
+	// callback is accepted only from this browser, a callback url sent to a victim is rejected
+	c.SetCookie(&http.Cookie{
+		Name: OIDC_STATE_COOKIE,
+		Value: HashToken(nil, state),
+		Path: this.config.RoutePrefix,
+		MaxAge: int(this.config.StateTTL / time.Second),
+		HttpOnly: true,
+		Secure: oidcSecure(c),
+		SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(data.Verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", this.config.ClientID)
+	query.Set("redirect_uri", this.config.RedirectURL)
+	query.Set("scope", strings.Join(this.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", data.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	separator := "?"
+	if strings.Contains(endpoints.AuthURL, "?") {
+		separator = "&"
+	}
+	return c.Redirect(http.StatusFound, endpoints.AuthURL + separator + query.Encode())
+}
+
+// Callback exchange code, verify id token and create session
+func (this *OIDCClient) Callback(c echo.Context) error {
+	if reason := c.QueryParam("error"); reason != "" {
+		return this.config.OnError(c, &OIDCProviderError{Reason: reason})
+	}
+	endpoints, err := this.discover()
+	if err != nil {
+		return this.config.OnError(c, err)
+	}
+	stateParam := c.QueryParam("state")
+	cookie, err := c.Cookie(OIDC_STATE_COOKIE)
+	if err != nil || stateParam == "" || !TokenEqual(cookie.Value, HashToken(nil, stateParam)) {
+		return this.config.OnError(c, ErrOIDCState)
+	}
+	c.SetCookie(&http.Cookie{
+		Name: OIDC_STATE_COOKIE,
+		Path: this.config.RoutePrefix,
+		MaxAge: -1,
+		HttpOnly: true,
+		Secure: oidcSecure(c),
+		SameSite: http.SameSiteLaxMode,
+	})
+	state, err := this.takeState(stateParam)
+	if err != nil {
+		return this.config.OnError(c, err)
+	}
+	idToken, err := this.exchange(endpoints.TokenURL, c.QueryParam("code"), state.Verifier)
+	if err != nil {
+		return this.config.OnError(c, err)
+	}
+	claims, err := this.Verify(idToken)
+	if err != nil {
+		return this.config.OnError(c, err)
+	}
+	if !TokenEqual(claims.Nonce, state.Nonce) {
+		return this.config.OnError(c, ErrOIDCToken)
+	}
+	user, err := this.config.MapClaims(claims)
+	if err != nil {
+		return this.config.OnError(c, err)
+	}
+	if user == nil {
+		return this.config.OnError(c, ErrOIDCToken)
+	}
+	user.IP = c.RealIP()
+	sessions := this.config.Sessions
+	if sessions == nil {
+		sessions = TokkorRedis().Sessions()
+	}
+	session, err := sessions.Create(user, SessionDevice{
+		Name: this.config.Name,
+		UserAgent: c.Request().UserAgent(),
+	})
+	if err != nil {
+		return this.config.OnError(c, err)
+	}
+	return this.config.OnLogin(c, session, state.Redirect)
+}
+
+// Verify signature and claims of id token, nonce is checked by Callback
+func (this *OIDCClient) Verify(idToken string) (*OIDCClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrOIDCToken
+	}
+	headerData, err1 := base64.RawURLEncoding.DecodeString(parts[0])
+	payload, err2 := base64.RawURLEncoding.DecodeString(parts[1])
+	signature, err3 := base64.RawURLEncoding.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, ErrOIDCToken
+	}
+	var header struct {
+		Alg 					string		`json:"alg"`
+		Kid 					string		`json:"kid"`
+	}
+	if err := stdjson.Unmarshal(headerData, &header); err != nil {
+		return nil, ErrOIDCToken
+	}
+	key, err := this.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	valid := false
+	switch header.Alg {
+	case "RS256":
+		if public, isRSA := key.(*rsa.PublicKey); isRSA {
+			valid = rsa.VerifyPKCS1v15(public, crypto.SHA256, sum[:], signature) == nil
+		}
+	case "ES256":
+		if public, isEC := key.(*ecdsa.PublicKey); isEC && len(signature) == 64 {
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			valid = ecdsa.Verify(public, sum[:], r, s)
+		}
+	}
+	if !valid {
+		return nil, ErrOIDCToken
+	}
+
+	var claims OIDCClaims
+	if err = stdjson.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrOIDCToken
+	}
+	_ = stdjson.Unmarshal(payload, &claims.Raw)
+	leeway := int64(this.config.Leeway / time.Second)
+	if claims.Issuer != this.config.Issuer || !claims.Audience.Contains(this.config.ClientID) ||
+		claims.Subject == "" || time.Now().Unix() > claims.ExpiresAt + leeway {
+		return nil, ErrOIDCToken
+	}
+	return &claims, nil
+}
+
+func (this *OIDCClient) redis() redis.UniversalClient {
+	if this.config.Redis != nil {
+		return this.config.Redis
+	}
+	return TokkorRedis().Do()
+}
+
+// takeState read and delete state so it can be used only once
+func (this *OIDCClient) takeState(state string) (*oidcState, error) {
+	if state == "" {
+		return nil, ErrOIDCState
+	}
+	pipe := this.redis().TxPipeline()
+	get := pipe.Get(KEY_OIDC_STATE + state)
+	pipe.Del(KEY_OIDC_STATE + state)
+	if _, err := pipe.Exec(); err != nil {
+		return nil, ErrOIDCState
+	}
+	var data oidcState
+	if err := json.UnmarshalFromString(get.Val(), &data); err != nil {
+		return nil, ErrOIDCState
+	}
+	return &data, nil
+}
+
+func (this *OIDCClient) exchange(tokenURL string, code string, verifier string) (string, error) {
+	if code == "" {
+		return "", &OIDCProviderError{Reason: "missing code"}
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", this.config.RedirectURL)
+	form.Set("client_id", this.config.ClientID)
+	form.Set("code_verifier", verifier)
+	if this.config.ClientSecret != "" {
+		form.Set("client_secret", this.config.ClientSecret)
+	}
+	var result struct {
+		IDToken 				string		`json:"id_token"`
+		Error 					string		`json:"error"`
+	}
+	res, err := this.config.HTTPClient.PostForm(tokenURL, form)
+	if err != nil {
+		Log().Error().Err(err).Str("provider", this.config.Name).Msg("Error when exchange oidc code")
+		return "", err
+	}
+	defer res.Body.Close()
+	if err = this.decode(res, &result); err != nil {
+		return "", err
+	}
+	if result.IDToken == "" {
+		return "", &OIDCProviderError{Reason: "no id token " + result.Error}
+	}
+	return result.IDToken, nil
+}
+
+// discover endpoints once, endpoints are copied under lock.
+// discovery request is sent without lock, concurrent callers wait for the running one
+func (this *OIDCClient) discover() (oidcEndpoints, error) {
+	for {
+		this.lock.Lock()
+		if this.discovered || (this.config.AuthURL != "" && this.config.TokenURL != "" && this.config.JWKSURL != "") {
+			this.discovered = true
+			endpoints := oidcEndpoints{AuthURL: this.config.AuthURL, TokenURL: this.config.TokenURL, JWKSURL: this.config.JWKSURL}
+			this.lock.Unlock()
+			return endpoints, nil
+		}
+		if wait := this.discovering; wait != nil {
+			this.lock.Unlock()
+			<-wait
+			continue
+		}
+		done := make(chan struct{})
+		this.discovering = done
+		this.lock.Unlock()
+
+		document, err := this.fetchDiscovery()
+		this.lock.Lock()
+		if err == nil {
+			if this.config.AuthURL == "" {
+				this.config.AuthURL = document.AuthURL
+			}
+			if this.config.TokenURL == "" {
+				this.config.TokenURL = document.TokenURL
+			}
+			if this.config.JWKSURL == "" {
+				this.config.JWKSURL = document.JWKSURL
+			}
+			this.discovered = true
+		}
+		this.discovering = nil
+		close(done)
+		this.lock.Unlock()
+		if err != nil {
+			return oidcEndpoints{}, err
+		}
+	}
+}
+
+func (this *OIDCClient) fetchDiscovery() (oidcEndpoints, error) {
+	var document struct {
+		Issuer 					string		`json:"issuer"`
+		AuthURL 				string		`json:"authorization_endpoint"`
+		TokenURL 				string		`json:"token_endpoint"`
+		JWKSURL 				string		`json:"jwks_uri"`
+	}
+	res, err := this.config.HTTPClient.Get(this.config.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		Log().Error().Err(err).Str("provider", this.config.Name).Msg("Error when discover oidc provider")
+		return oidcEndpoints{}, err
+	}
+	defer res.Body.Close()
+	if err = this.decode(res, &document); err != nil {
+		return oidcEndpoints{}, err
+	}
+	if strings.TrimSuffix(document.Issuer, "/") != this.config.Issuer {
+		return oidcEndpoints{}, &OIDCProviderError{Reason: "issuer mismatch " + document.Issuer}
+	}
+	return oidcEndpoints{AuthURL: document.AuthURL, TokenURL: document.TokenURL, JWKSURL: document.JWKSURL}, nil
+}
+
+// key return public key of kid, keys are fetched again when kid is unknown ( provider rotated keys ).
+// keys are fetched without lock, concurrent callers wait for the running fetch and the map is swapped under lock
+func (this *OIDCClient) key(kid string) (crypto.PublicKey, error) {
+	endpoints, err := this.discover()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		this.lock.Lock()
+		if key, has := this.keys[kid]; has {
+			this.lock.Unlock()
+			return key, nil
+		}
+		if wait := this.fetching; wait != nil {
+			this.lock.Unlock()
+			<-wait
+			continue
+		}
+		if time.Since(this.keysFetched) < time.Minute {
+			this.lock.Unlock()
+			return nil, ErrOIDCToken
+		}
+		this.keysFetched = time.Now()
+		done := make(chan struct{})
+		this.fetching = done
+		this.lock.Unlock()
+
+		keys, err := this.fetchKeys(endpoints.JWKSURL)
+		this.lock.Lock()
+		if err == nil {
+			this.keys = keys
+		}
+		this.fetching = nil
+		close(done)
+		this.lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		if key, has := keys[kid]; has {
+			return key, nil
+		}
+		return nil, ErrOIDCToken
+	}
+}
+
+func (this *OIDCClient) fetchKeys(jwksURL string) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys 					[]struct {
+			Kid 				string		`json:"kid"`
+			Kty 				string		`json:"kty"`
+			Crv 				string		`json:"crv"`
+			N 					string		`json:"n"`
+			E 					string		`json:"e"`
+			X 					string		`json:"x"`
+			Y 					string		`json:"y"`
+		}							`json:"keys"`
+	}
+	res, err := this.config.HTTPClient.Get(jwksURL)
+	if err != nil {
+		Log().Error().Err(err).Str("provider", this.config.Name).Msg("Error when fetch oidc keys")
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err = this.decode(res, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil || k.Crv != "P-256" {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
+
+func (this *OIDCClient) decode(res *http.Response, target interface{}) error {
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		Log().Error().Int("status", res.StatusCode).Str("provider", this.config.Name).Str("url", res.Request.URL.String()).Msg("Error response from oidc provider")
+		return &OIDCProviderError{Reason: fmt.Sprintf("status %d", res.StatusCode)}
+	}
+	return stdjson.Unmarshal(body, target)
+}
+
+var _ HandlerInterface = (*OIDCClient)(nil)
@@ -0,0 +1,269 @@
+package gocore
+
+import (
+	"crypto"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	stdjson "encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/labstack/echo/v4"
+)
+
+// testOIDCProvider is a local stand-in provider, codes are registered by test with their nonce
+type testOIDCProvider struct {
+	server 					*httptest.Server
+	key 					*rsa.PrivateKey
+
+	lock 					sync.Mutex
+	// code -> nonce, code_challenge
+	codes 					map[string][2]string
+	discovered 				int
+	fetched 				int
+	// jwks response wait on hold when set
+	hold 					chan struct{}
+}
+
+func newTestOIDCProvider(t *testing.T) *testOIDCProvider {
+	key, err := rsa.GenerateKey(crand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &testOIDCProvider{key: key, codes: make(map[string][2]string)}
+	encode := base64.RawURLEncoding.EncodeToString
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		provider.lock.Lock()
+		provider.discovered++
+		provider.lock.Unlock()
+		issuer := provider.server.URL
+		_ = stdjson.NewEncoder(w).Encode(map[string]string{
+			"issuer": issuer,
+			"authorization_endpoint": issuer + "/authorize",
+			"token_endpoint": issuer + "/token",
+			"jwks_uri": issuer + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		provider.lock.Lock()
+		provider.fetched++
+		hold := provider.hold
+		provider.lock.Unlock()
+		if hold != nil {
+			<-hold
+		}
+		_ = stdjson.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "k1",
+				"kty": "RSA",
+				"n": encode(key.N.Bytes()),
+				"e": encode(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		provider.lock.Lock()
+		code, has := provider.codes[r.Form.Get("code")]
+		delete(provider.codes, r.Form.Get("code"))
+		provider.lock.Unlock()
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if !has || encode(sum[:]) != code[1] {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		payload, _ := stdjson.Marshal(map[string]interface{}{
+			"iss": provider.server.URL,
+			"sub": "42",
+			"aud": "client",
+			"exp": time.Now().Add(time.Hour).Unix(),
+			"nonce": code[0],
+			"name": "Bob",
+		})
+		input := encode([]byte(`{"alg":"RS256","kid":"k1"}`)) + "." + encode(payload)
+		digest := sha256.Sum256([]byte(input))
+		signature, _ := rsa.SignPKCS1v15(crand.Reader, key, crypto.SHA256, digest[:])
+		_ = stdjson.NewEncoder(w).Encode(map[string]string{"id_token": input + "." + encode(signature)})
+	})
+	provider.server = httptest.NewServer(mux)
+	return provider
+}
+
+func (this *testOIDCProvider) issue(code string, nonce string, challenge string) {
+	this.lock.Lock()
+	this.codes[code] = [2]string{nonce, challenge}
+	this.lock.Unlock()
+}
+
+func TestOIDCLogin(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	provider := newTestOIDCProvider(t)
+	defer provider.server.Close()
+
+	var loginErr error
+	sessions := NewSessionStore(client, SessionConfig{})
+	oidc := NewOIDCClient(OIDCConfig{
+		Name: "local",
+		Issuer: provider.server.URL,
+		ClientID: "client",
+		RedirectURL: "http://app/auth/local/callback",
+		Redis: client,
+		Sessions: sessions,
+		OnError: func(c echo.Context, err error) error {
+			loginErr = err
+			return c.NoContent(http.StatusUnauthorized)
+		},
+	})
+	e := echo.New()
+	oidc.RegisterRouteGroup(e)
+
+	// login return provider url, state and the cookie binding state to browser
+	login := func(redirect string) (url.Values, *http.Cookie) {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/local/login?redirect=" + url.QueryEscape(redirect), nil))
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil || !strings.HasPrefix(location.String(), provider.server.URL + "/authorize") {
+			t.Fatalf("login location %v", w.Header().Get("Location"))
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != OIDC_STATE_COOKIE || !cookies[0].HttpOnly {
+			t.Fatalf("state cookie %v", cookies)
+		}
+		return location.Query(), cookies[0]
+	}
+	callback := func(code string, state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		loginErr = nil
+		req := httptest.NewRequest(http.MethodGet, "/auth/local/callback?code=" + code + "&state=" + state, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		return w
+	}
+
+	query, cookie := login("/home")
+	provider.issue("c1", query.Get("nonce"), query.Get("code_challenge"))
+	w := callback("c1", query.Get("state"), cookie)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/home" || loginErr != nil {
+		t.Fatalf("callback %d %v", w.Code, loginErr)
+	}
+	userID := "local:" + provider.server.URL + ":42"
+	list, err := sessions.List(userID)
+	if err != nil || len(list) != 1 || list[0].Auth.UserName != "Bob" {
+		t.Fatalf("sessions of %s: %v %v", userID, list, err)
+	}
+
+	// state is single use
+	if callback("c1", query.Get("state"), cookie); loginErr != ErrOIDCState {
+		t.Errorf("replayed state: %v", loginErr)
+	}
+
+	// callback url sent to another browser
+	query, cookie = login("/home")
+	provider.issue("c2", query.Get("nonce"), query.Get("code_challenge"))
+	if callback("c2", query.Get("state"), nil); loginErr != ErrOIDCState {
+		t.Errorf("callback without cookie: %v", loginErr)
+	}
+	other := &http.Cookie{Name: OIDC_STATE_COOKIE, Value: HashToken(nil, "other")}
+	if callback("c2", query.Get("state"), other); loginErr != ErrOIDCState {
+		t.Errorf("callback with cookie of another login: %v", loginErr)
+	}
+
+	// id token with nonce of another login
+	query, cookie = login("")
+	provider.issue("c3", "wrong", query.Get("code_challenge"))
+	if callback("c3", query.Get("state"), cookie); loginErr != ErrOIDCToken {
+		t.Errorf("wrong nonce: %v", loginErr)
+	}
+
+	// code exchanged without matching verifier
+	query, cookie = login("")
+	provider.issue("c4", query.Get("nonce"), "wrong")
+	if callback("c4", query.Get("state"), cookie); loginErr == nil {
+		t.Errorf("pkce mismatch accepted")
+	} else if _, isProvider := loginErr.(*OIDCProviderError); !isProvider {
+		t.Errorf("pkce mismatch: %v", loginErr)
+	}
+
+	if provider.discovered != 1 {
+		t.Errorf("discovery fetched %d times", provider.discovered)
+	}
+}
+
+func TestOIDCKeysFetchedOutsideLock(t *testing.T) {
+	provider := newTestOIDCProvider(t)
+	defer provider.server.Close()
+	provider.hold = make(chan struct{})
+	oidc := NewOIDCClient(OIDCConfig{Name: "local", Issuer: provider.server.URL, ClientID: "client"})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := oidc.key("k1")
+			errs <- err
+		}()
+	}
+	// endpoints stay readable while keys are fetched
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		provider.lock.Lock()
+		fetching := provider.fetched > 0
+		provider.lock.Unlock()
+		if fetching {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("keys not fetched")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	discovered := make(chan error, 1)
+	go func() {
+		_, err := oidc.discover()
+		discovered <- err
+	}()
+	select {
+	case err := <-discovered:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("discover blocked by keys fetch")
+	}
+	close(provider.hold)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("key: %v", err)
+		}
+	}
+	if _, err := oidc.key("unknown"); err != ErrOIDCToken {
+		t.Errorf("unknown kid: %v", err)
+	}
+	if provider.fetched != 1 || provider.discovered != 1 {
+		t.Errorf("keys fetched %d times, discovery %d times", provider.fetched, provider.discovered)
+	}
+}
@@ -1,58 +1,144 @@
 package gocore
 
 import (
+	"crypto/tls"
+	"sync"
+	"time"
+
 	"github.com/go-redis/redis/v7"
 )
 
+const (
+	REDIS_MODE_SINGLE = "single"
+	REDIS_MODE_SENTINEL = "sentinel"
+	REDIS_MODE_CLUSTER = "cluster"
+)
+
+type AppRedisOptions struct {
+	// REDIS_MODE_SINGLE ( default ), REDIS_MODE_SENTINEL or REDIS_MODE_CLUSTER
+	Mode 						string
+	// single: server address, sentinel: sentinel addresses, cluster: seed nodes
+	// address format: localhost:6379
+	Addrs 						[]string
+	// sentinel only
+	MasterName 					string
+	SentinelPassword 			string
+
+	Password 					string
+	// database index, cluster always use DB 0
+	DB 							int
+	// set nil if do not use
+	TLS 						*tls.Config
+
+	// 0 use go-redis defaults
+	PoolSize 					int
+	MinIdleConns 				int
+	MaxRetries 					int
+	DialTimeout 				time.Duration
+	ReadTimeout 				time.Duration
+	WriteTimeout 				time.Duration
+	PoolTimeout 				time.Duration
+	IdleTimeout 				time.Duration
+
+	// cluster only: allow read from slaves
+	ReadOnly 					bool
+	RouteByLatency 				bool
+}
+
 type AppRedis struct {
-	Client 						*redis.Client
+	Client 						redis.UniversalClient
 	pool						*Pool
 
+	// receive messages of channels subscribed without handler
 	OnMessage 					func(msg *redis.Message)
+
+	// subscriber
+	subLock 					sync.Mutex
+	subConfig 					RedisSubscriberConfig
+	pubsub 						*redis.PubSub
+	channelHandlers 			map[string]RedisMessageHandler
+	patternHandlers 			map[string]RedisMessageHandler
+	dropped 					uint64
+	// channels confirmed by redis and callers of WaitSubscribed
+	confirmed 					map[string]bool
+	confirmWaits 				map[string][]chan struct{}
 }
 
 // address format: localhost:6379
 func NewRedisApp(address string, password string) *AppRedis {
-	instance := &AppRedis{}
-	instance.Client = redis.NewClient(&redis.Options{
-		Addr:     address,
-		Password: password, // no password set
-		DB:       0,  // use default DB
+	return NewRedisAppWithOptions(AppRedisOptions{
+		Addrs: []string{address},
+		Password: password,
 	})
-	instance.pool = NewPool(128, 1, 1)
-	instance.OnMessage = func(msg *redis.Message){}
-	return instance
 }
 
-func (this*AppRedis) Subscribe(channels ...string) {
-	go this.internalSubscribe(channels...)
+func NewRedisAppWithOptions(options AppRedisOptions) *AppRedis {
+	instance := &AppRedis{}
+	instance.Client = newRedisClient(options)
+	instance.channelHandlers = make(map[string]RedisMessageHandler)
+	instance.patternHandlers = make(map[string]RedisMessageHandler)
+	instance.confirmed = make(map[string]bool)
+	instance.confirmWaits = make(map[string][]chan struct{})
+	instance.OnMessage = func(msg *redis.Message){}
+	instance.SetSubscriberConfig(DefaultRedisSubscriberConfig)
+	return instance
 }
 
-func (this*AppRedis) internalSubscribe(channels ...string) {
-	pubsub := this.Client.Subscribe(channels...)
-	// Wait for confirmation that subscription is created
-	_, err := pubsub.Receive()
-	if err != nil {
-		Log().Error().Interface("channels", channels).Err(err).Msg("Error when subscribe channels")
-		return
-	}
-
-	// get the message channel
-	msgChannel := pubsub.Channel()
-
-	Log().Info().Interface("channels", channels).Msg("Subscribed to channel")
-
-	// loop for message
-	for msg := range msgChannel {
-		// we process message on pool so we need copy the message data
-		// it will be Data Race if we use message pointer here because of message can be write when it reading on schedule
-		cM := *msg
-		this.pool.Schedule(func() {
-			this.OnMessage(&cM)
+func newRedisClient(options AppRedisOptions) redis.UniversalClient {
+	switch options.Mode {
+	case REDIS_MODE_SENTINEL:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName: options.MasterName,
+			SentinelAddrs: options.Addrs,
+			SentinelPassword: options.SentinelPassword,
+			Password: options.Password,
+			DB: options.DB,
+			TLSConfig: options.TLS,
+			PoolSize: options.PoolSize,
+			MinIdleConns: options.MinIdleConns,
+			MaxRetries: options.MaxRetries,
+			DialTimeout: options.DialTimeout,
+			ReadTimeout: options.ReadTimeout,
+			WriteTimeout: options.WriteTimeout,
+			PoolTimeout: options.PoolTimeout,
+			IdleTimeout: options.IdleTimeout,
+		})
+	case REDIS_MODE_CLUSTER:
+		if options.DB != 0 {
+			Log().Warn().Int("db", options.DB).Msg("Redis cluster do not support DB index, using DB 0")
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs: options.Addrs,
+			Password: options.Password,
+			TLSConfig: options.TLS,
+			PoolSize: options.PoolSize,
+			MinIdleConns: options.MinIdleConns,
+			MaxRetries: options.MaxRetries,
+			DialTimeout: options.DialTimeout,
+			ReadTimeout: options.ReadTimeout,
+			WriteTimeout: options.WriteTimeout,
+			PoolTimeout: options.PoolTimeout,
+			IdleTimeout: options.IdleTimeout,
+			ReadOnly: options.ReadOnly,
+			RouteByLatency: options.RouteByLatency,
 		})
 	}
-
-	Log().Info().Interface("channels", channels).Msg("Closed pub/sub")
-	// close on finish
-	_ = pubsub.Close()
-}
\ No newline at end of file
+	address := ""
+	if len(options.Addrs) > 0 {
+		address = options.Addrs[0]
+	}
+	return redis.NewClient(&redis.Options{
+		Addr: address,
+		Password: options.Password,
+		DB: options.DB,
+		TLSConfig: options.TLS,
+		PoolSize: options.PoolSize,
+		MinIdleConns: options.MinIdleConns,
+		MaxRetries: options.MaxRetries,
+		DialTimeout: options.DialTimeout,
+		ReadTimeout: options.ReadTimeout,
+		WriteTimeout: options.WriteTimeout,
+		PoolTimeout: options.PoolTimeout,
+		IdleTimeout: options.IdleTimeout,
+	})
+}
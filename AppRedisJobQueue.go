@@ -0,0 +1,675 @@
+package gocore
+
+import (
+	stdjson "encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+const (
+	JOB_STATUS_QUEUED = "queued"
+	JOB_STATUS_DELAYED = "delayed"
+	JOB_STATUS_RUNNING = "running"
+	JOB_STATUS_RETRYING = "retrying"
+	JOB_STATUS_DONE = "done"
+	JOB_STATUS_DEAD = "dead"
+)
+
+// move due jobs from delayed zset to stream
+var jobQueueMoveScript = redis.NewScript(`
+local jobs = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[2]))
+local maxLen = tonumber(ARGV[3])
+for _, job in ipairs(jobs) do
+	if maxLen > 0 then
+		redis.call('XADD', KEYS[2], 'MAXLEN', '~', maxLen, '*', 'job', job)
+	else
+		redis.call('XADD', KEYS[2], '*', 'job', job)
+	end
+	redis.call('ZREM', KEYS[1], job)
+end
+return #jobs
+`)
+
+type JobHandler func(job *Job) error
+
+type JobQueueConfig struct {
+	// queue name, all instances using the same name share jobs
+	Name 						string
+	// consumer group ( default: "workers" )
+	Group 						string
+	// unique name of this instance in group ( default: hostname-pid )
+	Consumer 					string
+	// jobs processed at the same time ( default: 8 )
+	Workers 					int
+	// how long a read wait for new jobs ( default: 1 second )
+	BlockTimeout 				time.Duration
+	// failed job is retried MaxRetries times then moved to dead-letter stream ( default: 5, negative: no retry )
+	MaxRetries 					int
+	// delay before retry attempt, default double from 1 second up to 10 minutes
+	Backoff 					func(attempt int) time.Duration
+	// job delivered but not acknowledged for ClaimIdle is considered lost ( crashed worker )
+	// and claimed by another consumer ( default: 5 minutes ), must be longer than slowest job
+	ClaimIdle 					time.Duration
+	// how often pending jobs are checked for reclaim ( default: 30 seconds )
+	ReclaimInterval 			time.Duration
+	// how often delayed jobs are moved to stream ( default: 1 second )
+	DelayInterval 				time.Duration
+	// how long job status is kept after last change ( default: 24 hours )
+	StatusTTL 					time.Duration
+	// approximate max length of stream, 0 unlimited
+	MaxLen 						int64
+}
+
+var DefaultJobQueueConfig = JobQueueConfig{
+	Group: "workers",
+	Workers: 8,
+	BlockTimeout: time.Second,
+	MaxRetries: 5,
+	ClaimIdle: 5 * time.Minute,
+	ReclaimInterval: 30 * time.Second,
+	DelayInterval: time.Second,
+	StatusTTL: 24 * time.Hour,
+}
+
+type Job struct {
+	ID 							string					`json:"id"`
+	Type 						string					`json:"type"`
+	Payload 					stdjson.RawMessage		`json:"payload,omitempty"`
+	// 0 on first run
+	Attempt 					int						`json:"attempt"`
+	// unix milliseconds
+	EnqueuedAt 					int64					`json:"enqueued"`
+	// error of last failed attempt
+	LastError 					string					`json:"error,omitempty"`
+
+	streamID 					string
+}
+
+// Decode payload into target
+func (this *Job) Decode(target interface{}) error {
+	if len(this.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(this.Payload, target)
+}
+
+type JobStatus struct {
+	ID 							string
+	Type 						string
+	Status 						string
+	Attempt 					int
+	Error 						string
+	// unix milliseconds
+	EnqueuedAt 					int64
+	UpdatedAt 					int64
+}
+
+type JobQueueStats struct {
+	// entries in stream, delivered or not
+	Queued 						int64
+	// delivered and not acknowledged
+	Pending 					int64
+	// pending per consumer
+	Consumers 					map[string]int64
+	Delayed 					int64
+	Dead 						int64
+}
+
+type RedisJobQueue struct {
+	redis 						*AppRedis
+	config 						JobQueueConfig
+
+	streamKey 					string
+	delayedKey 					string
+	deadKey 					string
+	statusPrefix 				string
+
+	lock 						sync.RWMutex
+	handlers 					map[string]JobHandler
+	pool 						*Pool
+	slots 						chan struct{}
+	stop 						chan struct{}
+	wg 							sync.WaitGroup
+	running 					bool
+}
+
+func NewRedisJobQueue(app *AppRedis, config JobQueueConfig) *RedisJobQueue {
+	if config.Name == "" {
+		config.Name = "default"
+	}
+	if config.Group == "" {
+		config.Group = DefaultJobQueueConfig.Group
+	}
+	if config.Consumer == "" {
+		host, _ := os.Hostname()
+		config.Consumer = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	if config.Workers <= 0 {
+		config.Workers = DefaultJobQueueConfig.Workers
+	}
+	if config.BlockTimeout <= 0 {
+		config.BlockTimeout = DefaultJobQueueConfig.BlockTimeout
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = DefaultJobQueueConfig.MaxRetries
+	} else if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	if config.Backoff == nil {
+		config.Backoff = jobQueueBackoff
+	}
+	if config.ClaimIdle <= 0 {
+		config.ClaimIdle = DefaultJobQueueConfig.ClaimIdle
+	}
+	if config.ReclaimInterval <= 0 {
+		config.ReclaimInterval = DefaultJobQueueConfig.ReclaimInterval
+	}
+	if config.DelayInterval <= 0 {
+		config.DelayInterval = DefaultJobQueueConfig.DelayInterval
+	}
+	if config.StatusTTL <= 0 {
+		config.StatusTTL = DefaultJobQueueConfig.StatusTTL
+	}
+	// hash tag keep all keys of a queue on one cluster slot so scripts and transactions work
+	base := "jobq|{" + config.Name + "}|"
+	return &RedisJobQueue{
+		redis: app,
+		config: config,
+		streamKey: base + "stream",
+		delayedKey: base + "delayed",
+		deadKey: base + "dead",
+		statusPrefix: base + "job|",
+		handlers: make(map[string]JobHandler),
+	}
+}
+
+func jobQueueBackoff(attempt int) time.Duration {
+	if attempt > 10 {
+		return 10 * time.Minute
+	}
+	dur := time.Second << uint(attempt - 1)
+	if dur > 10 * time.Minute {
+		dur = 10 * time.Minute
+	}
+	return dur
+}
+
+// Handle register handler for a job type, returning error retry the job.
+// consumers of a group may handle different types, a job read by a consumer without
+// its handler stay pending until a consumer having it claim the job after ClaimIdle
+func (this *RedisJobQueue) Handle(jobType string, handler JobHandler) {
+	this.lock.Lock()
+	this.handlers[jobType] = handler
+	this.lock.Unlock()
+}
+
+// Enqueue job to run as soon as a worker is free, return job id
+func (this *RedisJobQueue) Enqueue(jobType string, payload interface{}) (string, error) {
+	return this.EnqueueIn(jobType, payload, 0)
+}
+
+// EnqueueAt job to run at given time
+func (this *RedisJobQueue) EnqueueAt(jobType string, payload interface{}, at time.Time) (string, error) {
+	return this.EnqueueIn(jobType, payload, time.Until(at))
+}
+
+// EnqueueIn job to run after delay
+func (this *RedisJobQueue) EnqueueIn(jobType string, payload interface{}, delay time.Duration) (string, error) {
+	job := &Job{
+		ID: randomHex(12),
+		Type: jobType,
+		EnqueuedAt: jobQueueNow(),
+	}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			Log().Error().Err(err).Str("type", jobType).Msg("Error when encode job payload")
+			return "", err
+		}
+		job.Payload = data
+	}
+	data, err := json.MarshalToString(job)
+	if err != nil {
+		return "", err
+	}
+
+	client := this.redis.Client
+	status := JOB_STATUS_QUEUED
+	if delay > 0 {
+		status = JOB_STATUS_DELAYED
+		err = client.ZAdd(this.delayedKey, &redis.Z{
+			Score: float64(time.Now().Add(delay).UnixNano() / int64(time.Millisecond)),
+			Member: data,
+		}).Err()
+	} else {
+		err = client.XAdd(this.xAddArgs(this.streamKey, map[string]interface{}{"job": data})).Err()
+	}
+	if err != nil {
+		Log().Error().Err(err).Str("queue", this.config.Name).Str("type", jobType).Msg("Error when enqueue job")
+		return "", err
+	}
+	this.setStatus(client, job, status, "")
+	return job.ID, nil
+}
+
+// Start create consumer group if needed and start processing jobs
+func (this *RedisJobQueue) Start() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.running {
+		return nil
+	}
+	err := this.redis.Client.XGroupCreateMkStream(this.streamKey, this.config.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		Log().Error().Err(err).Str("queue", this.config.Name).Msg("Error when create job queue consumer group")
+		return err
+	}
+	this.pool = NewPool(this.config.Workers, 0, 0)
+	this.slots = make(chan struct{}, this.config.Workers)
+	this.stop = make(chan struct{})
+	this.running = true
+
+	this.wg.Add(3)
+	go this.reader()
+	go this.mover()
+	go this.reclaimer()
+	if AppManagerInstance != nil {
+		AppManagerInstance.AddGracefulCallback("redis_jobqueue_" + this.config.Name, this.Stop)
+	}
+	Log().Info().Str("queue", this.config.Name).Str("consumer", this.config.Consumer).Int("workers", this.config.Workers).Msg("Job queue started")
+	return nil
+}
+
+// Stop fetching new jobs and wait running jobs to finish
+func (this *RedisJobQueue) Stop() {
+	this.lock.Lock()
+	if !this.running {
+		this.lock.Unlock()
+		return
+	}
+	this.running = false
+	close(this.stop)
+	this.lock.Unlock()
+	this.wg.Wait()
+	Log().Info().Str("queue", this.config.Name).Msg("Job queue stopped")
+}
+
+// Status of a job, nil when job is unknown or its status expired
+func (this *RedisJobQueue) Status(id string) (*JobStatus, error) {
+	values, err := this.redis.Client.HGetAll(this.statusPrefix + id).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	status := &JobStatus{
+		ID: id,
+		Type: values["type"],
+		Status: values["status"],
+		Error: values["error"],
+	}
+	status.Attempt, _ = strconv.Atoi(values["attempt"])
+	status.EnqueuedAt, _ = strconv.ParseInt(values["enqueued"], 10, 64)
+	status.UpdatedAt, _ = strconv.ParseInt(values["updated"], 10, 64)
+	return status, nil
+}
+
+func (this *RedisJobQueue) Stats() (JobQueueStats, error) {
+	var stats JobQueueStats
+	client := this.redis.Client
+	pipe := client.Pipeline()
+	queued := pipe.XLen(this.streamKey)
+	delayed := pipe.ZCard(this.delayedKey)
+	dead := pipe.XLen(this.deadKey)
+	_, _ = pipe.Exec()
+	for _, cmd := range []*redis.IntCmd{queued, delayed, dead} {
+		if err := cmd.Err(); err != nil && err != redis.Nil {
+			return stats, err
+		}
+	}
+	stats.Queued = queued.Val()
+	stats.Delayed = delayed.Val()
+	stats.Dead = dead.Val()
+
+	pending, err := client.XPending(this.streamKey, this.config.Group).Result()
+	if err != nil && !strings.HasPrefix(err.Error(), "NOGROUP") {
+		return stats, err
+	}
+	if pending != nil {
+		stats.Pending = pending.Count
+		stats.Consumers = pending.Consumers
+	}
+	return stats, nil
+}
+
+// DeadJobs return oldest jobs of dead-letter stream
+func (this *RedisJobQueue) DeadJobs(count int64) ([]*Job, error) {
+	messages, err := this.redis.Client.XRangeN(this.deadKey, "-", "+", count).Result()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*Job, 0, len(messages))
+	for _, msg := range messages {
+		if job := jobQueueDecode(msg); job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// RetryDead move a dead job back to queue with attempts reset
+func (this *RedisJobQueue) RetryDead(job *Job) error {
+	if job == nil || job.streamID == "" {
+		return fmt.Errorf("job queue: job is not from dead-letter stream")
+	}
+	retry := *job
+	retry.Attempt = 0
+	retry.LastError = ""
+	data, err := json.MarshalToString(&retry)
+	if err != nil {
+		return err
+	}
+	_, err = this.redis.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.XAdd(this.xAddArgs(this.streamKey, map[string]interface{}{"job": data}))
+		pipe.XDel(this.deadKey, job.streamID)
+		this.setStatus(pipe, &retry, JOB_STATUS_QUEUED, "")
+		return nil
+	})
+	return err
+}
+
+//--------------------------------------------------------------------------------------
+// workers
+//--------------------------------------------------------------------------------------
+
+func (this *RedisJobQueue) reader() {
+	defer this.wg.Done()
+	for {
+		// only read as many jobs as free workers, others stay in stream for other consumers
+		select {
+		case this.slots <- struct{}{}:
+		case <-this.stop:
+			return
+		}
+		count := int64(1 + cap(this.slots) - len(this.slots))
+		streams, err := this.redis.Client.XReadGroup(&redis.XReadGroupArgs{
+			Group: this.config.Group,
+			Consumer: this.config.Consumer,
+			Streams: []string{this.streamKey, ">"},
+			Count: count,
+			Block: this.config.BlockTimeout,
+		}).Result()
+		if err != nil {
+			<-this.slots
+			if err != redis.Nil {
+				Log().Error().Err(err).Str("queue", this.config.Name).Msg("Error when read jobs")
+				if this.wait(this.config.BlockTimeout) {
+					return
+				}
+			}
+			if this.stopped() {
+				return
+			}
+			continue
+		}
+		first := true
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				if !first {
+					this.slots <- struct{}{}
+				}
+				first = false
+				this.run(msg, 0)
+			}
+		}
+		if first {
+			<-this.slots
+		}
+	}
+}
+
+// run take a slot already acquired
+func (this *RedisJobQueue) run(msg redis.XMessage, deliveries int64) {
+	this.wg.Add(1)
+	this.pool.Schedule(func() {
+		defer this.wg.Done()
+		defer func() { <-this.slots }()
+		this.process(msg, deliveries)
+	})
+}
+
+func (this *RedisJobQueue) process(msg redis.XMessage, deliveries int64) {
+	client := this.redis.Client
+	job := jobQueueDecode(msg)
+	if job == nil {
+		Log().Error().Str("queue", this.config.Name).Str("entry", msg.ID).Msg("Error when decode job, dropped")
+		client.XAck(this.streamKey, this.config.Group, msg.ID)
+		client.XDel(this.streamKey, msg.ID)
+		return
+	}
+	handler := this.handler(job.Type)
+	if handler == nil {
+		// another consumer of group may handle this type, its reclaimer claim the job after ClaimIdle
+		Log().Debug().Str("queue", this.config.Name).Str("job", job.ID).Str("type", job.Type).Msg("No handler for job, left pending")
+		return
+	}
+	// delivered too many times without ack, worker probably crash on it
+	if deliveries > int64(this.config.MaxRetries) + 1 {
+		this.fail(job, fmt.Errorf("job queue: delivered %d times without acknowledgement", deliveries), true)
+		return
+	}
+
+	this.setStatus(client, job, JOB_STATUS_RUNNING, "")
+	err := jobQueueCall(handler, job)
+	if err != nil {
+		this.fail(job, err, false)
+		return
+	}
+	_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.XAck(this.streamKey, this.config.Group, job.streamID)
+		pipe.XDel(this.streamKey, job.streamID)
+		this.setStatus(pipe, job, JOB_STATUS_DONE, "")
+		return nil
+	})
+	if err != nil {
+		Log().Error().Err(err).Str("queue", this.config.Name).Str("job", job.ID).Msg("Error when acknowledge job")
+	}
+}
+
+func (this *RedisJobQueue) handler(jobType string) JobHandler {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.handlers[jobType]
+}
+
+// claimable is false for pending job of a type without local handler, claiming it would only count a delivery
+func (this *RedisJobQueue) claimable(id string) bool {
+	messages, err := this.redis.Client.XRangeN(this.streamKey, id, id, 1).Result()
+	if err != nil || len(messages) == 0 {
+		return true
+	}
+	job := jobQueueDecode(messages[0])
+	return job == nil || this.handler(job.Type) != nil
+}
+
+// fail schedule a retry or move job to dead-letter stream
+func (this *RedisJobQueue) fail(job *Job, cause error, dead bool) {
+	job.LastError = cause.Error()
+	dead = dead || job.Attempt >= this.config.MaxRetries
+	streamID := job.streamID
+
+	next := *job
+	if !dead {
+		next.Attempt++
+	}
+	data, err := json.MarshalToString(&next)
+	if err != nil {
+		Log().Error().Err(err).Str("job", job.ID).Msg("Error when encode job")
+		return
+	}
+	_, err = this.redis.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.XAck(this.streamKey, this.config.Group, streamID)
+		pipe.XDel(this.streamKey, streamID)
+		if dead {
+			pipe.XAdd(this.xAddArgs(this.deadKey, map[string]interface{}{"job": data}))
+			this.setStatus(pipe, &next, JOB_STATUS_DEAD, cause.Error())
+		} else {
+			pipe.ZAdd(this.delayedKey, &redis.Z{
+				Score: float64(time.Now().Add(this.config.Backoff(next.Attempt)).UnixNano() / int64(time.Millisecond)),
+				Member: data,
+			})
+			this.setStatus(pipe, &next, JOB_STATUS_RETRYING, cause.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		Log().Error().Err(err).Str("queue", this.config.Name).Str("job", job.ID).Msg("Error when reschedule failed job")
+		return
+	}
+	if dead {
+		Log().Warn().Str("queue", this.config.Name).Str("job", job.ID).Str("type", job.Type).Str("error", cause.Error()).Msg("Job moved to dead-letter stream")
+	}
+}
+
+// mover push due delayed jobs to stream
+func (this *RedisJobQueue) mover() {
+	defer this.wg.Done()
+	for {
+		for {
+			n, err := jobQueueMoveScript.Run(this.redis.Client, []string{this.delayedKey, this.streamKey},
+				jobQueueNow(), 100, this.config.MaxLen).Int()
+			if err != nil {
+				Log().Error().Err(err).Str("queue", this.config.Name).Msg("Error when move delayed jobs")
+			}
+			if err != nil || n < 100 {
+				break
+			}
+		}
+		if this.wait(this.config.DelayInterval) {
+			return
+		}
+	}
+}
+
+// reclaimer claim jobs of consumers which did not acknowledge them in ClaimIdle
+func (this *RedisJobQueue) reclaimer() {
+	defer this.wg.Done()
+	for {
+		if this.wait(this.config.ReclaimInterval) {
+			return
+		}
+		pending, err := this.redis.Client.XPendingExt(&redis.XPendingExtArgs{
+			Stream: this.streamKey,
+			Group: this.config.Group,
+			Start: "-",
+			End: "+",
+			Count: 100,
+		}).Result()
+		if err != nil {
+			Log().Error().Err(err).Str("queue", this.config.Name).Msg("Error when read pending jobs")
+			continue
+		}
+		for _, entry := range pending {
+			if entry.Idle < this.config.ClaimIdle || !this.claimable(entry.ID) {
+				continue
+			}
+			messages, err := this.redis.Client.XClaim(&redis.XClaimArgs{
+				Stream: this.streamKey,
+				Group: this.config.Group,
+				Consumer: this.config.Consumer,
+				MinIdle: this.config.ClaimIdle,
+				Messages: []string{entry.ID},
+			}).Result()
+			if err != nil {
+				Log().Error().Err(err).Str("queue", this.config.Name).Str("entry", entry.ID).Msg("Error when claim pending job")
+				continue
+			}
+			for _, msg := range messages {
+				select {
+				case this.slots <- struct{}{}:
+				case <-this.stop:
+					return
+				}
+				Log().Warn().Str("queue", this.config.Name).Str("entry", msg.ID).Str("from", entry.Consumer).Msg("Reclaimed pending job")
+				// claim count as one more delivery
+				this.run(msg, entry.RetryCount + 1)
+			}
+		}
+	}
+}
+
+// wait return true when queue is stopped
+func (this *RedisJobQueue) wait(dur time.Duration) bool {
+	timer := time.NewTimer(dur)
+	defer timer.Stop()
+	select {
+	case <-this.stop:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (this *RedisJobQueue) stopped() bool {
+	select {
+	case <-this.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (this *RedisJobQueue) xAddArgs(stream string, values map[string]interface{}) *redis.XAddArgs {
+	return &redis.XAddArgs{
+		Stream: stream,
+		MaxLenApprox: this.config.MaxLen,
+		Values: values,
+	}
+}
+
+func (this *RedisJobQueue) setStatus(client redis.Cmdable, job *Job, status string, errMsg string) {
+	key := this.statusPrefix + job.ID
+	client.HMSet(key, map[string]interface{}{
+		"type": job.Type,
+		"status": status,
+		"attempt": job.Attempt,
+		"error": errMsg,
+		"enqueued": job.EnqueuedAt,
+		"updated": jobQueueNow(),
+	})
+	client.Expire(key, this.config.StatusTTL)
+}
+
+func jobQueueDecode(msg redis.XMessage) *Job {
+	data, isString := msg.Values["job"].(string)
+	if !isString {
+		return nil
+	}
+	var job Job
+	if err := json.UnmarshalFromString(data, &job); err != nil {
+		return nil
+	}
+	job.streamID = msg.ID
+	return &job
+}
+
+// call handler and turn panic into error so worker keep running
+func jobQueueCall(handler JobHandler, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job queue: handler panic: %v", r)
+		}
+	}()
+	return handler(job)
+}
+
+func jobQueueNow() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,154 @@
+package gocore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+type testJobPayload struct {
+	N 							int				`json:"n"`
+}
+
+func testJobQueueConfig(name string, consumer string) JobQueueConfig {
+	return JobQueueConfig{
+		Name: name,
+		Consumer: consumer,
+		BlockTimeout: 50 * time.Millisecond,
+		DelayInterval: 20 * time.Millisecond,
+		ReclaimInterval: 50 * time.Millisecond,
+		ClaimIdle: 100 * time.Millisecond,
+		MaxRetries: 2,
+		Backoff: func(attempt int) time.Duration { return 10 * time.Millisecond },
+	}
+}
+
+// waitJobStatus poll status of job until it is want
+func waitJobStatus(t *testing.T, queue *RedisJobQueue, id string, want string) *JobStatus {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		status, err := queue.Status(id)
+		if err == nil && status != nil && status.Status == want {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s status %+v %v, want %s", id, status, err, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	app := NewRedisApp(mr.Addr(), "")
+	defer app.Close()
+	queue := NewRedisJobQueue(app, testJobQueueConfig("t", "c1"))
+	done := make(chan int, 4)
+	queue.Handle("ok", func(job *Job) error {
+		var payload testJobPayload
+		if err := job.Decode(&payload); err != nil {
+			return err
+		}
+		done <- payload.N
+		return nil
+	})
+	attempts := make(chan int, 8)
+	queue.Handle("bad", func(job *Job) error {
+		attempts <- job.Attempt
+		return errors.New("boom")
+	})
+	queue.Handle("panic", func(job *Job) error {
+		panic("crash")
+	})
+	if err = queue.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Stop()
+
+	okID, _ := queue.Enqueue("ok", &testJobPayload{N: 1})
+	delayedID, _ := queue.EnqueueIn("ok", &testJobPayload{N: 2}, 100 * time.Millisecond)
+	if status, _ := queue.Status(delayedID); status == nil || status.Status != JOB_STATUS_DELAYED {
+		t.Errorf("delayed job status %+v", status)
+	}
+	badID, _ := queue.Enqueue("bad", nil)
+	panicID, _ := queue.Enqueue("panic", nil)
+
+	waitJobStatus(t, queue, okID, JOB_STATUS_DONE)
+	waitJobStatus(t, queue, delayedID, JOB_STATUS_DONE)
+	status := waitJobStatus(t, queue, badID, JOB_STATUS_DEAD)
+	if status.Error != "boom" || status.Attempt != 2 || len(attempts) != 3 {
+		t.Errorf("dead job %+v after %d attempts", status, len(attempts))
+	}
+	if status = waitJobStatus(t, queue, panicID, JOB_STATUS_DEAD); status.Error != "job queue: handler panic: crash" {
+		t.Errorf("panic job %+v", status)
+	}
+	dead, err := queue.DeadJobs(10)
+	if err != nil || len(dead) != 2 {
+		t.Fatalf("dead jobs %d %v", len(dead), err)
+	}
+	if err = queue.RetryDead(dead[0]); err != nil {
+		t.Fatal(err)
+	}
+	if dead, _ = queue.DeadJobs(10); len(dead) != 1 {
+		t.Errorf("dead jobs after retry %d", len(dead))
+	}
+}
+
+func TestJobQueueConsumersWithDifferentHandlers(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	app := NewRedisApp(mr.Addr(), "")
+	defer app.Close()
+
+	// first consumer read job it can not handle
+	mailer := NewRedisJobQueue(app, testJobQueueConfig("mixed", "mailer"))
+	mailer.Handle("mail", func(job *Job) error { return nil })
+	if err = mailer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer mailer.Stop()
+	id, _ := mailer.Enqueue("resize", nil)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats, _ := mailer.Stats()
+		if stats.Consumers["mailer"] == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job not read by first consumer: %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resizer := NewRedisJobQueue(app, testJobQueueConfig("mixed", "resizer"))
+	resized := make(chan string, 1)
+	resizer.Handle("resize", func(job *Job) error {
+		resized <- job.ID
+		return nil
+	})
+	if err = resizer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer resizer.Stop()
+	select {
+	case got := <-resized:
+		if got != id {
+			t.Errorf("resized %s, want %s", got, id)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("job not claimed by consumer having its handler")
+	}
+	waitJobStatus(t, resizer, id, JOB_STATUS_DONE)
+	if dead, _ := resizer.DeadJobs(10); len(dead) != 0 {
+		t.Errorf("job dead-lettered by consumer without handler")
+	}
+}
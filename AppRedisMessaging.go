@@ -0,0 +1,296 @@
+package gocore
+
+import (
+	"encoding/hex"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+var (
+	ErrMessageTimeout = errors.New("messaging: request timed out")
+)
+
+// MessageEnvelope wrap every message published by RedisMessenger
+type MessageEnvelope struct {
+	Type 						string					`json:"type"`
+	ID 							string					`json:"id"`
+	// unix milliseconds
+	Timestamp 					int64					`json:"ts"`
+	// instance which published the message
+	Source 						string					`json:"source"`
+	// set on requests, channel where reply must be published
+	ReplyTo 					string					`json:"reply_to,omitempty"`
+	// set on replies, ID of the request
+	CorrelationID 				string					`json:"correlation_id,omitempty"`
+	// set on replies when handler failed
+	Error 						string					`json:"error,omitempty"`
+	Payload 					stdjson.RawMessage		`json:"payload,omitempty"`
+}
+
+// Decode payload into target
+func (this *MessageEnvelope) Decode(target interface{}) error {
+	if len(this.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(this.Payload, target)
+}
+
+// MessageRemoteError is returned by Request when the remote handler failed
+type MessageRemoteError struct {
+	Source 						string
+	Message 					string
+}
+
+func (e *MessageRemoteError) Error() string {
+	return fmt.Sprintf("messaging: remote %s: %s", e.Source, e.Message)
+}
+
+type messengerHandler struct {
+	fn 							reflect.Value
+	payloadType 				reflect.Type
+	hasReply 					bool
+}
+
+type RedisMessenger struct {
+	redis 						*AppRedis
+	source 						string
+	replyChannel 				string
+	replyOnce 					sync.Once
+
+	lock 						sync.RWMutex
+	handlers 					map[string]*messengerHandler
+	pending 					map[string]chan *MessageEnvelope
+}
+
+var (
+	messageEnvelopeType = reflect.TypeOf(&MessageEnvelope{})
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// NewRedisMessenger create typed messaging on top of redis pub/sub.
+// source identify this instance, empty use hostname and pid
+func NewRedisMessenger(app *AppRedis, source string) *RedisMessenger {
+	if source == "" {
+		host, _ := os.Hostname()
+		source = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), randomHex(4))
+	}
+	return &RedisMessenger{
+		redis: app,
+		source: source,
+		replyChannel: "msg_reply|" + source,
+		handlers: make(map[string]*messengerHandler),
+		pending: make(map[string]chan *MessageEnvelope),
+	}
+}
+
+func (this *RedisMessenger) Source() string {
+	return this.source
+}
+
+// Listen subscribe channels, received envelopes are dispatched to handler of their type
+func (this *RedisMessenger) Listen(channels ...string) {
+	for _, channel := range channels {
+		this.redis.SubscribeFunc(channel, this.onMessage)
+	}
+}
+
+// Handle register handler for a message type. handler must be one of:
+//   func(env *MessageEnvelope, payload *T)
+//   func(env *MessageEnvelope, payload *T) (reply interface{}, err error)
+// payload is decoded into a new T for each message. second form answer requests.
+func (this *RedisMessenger) Handle(msgType string, handler interface{}) {
+	fn := reflect.ValueOf(handler)
+	t := fn.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.In(0) != messageEnvelopeType || t.In(1).Kind() != reflect.Ptr {
+		panic("messaging: handler of " + msgType + " must be func(*MessageEnvelope, *T) or func(*MessageEnvelope, *T) (interface{}, error)")
+	}
+	h := &messengerHandler{
+		fn: fn,
+		payloadType: t.In(1).Elem(),
+	}
+	switch {
+	case t.NumOut() == 0:
+	case t.NumOut() == 2 && t.Out(1) == errorType:
+		h.hasReply = true
+	default:
+		panic("messaging: handler of " + msgType + " must return nothing or (interface{}, error)")
+	}
+	this.lock.Lock()
+	this.handlers[msgType] = h
+	this.lock.Unlock()
+}
+
+// Publish payload as msgType to channel
+func (this *RedisMessenger) Publish(channel string, msgType string, payload interface{}) error {
+	env, err := this.newEnvelope(msgType, payload)
+	if err != nil {
+		return err
+	}
+	return this.publish(channel, env)
+}
+
+// Request publish payload and wait reply of a remote handler, reply is decoded into reply
+func (this *RedisMessenger) Request(channel string, msgType string, payload interface{}, timeout time.Duration, reply interface{}) error {
+	this.replyOnce.Do(func() {
+		this.redis.SubscribeFunc(this.replyChannel, this.onReply)
+	})
+	env, err := this.newEnvelope(msgType, payload)
+	if err != nil {
+		return err
+	}
+	env.ReplyTo = this.replyChannel
+	// replies published before redis confirm subscription would be lost
+	deadline := time.Now().Add(timeout)
+	if !this.redis.WaitSubscribed(this.replyChannel, timeout) {
+		return ErrMessageTimeout
+	}
+
+	wait := make(chan *MessageEnvelope, 1)
+	this.lock.Lock()
+	this.pending[env.ID] = wait
+	this.lock.Unlock()
+	defer func() {
+		this.lock.Lock()
+		delete(this.pending, env.ID)
+		this.lock.Unlock()
+	}()
+
+	if err = this.publish(channel, env); err != nil {
+		return err
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case res := <-wait:
+		if res.Error != "" {
+			return &MessageRemoteError{Source: res.Source, Message: res.Error}
+		}
+		if reply != nil {
+			return res.Decode(reply)
+		}
+		return nil
+	case <-timer.C:
+		return ErrMessageTimeout
+	}
+}
+
+func (this *RedisMessenger) newEnvelope(msgType string, payload interface{}) (*MessageEnvelope, error) {
+	env := &MessageEnvelope{
+		Type: msgType,
+		ID: randomHex(16),
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Source: this.source,
+	}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			Log().Error().Err(err).Str("type", msgType).Msg("Error when encode message payload")
+			return nil, err
+		}
+		env.Payload = data
+	}
+	return env, nil
+}
+
+func (this *RedisMessenger) publish(channel string, env *MessageEnvelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	err = this.redis.Client.Publish(channel, data).Err()
+	if err != nil {
+		Log().Error().Err(err).Str("channel", channel).Str("type", env.Type).Msg("Error when publish message")
+	}
+	return err
+}
+
+func (this *RedisMessenger) onMessage(msg *redis.Message) {
+	var env MessageEnvelope
+	if err := json.UnmarshalFromString(msg.Payload, &env); err != nil {
+		Log().Error().Err(err).Str("channel", msg.Channel).Msg("Error when decode message envelope")
+		return
+	}
+	this.lock.RLock()
+	h := this.handlers[env.Type]
+	this.lock.RUnlock()
+	if h == nil {
+		// another instance may handle it, requests time out when none does
+		Log().Debug().Str("channel", msg.Channel).Str("type", env.Type).Msg("No handler for message")
+		return
+	}
+
+	payload := reflect.New(h.payloadType)
+	if err := env.Decode(payload.Interface()); err != nil {
+		Log().Error().Err(err).Str("type", env.Type).Msg("Error when decode message payload")
+		if env.ReplyTo != "" {
+			this.reply(&env, nil, err)
+		}
+		return
+	}
+	result, err := messageCall(h, &env, payload)
+	if env.ReplyTo == "" || (!h.hasReply && err == nil) {
+		return
+	}
+	this.reply(&env, result, err)
+}
+
+// call handler and turn panic into error so subscriber keep running
+func messageCall(h *messengerHandler, env *MessageEnvelope, payload reflect.Value) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = nil
+			err = fmt.Errorf("messaging: handler panic: %v", r)
+			Log().Error().Err(err).Str("type", env.Type).Msg("Error when handle message")
+		}
+	}()
+	out := h.fn.Call([]reflect.Value{reflect.ValueOf(env), payload})
+	if !h.hasReply {
+		return nil, nil
+	}
+	if !out[1].IsNil() {
+		err = out[1].Interface().(error)
+	}
+	return out[0].Interface(), err
+}
+
+func (this *RedisMessenger) reply(request *MessageEnvelope, payload interface{}, handlerErr error) {
+	env, err := this.newEnvelope(request.Type + ".reply", payload)
+	if err != nil {
+		env, _ = this.newEnvelope(request.Type + ".reply", nil)
+		handlerErr = err
+	}
+	env.CorrelationID = request.ID
+	if handlerErr != nil {
+		env.Error = handlerErr.Error()
+	}
+	_ = this.publish(request.ReplyTo, env)
+}
+
+func (this *RedisMessenger) onReply(msg *redis.Message) {
+	var env MessageEnvelope
+	if err := json.UnmarshalFromString(msg.Payload, &env); err != nil {
+		Log().Error().Err(err).Msg("Error when decode reply envelope")
+		return
+	}
+	this.lock.RLock()
+	wait, has := this.pending[env.CorrelationID]
+	this.lock.RUnlock()
+	if has {
+		select {
+		case wait <- &env:
+		default:
+		}
+	}
+}
+
+// randomHex return 2*n hex characters from crypto/rand, panic when it fail
+func randomHex(n int) string {
+	return hex.EncodeToString(secureRandom(n))
+}
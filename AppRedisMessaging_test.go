@@ -0,0 +1,51 @@
+package gocore
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+type testMessagePing struct {
+	N 							int				`json:"n"`
+}
+
+func TestMessengerHandlerPanic(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	client, server := NewRedisApp(mr.Addr(), ""), NewRedisApp(mr.Addr(), "")
+	defer client.Close()
+	defer server.Close()
+	requester, responder := NewRedisMessenger(client, "client"), NewRedisMessenger(server, "server")
+	responder.Handle("ping", func(env *MessageEnvelope, ping *testMessagePing) (interface{}, error) {
+		if ping.N < 0 {
+			panic("negative")
+		}
+		return &testMessagePing{N: ping.N * 2}, nil
+	})
+	responder.Handle("note", func(env *MessageEnvelope, ping *testMessagePing) {
+		panic("note")
+	})
+	responder.Listen("svc")
+	if !server.WaitSubscribed("svc", time.Second) {
+		t.Fatal("responder not subscribed")
+	}
+
+	var reply testMessagePing
+	err = requester.Request("svc", "ping", &testMessagePing{N: -1}, time.Second, &reply)
+	if remote, ok := err.(*MessageRemoteError); !ok || !strings.Contains(remote.Message, "panic") {
+		t.Fatalf("panic reply: %v", err)
+	}
+	if err = requester.Publish("svc", "note", &testMessagePing{}); err != nil {
+		t.Fatal(err)
+	}
+	// responder still serve after both panics
+	if err = requester.Request("svc", "ping", &testMessagePing{N: 21}, time.Second, &reply); err != nil || reply.N != 42 {
+		t.Fatalf("after panic: %v %+v", err, reply)
+	}
+}
@@ -0,0 +1,310 @@
+package gocore
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+type RedisMessageHandler func(msg *redis.Message)
+
+type RedisSubscriberConfig struct {
+	// max goroutines processing messages ( default: 128 )
+	Workers 					int
+	// messages waiting for a free worker ( default: 128 )
+	QueueSize 					int
+	// how long receiver wait for a free worker before drop message.
+	// 0 block receiving until a worker is free, so slow handlers slow down the subscriber
+	ScheduleTimeout 			time.Duration
+	// ping redis when no message received in this duration ( default: 30 seconds )
+	HealthCheckInterval 		time.Duration
+	// wait between reconnect attempts, doubled on each failure up to MaxReconnectBackoff
+	MinReconnectBackoff 		time.Duration
+	MaxReconnectBackoff 		time.Duration
+}
+
+var DefaultRedisSubscriberConfig = RedisSubscriberConfig{
+	Workers: 128,
+	QueueSize: 128,
+	HealthCheckInterval: 30 * time.Second,
+	MinReconnectBackoff: 100 * time.Millisecond,
+	MaxReconnectBackoff: 10 * time.Second,
+}
+
+// SetSubscriberConfig must be called before first subscription
+func (this*AppRedis) SetSubscriberConfig(config RedisSubscriberConfig) {
+	if config.Workers <= 0 {
+		config.Workers = DefaultRedisSubscriberConfig.Workers
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultRedisSubscriberConfig.QueueSize
+	}
+	if config.HealthCheckInterval <= 0 {
+		config.HealthCheckInterval = DefaultRedisSubscriberConfig.HealthCheckInterval
+	}
+	if config.MinReconnectBackoff <= 0 {
+		config.MinReconnectBackoff = DefaultRedisSubscriberConfig.MinReconnectBackoff
+	}
+	if config.MaxReconnectBackoff < config.MinReconnectBackoff {
+		config.MaxReconnectBackoff = config.MinReconnectBackoff
+	}
+	this.subLock.Lock()
+	old := this.pool
+	if old == nil || config.Workers != this.subConfig.Workers || config.QueueSize != this.subConfig.QueueSize {
+		this.pool = NewPool(config.Workers, config.QueueSize, 1)
+	}
+	this.subConfig = config
+	this.subLock.Unlock()
+	if old != nil && old != this.pool {
+		old.Stop()
+	}
+}
+
+// Subscribe channels, messages are delivered to OnMessage
+func (this*AppRedis) Subscribe(channels ...string) {
+	this.subscribe(false, channels, nil)
+}
+
+// SubscribeFunc subscribe channel and deliver its messages to handler
+func (this*AppRedis) SubscribeFunc(channel string, handler RedisMessageHandler) {
+	this.subscribe(false, []string{channel}, handler)
+}
+
+// PSubscribe patterns, ex: "chat.*", messages are delivered to OnMessage
+func (this*AppRedis) PSubscribe(patterns ...string) {
+	this.subscribe(true, patterns, nil)
+}
+
+// PSubscribeFunc subscribe pattern and deliver matched messages to handler
+func (this*AppRedis) PSubscribeFunc(pattern string, handler RedisMessageHandler) {
+	this.subscribe(true, []string{pattern}, handler)
+}
+
+func (this*AppRedis) Unsubscribe(channels ...string) {
+	this.unsubscribe(false, channels)
+}
+
+func (this*AppRedis) PUnsubscribe(patterns ...string) {
+	this.unsubscribe(true, patterns)
+}
+
+// WaitSubscribed block until redis confirm subscription of channel, return false on timeout.
+// messages published before confirmation are not received
+func (this*AppRedis) WaitSubscribed(channel string, timeout time.Duration) bool {
+	this.subLock.Lock()
+	if this.confirmed[channel] {
+		this.subLock.Unlock()
+		return true
+	}
+	wait := make(chan struct{})
+	this.confirmWaits[channel] = append(this.confirmWaits[channel], wait)
+	this.subLock.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-wait:
+		return true
+	case <-timer.C:
+	}
+	this.subLock.Lock()
+	defer this.subLock.Unlock()
+	waits := this.confirmWaits[channel]
+	for i, w := range waits {
+		if w == wait {
+			this.confirmWaits[channel] = append(waits[:i], waits[i + 1:]...)
+			break
+		}
+	}
+	if len(this.confirmWaits[channel]) == 0 {
+		delete(this.confirmWaits, channel)
+	}
+	return this.confirmed[channel]
+}
+
+func (this*AppRedis) confirmSubscription(m *redis.Subscription) {
+	this.subLock.Lock()
+	defer this.subLock.Unlock()
+	switch m.Kind {
+	case "subscribe":
+		this.confirmed[m.Channel] = true
+		for _, wait := range this.confirmWaits[m.Channel] {
+			close(wait)
+		}
+		delete(this.confirmWaits, m.Channel)
+	case "unsubscribe":
+		delete(this.confirmed, m.Channel)
+	}
+}
+
+// DroppedMessages count messages dropped because no worker free during ScheduleTimeout
+func (this*AppRedis) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&this.dropped)
+}
+
+// CloseSubscriber stop receiving messages, handlers and subscriptions are cleared
+func (this*AppRedis) CloseSubscriber() {
+	this.subLock.Lock()
+	pubsub := this.pubsub
+	this.pubsub = nil
+	this.channelHandlers = make(map[string]RedisMessageHandler)
+	this.patternHandlers = make(map[string]RedisMessageHandler)
+	this.confirmed = make(map[string]bool)
+	this.subLock.Unlock()
+	if pubsub != nil {
+		_ = pubsub.Close()
+		Log().Info().Msg("Closed pub/sub")
+	}
+}
+
+// Close subscriber and redis connections
+func (this*AppRedis) Close() error {
+	this.CloseSubscriber()
+	return this.Client.Close()
+}
+
+func (this*AppRedis) subscribe(pattern bool, names []string, handler RedisMessageHandler) {
+	if len(names) == 0 {
+		return
+	}
+	this.subLock.Lock()
+	for _, name := range names {
+		if pattern {
+			this.patternHandlers[name] = handler
+		} else {
+			this.channelHandlers[name] = handler
+		}
+	}
+	pubsub := this.pubsub
+	if pubsub == nil {
+		pubsub = this.Client.Subscribe()
+		this.pubsub = pubsub
+		go this.receiver(pubsub)
+		if AppManagerInstance != nil {
+			AppManagerInstance.AddGracefulCallback(fmt.Sprintf("redis_pubsub_%p", this), this.CloseSubscriber)
+		}
+	}
+	this.subLock.Unlock()
+
+	var err error
+	if pattern {
+		err = pubsub.PSubscribe(names...)
+	} else {
+		err = pubsub.Subscribe(names...)
+	}
+	// on error subscription is kept and restored when connection come back
+	if err != nil {
+		Log().Error().Interface("channels", names).Err(err).Msg("Error when subscribe channels, will retry on reconnect")
+	}
+}
+
+func (this*AppRedis) unsubscribe(pattern bool, names []string) {
+	this.subLock.Lock()
+	for _, name := range names {
+		if pattern {
+			delete(this.patternHandlers, name)
+		} else {
+			delete(this.channelHandlers, name)
+		}
+	}
+	pubsub := this.pubsub
+	this.subLock.Unlock()
+	if pubsub == nil || len(names) == 0 {
+		return
+	}
+	var err error
+	if pattern {
+		err = pubsub.PUnsubscribe(names...)
+	} else {
+		err = pubsub.Unsubscribe(names...)
+	}
+	if err != nil {
+		Log().Error().Interface("channels", names).Err(err).Msg("Error when unsubscribe channels")
+	}
+}
+
+// receiver loop until pubsub is closed. go-redis reconnect and resubscribe
+// all channels on next receive after a connection error so we only need to back off
+func (this*AppRedis) receiver(pubsub *redis.PubSub) {
+	this.subLock.Lock()
+	config := this.subConfig
+	this.subLock.Unlock()
+
+	backoff := config.MinReconnectBackoff
+	for {
+		msg, err := pubsub.ReceiveTimeout(config.HealthCheckInterval)
+		if err != nil {
+			if !this.isActivePubSub(pubsub) {
+				return
+			}
+			if netErr, isNet := err.(net.Error); isNet && netErr.Timeout() {
+				// idle connection, ping it so a dead one get replaced
+				if err = pubsub.Ping(); err == nil {
+					continue
+				}
+			}
+			// resubscribed channels are confirmed again after reconnect
+			this.subLock.Lock()
+			this.confirmed = make(map[string]bool)
+			this.subLock.Unlock()
+			Log().Error().Err(err).Dur("retry", backoff).Msg("Error when receive from pub/sub")
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > config.MaxReconnectBackoff {
+				backoff = config.MaxReconnectBackoff
+			}
+			continue
+		}
+		backoff = config.MinReconnectBackoff
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			Log().Info().Str("kind", m.Kind).Str("channel", m.Channel).Int("count", m.Count).Msg("Pub/sub subscription changed")
+			this.confirmSubscription(m)
+		case *redis.Message:
+			this.dispatch(m, config)
+		}
+	}
+}
+
+func (this*AppRedis) isActivePubSub(pubsub *redis.PubSub) bool {
+	this.subLock.Lock()
+	defer this.subLock.Unlock()
+	return this.pubsub == pubsub
+}
+
+func (this*AppRedis) dispatch(msg *redis.Message, config RedisSubscriberConfig) {
+	this.subLock.Lock()
+	var handler RedisMessageHandler
+	if msg.Pattern != "" {
+		handler = this.patternHandlers[msg.Pattern]
+	} else {
+		handler = this.channelHandlers[msg.Channel]
+	}
+	if handler == nil {
+		handler = this.OnMessage
+	}
+	pool := this.pool
+	this.subLock.Unlock()
+
+	task := func() {
+		// a panicking handler must not take down the process
+		defer func() {
+			if r := recover(); r != nil {
+				Log().Error().Str("channel", msg.Channel).Interface("panic", r).Msg("Error when handle pub/sub message")
+			}
+		}()
+		handler(msg)
+	}
+	if config.ScheduleTimeout <= 0 {
+		pool.Schedule(task)
+		return
+	}
+	if err := pool.ScheduleTimeout(config.ScheduleTimeout, task); err != nil {
+		atomic.AddUint64(&this.dropped, 1)
+		Log().Warn().Str("channel", msg.Channel).Msg("Pub/sub workers busy, message dropped")
+	}
+}
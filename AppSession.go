@@ -0,0 +1,417 @@
+package gocore
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+const (
+	KEY_SESSION = "k_sess|"
+	KEY_SESSION_ACCESS = "k_sess_at|"
+	KEY_SESSION_REFRESH = "k_sess_rt|"
+	KEY_SESSION_USER = "k_sess_user|"
+
+	// prefix of refresh index value once the token was rotated
+	sessionRotatedMark = "!"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session: not found or expired")
+	ErrSessionIPMismatch = errors.New("session: ip mismatch")
+	// a rotated refresh token was presented again, the session is revoked
+	ErrSessionTokenReuse = errors.New("session: refresh token reused")
+)
+
+// mark refresh token of session ARGV[2] as rotated and return the value it had.
+// any other value ( already rotated, other session ) is returned untouched so reuse can be detected.
+// a key without expiry get ARGV[3] milliseconds so the mark is never lost
+// ttl is formatted as integer, big lua numbers could be sent in exponent notation
+var sessionRotateScript = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if v ~= ARGV[2] then return v end
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl <= 0 then ttl = tonumber(ARGV[3]) end
+redis.call('SET', KEYS[1], ARGV[1] .. v, 'PX', string.format('%d', ttl))
+return v
+`)
+
+// undo sessionRotateScript when new tokens could not be saved
+var sessionRestoreScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] .. ARGV[2] then return 0 end
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl <= 0 then ttl = tonumber(ARGV[3]) end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', string.format('%d', ttl))
+return 1
+`)
+
+type SessionConfig struct {
+	// access token expire when not used for AccessTTL ( default: 3 hours )
+	AccessTTL 					time.Duration
+	// access token expire AccessTTL after issued even if it is used
+	DisableSliding 				bool
+	// refresh token expire when not used for RefreshTTL, session end with it ( default: 30 days )
+	RefreshTTL 					time.Duration
+	// max lifetime of a session since login whatever refreshes ( default: 90 days )
+	AbsoluteTTL 				time.Duration
+	// max sessions per user, oldest are revoked when exceeded. 0 unlimited
+	MaxSessions 				int
+	// reject access token used from an other ip than the one of login
+	BindIP 						bool
+	// key of HMAC used to hash stored tokens, changing it end all sessions.
+	// empty hash with plain SHA-256
+	TokenSecret 				[]byte
+}
+
+var DefaultSessionConfig = SessionConfig{
+	AccessTTL: 3 * time.Hour,
+	RefreshTTL: 30 * 24 * time.Hour,
+	AbsoluteTTL: 90 * 24 * time.Hour,
+}
+
+type SessionDevice struct {
+	Name 						string			`json:"name,omitempty"`
+	Platform 					string			`json:"platform,omitempty"`
+	UserAgent 					string			`json:"user_agent,omitempty"`
+}
+
+type Session struct {
+	ID 							string			`json:"sid"`
+	UserID 						string			`json:"uid"`
+	// access token is not kept here, it is set on sessions returned by Create, Validate and Refresh
+	Auth 						UserAuthData	`json:"auth"`
+	Device 						SessionDevice	`json:"device"`
+	IP 							string			`json:"ip"`
+	// unix milliseconds
+	CreatedAt 					int64			`json:"created"`
+	LastSeenAt 					int64			`json:"seen"`
+	ExpiresAt 					int64			`json:"expires"`
+
+	// only hashes of current tokens are stored
+	AccessHash 					string			`json:"ath,omitempty"`
+	RefreshHash 				string			`json:"rth,omitempty"`
+
+	// raw tokens, only set on sessions returned by Create and Refresh
+	AccessToken 				string			`json:"-"`
+	RefreshToken 				string			`json:"-"`
+}
+
+type SessionStore struct {
+	client 						redis.UniversalClient
+	config 						SessionConfig
+}
+
+func NewSessionStore(client redis.UniversalClient, config SessionConfig) *SessionStore {
+	if config.AccessTTL <= 0 {
+		config.AccessTTL = DefaultSessionConfig.AccessTTL
+	}
+	if config.RefreshTTL <= 0 {
+		config.RefreshTTL = DefaultSessionConfig.RefreshTTL
+	}
+	if config.AbsoluteTTL <= 0 {
+		config.AbsoluteTTL = DefaultSessionConfig.AbsoluteTTL
+	}
+	if config.RefreshTTL > config.AbsoluteTTL {
+		config.RefreshTTL = config.AbsoluteTTL
+	}
+	if config.AccessTTL > config.RefreshTTL {
+		config.AccessTTL = config.RefreshTTL
+	}
+	return &SessionStore{
+		client: client,
+		config: config,
+	}
+}
+
+func (this *SessionStore) Config() SessionConfig {
+	return this.config
+}
+
+// Create a new session for user, auth.AccessToken is ignored and a new one is generated
+func (this *SessionStore) Create(auth *UserAuthData, device SessionDevice) (*Session, error) {
+	return this.create(auth, device, "")
+}
+
+func (this *SessionStore) create(auth *UserAuthData, device SessionDevice, accessToken string) (*Session, error) {
+	if auth == nil || auth.UserID == "" {
+		return nil, errors.New("session: missing user id")
+	}
+	if accessToken == "" {
+		accessToken = NewSecureToken(32)
+	}
+	now := time.Now()
+	session := &Session{
+		ID: randomHex(16),
+		UserID: auth.UserID,
+		Auth: *auth,
+		Device: device,
+		IP: auth.IP,
+		CreatedAt: sessionMillis(now),
+		LastSeenAt: sessionMillis(now),
+		ExpiresAt: sessionMillis(now.Add(this.config.AbsoluteTTL)),
+		AccessToken: accessToken,
+		RefreshToken: NewSecureToken(32),
+	}
+	session.AccessHash = this.hash(session.AccessToken)
+	session.RefreshHash = this.hash(session.RefreshToken)
+	session.Auth.AccessToken = ""
+	if err := this.save(session, true); err != nil {
+		return nil, err
+	}
+	if this.config.MaxSessions > 0 {
+		this.trim(session.UserID)
+	}
+	session.Auth.AccessToken = session.AccessToken
+	return session, nil
+}
+
+// Validate access token and return its session, ip is checked when BindIP is set
+func (this *SessionStore) Validate(accessToken string, ip string) (*Session, error) {
+	if accessToken == "" {
+		return nil, ErrSessionNotFound
+	}
+	hash := this.hash(accessToken)
+	sid, err := this.client.Get(KEY_SESSION_ACCESS + hash).Result()
+	if err != nil {
+		if err != redis.Nil {
+			Log().Error().Err(err).Msg("Error when read session access token")
+		}
+		return nil, ErrSessionNotFound
+	}
+	session, err := this.Get(sid)
+	if err != nil {
+		return nil, err
+	}
+	if !TokenEqual(session.AccessHash, hash) {
+		return nil, ErrSessionNotFound
+	}
+	if this.config.BindIP && ip != "" && session.IP != ip {
+		return nil, ErrSessionIPMismatch
+	}
+	now := time.Now()
+	if !this.config.DisableSliding {
+		this.client.PExpire(KEY_SESSION_ACCESS + session.AccessHash, this.ttl(session, this.config.AccessTTL, now))
+	}
+	// avoid rewriting session on every request
+	if sessionMillis(now) - session.LastSeenAt > int64(time.Minute / time.Millisecond) {
+		session.LastSeenAt = sessionMillis(now)
+		if err = this.save(session, false); err != nil {
+			Log().Error().Err(err).Str("sid", sid).Msg("Error when update session last seen")
+		}
+	}
+	session.Auth.AccessToken = accessToken
+	return session, nil
+}
+
+// Refresh rotate access and refresh tokens of session owning refreshToken.
+// presenting an already rotated token revoke the session since it may be stolen.
+// token is only marked as rotated once session, hash and ip are checked
+func (this *SessionStore) Refresh(refreshToken string, ip string) (*Session, error) {
+	if refreshToken == "" {
+		return nil, ErrSessionNotFound
+	}
+	hash := this.hash(refreshToken)
+	key := KEY_SESSION_REFRESH + hash
+	sid, err := this.client.Get(key).Result()
+	if err != nil {
+		if err != redis.Nil {
+			Log().Error().Err(err).Msg("Error when read session refresh token")
+		}
+		return nil, ErrSessionNotFound
+	}
+	if strings.HasPrefix(sid, sessionRotatedMark) {
+		return nil, this.reused(strings.TrimPrefix(sid, sessionRotatedMark), ip)
+	}
+	session, err := this.Get(sid)
+	if err != nil {
+		return nil, err
+	}
+	if !TokenEqual(session.RefreshHash, hash) {
+		return nil, ErrSessionNotFound
+	}
+	if this.config.BindIP && ip != "" && session.IP != ip {
+		return nil, ErrSessionIPMismatch
+	}
+	now := time.Now()
+	ttl := int64(this.ttl(session, this.config.RefreshTTL, now) / time.Millisecond)
+	if ttl <= 0 {
+		return nil, ErrSessionNotFound
+	}
+
+	// refresh index and session are in different cluster slots, so only the mark is atomic.
+	// a concurrent refresh with same token lose here and is treated as reuse
+	value, err := sessionRotateScript.Run(this.client, []string{key}, sessionRotatedMark, sid, ttl).String()
+	if err != nil && err != redis.Nil {
+		Log().Error().Err(err).Str("sid", sid).Msg("Error when rotate refresh token")
+		return nil, err
+	}
+	if value != sid {
+		if strings.HasPrefix(value, sessionRotatedMark) {
+			return nil, this.reused(strings.TrimPrefix(value, sessionRotatedMark), ip)
+		}
+		return nil, ErrSessionNotFound
+	}
+
+	oldAccess := session.AccessHash
+	session.AccessToken = NewSecureToken(32)
+	session.RefreshToken = NewSecureToken(32)
+	session.AccessHash = this.hash(session.AccessToken)
+	session.RefreshHash = this.hash(session.RefreshToken)
+	session.LastSeenAt = sessionMillis(now)
+	if err = this.save(session, true); err != nil {
+		// keep old token usable, client will retry with it
+		if err := sessionRestoreScript.Run(this.client, []string{key}, sessionRotatedMark, sid, ttl).Err(); err != nil {
+			Log().Error().Err(err).Str("sid", sid).Msg("Error when restore refresh token")
+		}
+		return nil, err
+	}
+	this.client.Del(KEY_SESSION_ACCESS + oldAccess)
+	session.Auth.AccessToken = session.AccessToken
+	return session, nil
+}
+
+// reused revoke session of a rotated refresh token presented again
+func (this *SessionStore) reused(sid string, ip string) error {
+	Log().Warn().Str("sid", sid).Str("ip", ip).Msg("Refresh token reused, session revoked")
+	_ = this.Revoke(sid)
+	return ErrSessionTokenReuse
+}
+
+// Get session by id, tokens are not checked
+func (this *SessionStore) Get(sid string) (*Session, error) {
+	data, err := this.client.Get(KEY_SESSION + sid).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			Log().Error().Err(err).Str("sid", sid).Msg("Error when read session")
+		}
+		return nil, ErrSessionNotFound
+	}
+	var session Session
+	if err = json.Unmarshal(data, &session); err != nil {
+		Log().Error().Err(err).Str("sid", sid).Msg("Error when decode session")
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+// List live sessions of user, newest first
+func (this *SessionStore) List(userID string) ([]*Session, error) {
+	sids, err := this.client.SMembers(KEY_SESSION_USER + userID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(sids) == 0 {
+		return nil, nil
+	}
+	sessions := make([]*Session, 0, len(sids))
+	var expired []interface{}
+	for _, sid := range sids {
+		session, err := this.Get(sid)
+		if err != nil {
+			expired = append(expired, sid)
+			continue
+		}
+		session.AccessHash = ""
+		session.RefreshHash = ""
+		sessions = append(sessions, session)
+	}
+	if len(expired) > 0 {
+		this.client.SRem(KEY_SESSION_USER + userID, expired...)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt > sessions[j].CreatedAt
+	})
+	return sessions, nil
+}
+
+// Revoke one session
+func (this *SessionStore) Revoke(sid string) error {
+	session, err := this.Get(sid)
+	if err != nil {
+		return err
+	}
+	pipe := this.client.TxPipeline()
+	pipe.Del(KEY_SESSION + sid)
+	pipe.Del(KEY_SESSION_ACCESS + session.AccessHash)
+	pipe.Del(KEY_SESSION_REFRESH + session.RefreshHash)
+	pipe.SRem(KEY_SESSION_USER + session.UserID, sid)
+	_, err = pipe.Exec()
+	if err != nil {
+		Log().Error().Err(err).Str("sid", sid).Msg("Error when revoke session")
+	}
+	return err
+}
+
+// RevokeAll sessions of user ( log out everywhere ), return number of revoked sessions
+func (this *SessionStore) RevokeAll(userID string) (int, error) {
+	sids, err := this.client.SMembers(KEY_SESSION_USER + userID).Result()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, sid := range sids {
+		if this.Revoke(sid) == nil {
+			count++
+		}
+	}
+	this.client.Del(KEY_SESSION_USER + userID)
+	return count, nil
+}
+
+// save session and its token indexes, indexes are only written when withTokens
+func (this *SessionStore) save(session *Session, withTokens bool) error {
+	now := time.Now()
+	data, err := json.Marshal(session)
+	if err != nil {
+		Log().Error().Err(err).Msg("Error when encode session")
+		return err
+	}
+	sessionTTL := this.ttl(session, this.config.RefreshTTL, now)
+	if sessionTTL <= 0 {
+		return ErrSessionNotFound
+	}
+	pipe := this.client.TxPipeline()
+	pipe.Set(KEY_SESSION + session.ID, data, sessionTTL)
+	if withTokens {
+		pipe.Set(KEY_SESSION_ACCESS + session.AccessHash, session.ID, this.ttl(session, this.config.AccessTTL, now))
+		pipe.Set(KEY_SESSION_REFRESH + session.RefreshHash, session.ID, sessionTTL)
+		pipe.SAdd(KEY_SESSION_USER + session.UserID, session.ID)
+		pipe.Expire(KEY_SESSION_USER + session.UserID, this.config.AbsoluteTTL)
+	}
+	_, err = pipe.Exec()
+	if err != nil {
+		Log().Error().Err(err).Str("sid", session.ID).Msg("Error when save session")
+	}
+	return err
+}
+
+func (this *SessionStore) hash(token string) string {
+	return HashToken(this.config.TokenSecret, token)
+}
+
+// ttl capped by session absolute expiry
+func (this *SessionStore) ttl(session *Session, want time.Duration, now time.Time) time.Duration {
+	remain := time.Duration(session.ExpiresAt - sessionMillis(now)) * time.Millisecond
+	if remain < want {
+		return remain
+	}
+	return want
+}
+
+// trim revoke oldest sessions over MaxSessions
+func (this *SessionStore) trim(userID string) {
+	sessions, err := this.List(userID)
+	if err != nil {
+		return
+	}
+	for i := this.config.MaxSessions; i < len(sessions); i++ {
+		_ = this.Revoke(sessions[i].ID)
+	}
+}
+
+func sessionMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
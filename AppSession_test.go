@@ -0,0 +1,93 @@
+package gocore
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+)
+
+func testSessionStore(t *testing.T, config SessionConfig) (*SessionStore, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSessionStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}), config), mr
+}
+
+func TestSessionRefresh(t *testing.T) {
+	store, mr := testSessionStore(t, SessionConfig{})
+	defer mr.Close()
+	session, err := store.Create(&UserAuthData{UserID: "u1", IP: "1.1.1.1"}, SessionDevice{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Refresh("unknown", ""); err != ErrSessionNotFound {
+		t.Errorf("unknown token: %v", err)
+	}
+	// stored hash is not a token
+	if _, err = store.Refresh(session.RefreshHash, ""); err != ErrSessionNotFound {
+		t.Errorf("hash as token: %v", err)
+	}
+
+	rotated, err := store.Refresh(session.RefreshToken, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ID != session.ID || rotated.RefreshToken == session.RefreshToken || rotated.AccessToken == session.AccessToken {
+		t.Fatalf("tokens not rotated")
+	}
+	if _, err = store.Validate(session.AccessToken, ""); err != ErrSessionNotFound {
+		t.Errorf("old access token: %v", err)
+	}
+	if _, err = store.Validate(rotated.AccessToken, ""); err != nil {
+		t.Errorf("new access token: %v", err)
+	}
+
+	// old refresh token presented again revoke the session
+	if _, err = store.Refresh(session.RefreshToken, ""); err != ErrSessionTokenReuse {
+		t.Errorf("reused token: %v", err)
+	}
+	if _, err = store.Refresh(rotated.RefreshToken, ""); err != ErrSessionNotFound {
+		t.Errorf("token of revoked session: %v", err)
+	}
+}
+
+func TestSessionRefreshIPMismatch(t *testing.T) {
+	store, mr := testSessionStore(t, SessionConfig{BindIP: true})
+	defer mr.Close()
+	session, err := store.Create(&UserAuthData{UserID: "u1", IP: "1.1.1.1"}, SessionDevice{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Refresh(session.RefreshToken, "2.2.2.2"); err != ErrSessionIPMismatch {
+		t.Errorf("other ip: %v", err)
+	}
+	// rejected refresh must not burn token of real client
+	if _, err = store.Refresh(session.RefreshToken, "1.1.1.1"); err != nil {
+		t.Errorf("refresh after mismatch: %v", err)
+	}
+}
+
+func TestSessionRefreshWithoutExpiry(t *testing.T) {
+	store, mr := testSessionStore(t, SessionConfig{})
+	defer mr.Close()
+	session, err := store.Create(&UserAuthData{UserID: "u1"}, SessionDevice{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := KEY_SESSION_REFRESH + session.RefreshHash
+	store.client.Persist(key)
+	if _, err = store.Refresh(session.RefreshToken, ""); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := mr.Get(key); value != sessionRotatedMark + session.ID {
+		t.Errorf("rotated mark %q", value)
+	}
+	if mr.TTL(key) <= 0 {
+		t.Errorf("mark without expiry")
+	}
+	if _, err = store.Refresh(session.RefreshToken, ""); err != ErrSessionTokenReuse {
+		t.Errorf("reused token: %v", err)
+	}
+}
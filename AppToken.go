@@ -0,0 +1,61 @@
+package gocore
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+)
+
+// NewSecureToken return url safe token of size random bytes from crypto/rand
+func NewSecureToken(size int) string {
+	return base64.RawURLEncoding.EncodeToString(secureRandom(size))
+}
+
+func secureRandom(size int) []byte {
+	b := make([]byte, size)
+	if _, err := crand.Read(b); err != nil {
+		// crypto/rand never fail on supported platforms, a weak token is worse than a crash
+		Log().Panic().Err(err).Msg("Error when read crypto random")
+	}
+	return b
+}
+
+// secureString pick length characters of charset uniformly
+func secureString(charset string, length int) string {
+	b := make([]byte, length)
+	max := big.NewInt(int64(len(charset)))
+	for i := range b {
+		n, err := crand.Int(crand.Reader, max)
+		if err != nil {
+			Log().Panic().Err(err).Msg("Error when read crypto random")
+		}
+		b[i] = charset[n.Int64()]
+	}
+	return string(b)
+}
+
+// NewAccessToken return a token suitable for SetAuthentication
+func NewAccessToken() string {
+	return NewSecureToken(32)
+}
+
+// HashToken return hex HMAC-SHA256 of token, plain SHA-256 when secret is empty.
+// store only hashes so a leaked database do not expose live tokens
+func HashToken(secret []byte, token string) string {
+	if len(secret) == 0 {
+		sum := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// TokenEqual compare tokens in constant time
+func TokenEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
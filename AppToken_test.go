@@ -0,0 +1,62 @@
+package gocore
+
+import (
+	"testing"
+)
+
+func TestHashToken(t *testing.T) {
+	tests := []struct {
+		name 					string
+		secret 					string
+		token 					string
+		hash 					string
+	}{
+		// FIPS 180-2 SHA-256 vector
+		{"sha256", "", "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		// RFC 4231 test case 2
+		{"hmac", "Jefe", "what do ya want for nothing?", "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if hash := HashToken([]byte(tt.secret), tt.token); hash != tt.hash {
+				t.Errorf("HashToken = %s, want %s", hash, tt.hash)
+			}
+		})
+	}
+	if HashToken([]byte("a"), "token") == HashToken([]byte("b"), "token") {
+		t.Errorf("secret ignored")
+	}
+}
+
+func TestTokenEqual(t *testing.T) {
+	tests := []struct {
+		a 						string
+		b 						string
+		equal 					bool
+	}{
+		{"", "", true},
+		{"token", "token", true},
+		{"token", "tokem", false},
+		{"token", "token2", false},
+		{"token", "", false},
+	}
+	for _, tt := range tests {
+		if equal := TokenEqual(tt.a, tt.b); equal != tt.equal {
+			t.Errorf("TokenEqual(%q, %q) = %v, want %v", tt.a, tt.b, equal, tt.equal)
+		}
+	}
+}
+
+func TestNewSecureToken(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		token := NewSecureToken(32)
+		if len(token) != 43 {
+			t.Fatalf("token length %d", len(token))
+		}
+		if seen[token] {
+			t.Fatalf("duplicate token %s", token)
+		}
+		seen[token] = true
+	}
+}
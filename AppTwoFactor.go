@@ -0,0 +1,408 @@
+package gocore
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"gopkg.in/gomail.v2"
+)
+
+const (
+	OTP_CHANNEL_EMAIL = "email"
+	OTP_CHANNEL_SMS = "sms"
+
+	KEY_OTP = "k_otp|"
+	KEY_OTP_RESEND = "k_otp_resend|"
+	KEY_TOTP_PENDING = "k_totp_pending|"
+	KEY_TOTP_USED = "k_totp_used|"
+	KEY_TOTP_FAIL = "k_totp_fail|"
+	KEY_TOTP_LOCK = "k_totp_lock|"
+)
+
+var (
+	ErrOTPInvalid = errors.New("2fa: invalid code")
+	ErrOTPExpired = errors.New("2fa: code expired or not issued")
+	ErrOTPTooManyAttempts = errors.New("2fa: too many attempts")
+	ErrOTPTooSoon = errors.New("2fa: code already sent, wait before resend")
+	ErrOTPNoSender = errors.New("2fa: no sender for channel")
+)
+
+// check code hash, count attempts and burn code on success or when attempts are exhausted.
+// return 1 valid, 0 invalid, -1 not found, -2 too many attempts
+var otpVerifyScript = redis.NewScript(`
+local h = redis.call('HGET', KEYS[1], 'h')
+if not h then return -1 end
+if h == ARGV[1] then
+	redis.call('DEL', KEYS[1])
+	return 1
+end
+local a = redis.call('HINCRBY', KEYS[1], 'a', 1)
+if a >= tonumber(ARGV[2]) then
+	redis.call('DEL', KEYS[1])
+	return -2
+end
+return 0
+`)
+
+// OTPSender deliver a one-time code, purpose tell why it is sent ( ex: "login", "reset_password" )
+type OTPSender interface {
+	SendOTP(destination string, code string, purpose string) error
+}
+
+// SMSSender is implemented by SMS gateways
+type SMSSender interface {
+	SendSMS(phone string, message string) error
+}
+
+// EmailOTPSender send code with AppMailer
+type EmailOTPSender struct {
+	Mailer 						*AppMailer
+	From 						string
+	Subject 					string
+	// Optional. Default a short text with the code
+	Body 						func(code string, purpose string) string
+}
+
+func (this *EmailOTPSender) SendOTP(destination string, code string, purpose string) error {
+	body := "Your verification code is " + code
+	if this.Body != nil {
+		body = this.Body(code, purpose)
+	}
+	msg := gomail.NewMessage()
+	msg.SetHeader("From", this.From)
+	msg.SetHeader("To", destination)
+	msg.SetHeader("Subject", this.Subject)
+	msg.SetBody("text/html", body)
+	return this.Mailer.SendEmailNow(msg)
+}
+
+// SMSOTPSender send code with a SMS gateway
+type SMSOTPSender struct {
+	Sender 						SMSSender
+	// Optional. Default a short text with the code
+	Message 					func(code string, purpose string) string
+}
+
+func (this *SMSOTPSender) SendOTP(destination string, code string, purpose string) error {
+	message := "Your verification code is " + code
+	if this.Message != nil {
+		message = this.Message(code, purpose)
+	}
+	return this.Sender.SendSMS(destination, message)
+}
+
+type TwoFactorConfig struct {
+	// digits of issued codes ( default: 6 )
+	OTPLength 					int
+	// ( default: 5 minutes )
+	OTPTTL 						time.Duration
+	// wrong codes before issued code is burned ( default: 5 )
+	MaxAttempts 				int
+	// min delay between two codes for same user and purpose ( default: 30 seconds )
+	ResendInterval 				time.Duration
+
+	// issuer shown in authenticator apps
+	Issuer 						string
+	// TOTP steps accepted before and after current one to tolerate clock drift,
+	// 0 accept current step only ( negative: default 1 )
+	TOTPSkew 					int
+	// how long an enrolment wait for confirmation ( default: 10 minutes )
+	EnrollTTL 					time.Duration
+	// TOTP is locked for user after MaxAttempts wrong codes within TOTPLockout, for TOTPLockout ( default: 15 minutes )
+	TOTPLockout 				time.Duration
+
+	// key of HMAC used to hash codes, empty use plain SHA-256
+	TokenSecret 				[]byte
+	// Optional. Default TokkorRedis()
+	Redis 						redis.UniversalClient
+}
+
+var DefaultTwoFactorConfig = TwoFactorConfig{
+	OTPLength: 6,
+	OTPTTL: 5 * time.Minute,
+	MaxAttempts: 5,
+	ResendInterval: 30 * time.Second,
+	TOTPSkew: 1,
+	EnrollTTL: 10 * time.Minute,
+	TOTPLockout: 15 * time.Minute,
+}
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+)
+
+type TwoFactor struct {
+	config 						TwoFactorConfig
+	senders 					map[string]OTPSender
+}
+
+func NewTwoFactor(config TwoFactorConfig) *TwoFactor {
+	if config.OTPLength <= 0 {
+		config.OTPLength = DefaultTwoFactorConfig.OTPLength
+	}
+	if config.OTPTTL <= 0 {
+		config.OTPTTL = DefaultTwoFactorConfig.OTPTTL
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultTwoFactorConfig.MaxAttempts
+	}
+	if config.ResendInterval < 0 {
+		config.ResendInterval = 0
+	} else if config.ResendInterval == 0 {
+		config.ResendInterval = DefaultTwoFactorConfig.ResendInterval
+	}
+	if config.TOTPSkew < 0 {
+		config.TOTPSkew = DefaultTwoFactorConfig.TOTPSkew
+	}
+	if config.EnrollTTL <= 0 {
+		config.EnrollTTL = DefaultTwoFactorConfig.EnrollTTL
+	}
+	if config.TOTPLockout <= 0 {
+		config.TOTPLockout = DefaultTwoFactorConfig.TOTPLockout
+	}
+	return &TwoFactor{
+		config: config,
+		senders: make(map[string]OTPSender),
+	}
+}
+
+func (this *TwoFactor) redis() redis.UniversalClient {
+	if this.config.Redis != nil {
+		return this.config.Redis
+	}
+	return TokkorRedis().Do()
+}
+
+// RegisterSender for a channel, ex: OTP_CHANNEL_EMAIL with EmailOTPSender
+func (this *TwoFactor) RegisterSender(channel string, sender OTPSender) {
+	this.senders[channel] = sender
+}
+
+//--------------------------------------------------------------------------------------
+// One-time codes
+//--------------------------------------------------------------------------------------
+
+// IssueOTP generate a code for user and purpose and send it to destination.
+// a new code replace the previous one
+func (this *TwoFactor) IssueOTP(userID string, purpose string, channel string, destination string) error {
+	sender := this.senders[channel]
+	if sender == nil {
+		return ErrOTPNoSender
+	}
+	key := userID + "|" + purpose
+	client := this.redis()
+	if this.config.ResendInterval > 0 {
+		allowed, err := client.SetNX(KEY_OTP_RESEND + key, 1, this.config.ResendInterval).Result()
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return ErrOTPTooSoon
+		}
+	}
+	code := GetUniqueNumberCode(this.config.OTPLength)
+	pipe := client.TxPipeline()
+	pipe.Del(KEY_OTP + key)
+	pipe.HMSet(KEY_OTP + key, map[string]interface{}{
+		"h": HashToken(this.config.TokenSecret, code),
+		"a": 0,
+	})
+	pipe.Expire(KEY_OTP + key, this.config.OTPTTL)
+	if _, err := pipe.Exec(); err != nil {
+		Log().Error().Err(err).Str("user", userID).Msg("Error when save otp")
+		return err
+	}
+	if err := sender.SendOTP(destination, code, purpose); err != nil {
+		Log().Error().Err(err).Str("user", userID).Str("channel", channel).Msg("Error when send otp")
+		// keys are in different cluster slots
+		client.Del(KEY_OTP + key)
+		client.Del(KEY_OTP_RESEND + key)
+		return err
+	}
+	return nil
+}
+
+// VerifyOTP check code, a valid code can be used only once
+func (this *TwoFactor) VerifyOTP(userID string, purpose string, code string) error {
+	key := userID + "|" + purpose
+	result, err := otpVerifyScript.Run(this.redis(), []string{KEY_OTP + key},
+		HashToken(this.config.TokenSecret, strings.TrimSpace(code)), this.config.MaxAttempts).Int()
+	if err != nil {
+		Log().Error().Err(err).Str("user", userID).Msg("Error when verify otp")
+		return err
+	}
+	switch result {
+	case 1:
+		this.redis().Del(KEY_OTP_RESEND + key)
+		return nil
+	case -1:
+		return ErrOTPExpired
+	case -2:
+		return ErrOTPTooManyAttempts
+	}
+	return ErrOTPInvalid
+}
+
+//--------------------------------------------------------------------------------------
+// TOTP ( RFC 6238, SHA1, 6 digits, 30 seconds )
+//--------------------------------------------------------------------------------------
+
+// NewTOTPSecret return a base32 secret for authenticator apps
+func NewTOTPSecret() string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secureRandom(20))
+}
+
+// TOTPURI return otpauth uri to show as QR code, account is user email or name
+func (this *TwoFactor) TOTPURI(secret string, account string) string {
+	label := url.PathEscape(account)
+	if this.config.Issuer != "" {
+		label = url.PathEscape(this.config.Issuer) + ":" + label
+	}
+	query := url.Values{}
+	query.Set("secret", secret)
+	if this.config.Issuer != "" {
+		query.Set("issuer", this.config.Issuer)
+	}
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// BeginTOTP start enrolment, show uri as QR code then call ConfirmTOTP with a code from the app
+func (this *TwoFactor) BeginTOTP(userID string, account string) (secret string, uri string, err error) {
+	secret = NewTOTPSecret()
+	if err = this.redis().Set(KEY_TOTP_PENDING + userID, secret, this.config.EnrollTTL).Err(); err != nil {
+		return "", "", err
+	}
+	return secret, this.TOTPURI(secret, account), nil
+}
+
+// ConfirmTOTP finish enrolment and return secret the application must store with the user ( encrypted )
+func (this *TwoFactor) ConfirmTOTP(userID string, code string) (string, error) {
+	secret, err := this.redis().Get(KEY_TOTP_PENDING + userID).Result()
+	if err != nil {
+		return "", ErrOTPExpired
+	}
+	if err = this.VerifyTOTP(userID, secret, code); err != nil {
+		return "", err
+	}
+	this.redis().Del(KEY_TOTP_PENDING + userID)
+	return secret, nil
+}
+
+// VerifyTOTP check code against secret of user, a code can not be replayed.
+// after MaxAttempts wrong codes TOTP of user is locked and ErrOTPTooManyAttempts returned
+func (this *TwoFactor) VerifyTOTP(userID string, secret string, code string) error {
+	fail, lock := totpKeys(userID)
+	locked, err := this.redis().Exists(lock).Result()
+	if err != nil {
+		Log().Error().Err(err).Str("user", userID).Msg("Error when check totp lock")
+		return err
+	}
+	if locked > 0 {
+		return ErrOTPTooManyAttempts
+	}
+	code = strings.TrimSpace(code)
+	now := time.Now().Unix() / totpPeriod
+	for skew := -this.config.TOTPSkew; skew <= this.config.TOTPSkew; skew++ {
+		step := now + int64(skew)
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return err
+		}
+		if !TokenEqual(expected, code) {
+			continue
+		}
+		ttl := time.Duration(totpPeriod * (2 * this.config.TOTPSkew + 1)) * time.Second
+		fresh, err := this.redis().SetNX(fmt.Sprintf("%s%s|%d", KEY_TOTP_USED, userID, step), 1, ttl).Result()
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return this.totpFail(userID)
+		}
+		this.redis().Del(fail)
+		return nil
+	}
+	return this.totpFail(userID)
+}
+
+// totpKeys return fail and lock keys of user, hash tag keep both in one cluster slot
+func totpKeys(userID string) (fail string, lock string) {
+	tag := "{" + userID + "}"
+	return KEY_TOTP_FAIL + tag, KEY_TOTP_LOCK + tag
+}
+
+// totpFail count a wrong code with the login failure script
+func (this *TwoFactor) totpFail(userID string) error {
+	fail, lock := totpKeys(userID)
+	lockout := int64(this.config.TOTPLockout / time.Millisecond)
+	n, err := loginFailScript.Run(this.redis(), []string{fail, lock}, lockout, this.config.MaxAttempts, lockout).Int()
+	if err != nil {
+		Log().Error().Err(err).Str("user", userID).Msg("Error when count totp failure")
+	} else if n >= this.config.MaxAttempts {
+		Log().Warn().Str("user", userID).Msg("TOTP locked after wrong codes")
+		return ErrOTPTooManyAttempts
+	}
+	return ErrOTPInvalid
+}
+
+// TOTPCode return code of secret at time t
+func TOTPCode(secret string, t time.Time) (string, error) {
+	return totpCode(secret, t.Unix() / totpPeriod)
+}
+
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum) - 1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset + 4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value % 1000000), nil
+}
+
+//--------------------------------------------------------------------------------------
+// Recovery codes
+//--------------------------------------------------------------------------------------
+
+const recoveryCodeChars = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// GenerateRecoveryCodes return codes to show once to user and hashes to store
+func (this *TwoFactor) GenerateRecoveryCodes(count int) (codes []string, hashes []string) {
+	for i := 0; i < count; i++ {
+		raw := secureString(recoveryCodeChars, 10)
+		codes = append(codes, raw[:5] + "-" + raw[5:])
+		hashes = append(hashes, HashToken(this.config.TokenSecret, raw))
+	}
+	return codes, hashes
+}
+
+// UseRecoveryCode return index of matching hash, -1 when none. the application must remove used hash
+func (this *TwoFactor) UseRecoveryCode(hashes []string, code string) int {
+	normalized := strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	hash := HashToken(this.config.TokenSecret, normalized)
+	found := -1
+	for i, h := range hashes {
+		if TokenEqual(h, hash) && found < 0 {
+			found = i
+		}
+	}
+	return found
+}
@@ -0,0 +1,116 @@
+package gocore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA1 secret "12345678901234567890", last 6 of the 8 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		time 					int64
+		code 					string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		code, err := TOTPCode(secret, time.Unix(tt.time, 0))
+		if err != nil || code != tt.code {
+			t.Errorf("TOTPCode at %d = %s %v, want %s", tt.time, code, err, tt.code)
+		}
+	}
+	if _, err := TOTPCode("not base32!", time.Now()); err == nil {
+		t.Errorf("invalid secret accepted")
+	}
+}
+
+func testTwoFactor(t *testing.T) (*TwoFactor, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return NewTwoFactor(TwoFactorConfig{MaxAttempts: 3, Redis: client}), mr
+}
+
+func TestVerifyTOTPLockout(t *testing.T) {
+	tfa, mr := testTwoFactor(t)
+	defer mr.Close()
+	secret := NewTOTPSecret()
+	code, _ := TOTPCode(secret, time.Now())
+	wrong := "000000"
+	if wrong == code {
+		wrong = "111111"
+	}
+
+	if err := tfa.VerifyTOTP("u1", secret, code); err != nil {
+		t.Fatalf("valid code: %v", err)
+	}
+	if err := tfa.VerifyTOTP("u1", secret, code); err != ErrOTPInvalid {
+		t.Errorf("replayed code: %v", err)
+	}
+	if err := tfa.VerifyTOTP("u1", secret, wrong); err != ErrOTPInvalid {
+		t.Errorf("wrong code: %v", err)
+	}
+	if err := tfa.VerifyTOTP("u1", secret, wrong); err != ErrOTPTooManyAttempts {
+		t.Errorf("third failure: %v", err)
+	}
+	// even a valid code is refused while locked
+	code, _ = TOTPCode(secret, time.Now().Add(-totpPeriod * time.Second))
+	if err := tfa.VerifyTOTP("u1", secret, code); err != ErrOTPTooManyAttempts {
+		t.Errorf("locked: %v", err)
+	}
+	if err := tfa.VerifyTOTP("u2", secret, wrong); err != ErrOTPInvalid {
+		t.Errorf("other user: %v", err)
+	}
+}
+
+type failingOTPSender struct{}
+
+func (this *failingOTPSender) SendOTP(destination string, code string, purpose string) error {
+	return errors.New("gateway down")
+}
+
+func TestIssueOTPSendError(t *testing.T) {
+	tfa, mr := testTwoFactor(t)
+	defer mr.Close()
+	tfa.RegisterSender(OTP_CHANNEL_SMS, &failingOTPSender{})
+	if err := tfa.IssueOTP("u1", "login", OTP_CHANNEL_SMS, "+100"); err == nil {
+		t.Fatal("send error hidden")
+	}
+	// code and resend guard are removed so user can retry at once
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("keys left %v", keys)
+	}
+}
+
+func TestVerifyTOTPSkew(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	secret := NewTOTPSecret()
+	previous, _ := TOTPCode(secret, time.Now().Add(-totpPeriod * time.Second))
+
+	strict := NewTwoFactor(TwoFactorConfig{TOTPSkew: 0, Redis: client})
+	if err := strict.VerifyTOTP("u1", secret, previous); err != ErrOTPInvalid {
+		t.Errorf("previous step with zero skew: %v", err)
+	}
+	drift := NewTwoFactor(TwoFactorConfig{TOTPSkew: -1, Redis: client})
+	if err := drift.VerifyTOTP("u2", secret, previous); err != nil {
+		t.Errorf("previous step with default skew: %v", err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"runtime"
 	"time"
 	"bytes"
@@ -17,10 +18,43 @@ import (
 )
 
 const (
+	// default deadlines, see WSKeepAliveConfig
 	WS_DEADLINE_DURATION_READ = 100 * time.Millisecond
 	WS_DEADLINE_DURATION_WRITE = 100 * time.Millisecond
 )
 
+const (
+	// connection was closed or failed while reading
+	WS_CLOSE_DISCONNECTED = "disconnected"
+	// client did not answer ping in time
+	WS_CLOSE_PONG_TIMEOUT = "pong_timeout"
+	// client did not send message during idle timeout
+	WS_CLOSE_IDLE_TIMEOUT = "idle_timeout"
+	// removed by application with Remove
+	WS_CLOSE_REMOVED = "removed"
+	// closed by application with WSClient.Close
+	WS_CLOSE_SERVER = "server_closed"
+	// closed by application with Kick
+	WS_CLOSE_KICKED = "kicked"
+
+	WS_CLOSE_BY_CLIENT = "client"
+	WS_CLOSE_BY_SERVER = "server"
+)
+
+// WSCloseReason tell OnClose why a client is gone
+type WSCloseReason struct {
+	// one of WS_CLOSE_*
+	Cause 						string
+	// close code sent or received, ws.StatusAbnormalClosure when connection dropped without close frame
+	Code 						ws.StatusCode
+	// reason of close frame
+	Reason 						string
+	// WS_CLOSE_BY_CLIENT or WS_CLOSE_BY_SERVER
+	Initiator 					string
+	// read error when cause is WS_CLOSE_DISCONNECTED
+	Err 						error
+}
+
 type AppWebSocket struct {
 	app 						*App
 	pool 						*Pool
@@ -28,7 +62,7 @@ type AppWebSocket struct {
 
 	// callback
 	OnOpen 						func(client *WSClient)
-	OnClose 					func(uuid string)
+	OnClose 					func(uuid string, reason WSCloseReason)
 	OnJoinChannel 				func(client *WSClient, channel *WSChannel)
 	OnLeaveChannel 				func(uuid string, channel *WSChannel)
 	OnMessage 					func(client *WSClient, data []byte)
@@ -36,12 +70,31 @@ type AppWebSocket struct {
 	// users list ( combile with all channel )
 	userLock 					sync.RWMutex
 	users 						map[string]*WSClient
-	globaOut 					chan []byte
+	// connections of authenticated users by user id
+	userClients 				map[string]map[string]*WSClient
+	globaOut 					chan wsBroadcast
 
 	// channel list
 	channelLock					sync.RWMutex
 	channels 					[]*WSChannel
 	nameChannels				map[string]*WSChannel
+
+	// handshake authentication, nil accept everyone
+	auth 						*WSAuthConfig
+	// fan-out to other nodes, nil for single node
+	backplane 					*WSBackplane
+	// presence of clients in channels, nil when not used
+	presence 					*WSPresence
+
+	keepAliveLock 				sync.RWMutex
+	keepAlive 					WSKeepAliveConfig
+
+	// outbound queue of clients
+	queueLock 					sync.RWMutex
+	queueConfig 				WSQueueConfig
+	queueSent 					uint64
+	queueDropped 				uint64
+	queueDisconnected 			uint64
 }
 
 func NewAppWebSocket(app *App, wsRoute string, poolSize int, singleThreadProcess bool) *AppWebSocket{
@@ -51,10 +104,13 @@ func NewAppWebSocket(app *App, wsRoute string, poolSize int, singleThreadProcess
 	instance.singleThreadProcess = singleThreadProcess
 	instance.nameChannels = make(map[string]*WSChannel)
 	instance.users = make(map[string]*WSClient)
-	instance.globaOut = make(chan []byte, 1)
+	instance.userClients = make(map[string]map[string]*WSClient)
+	instance.globaOut = make(chan wsBroadcast, 1)
+	instance.keepAlive = DefaultWSKeepAliveConfig
+	instance.queueConfig = DefaultWSQueueConfig
 
 	instance.OnOpen = func(client *WSClient){}
-	instance.OnClose = func(uuid string){}
+	instance.OnClose = func(uuid string, reason WSCloseReason){}
 	instance.OnJoinChannel = func(client *WSClient, channel *WSChannel){}
 	instance.OnLeaveChannel = func(uuid string, channel *WSChannel){}
 	instance.OnMessage = func(client *WSClient, data []byte){}
@@ -62,6 +118,7 @@ func NewAppWebSocket(app *App, wsRoute string, poolSize int, singleThreadProcess
 	instance.Init(wsRoute)
 
 	go instance.globalBroadcaster()
+	go instance.keepAliveLoop()
 
 	return instance
 }
@@ -76,34 +133,60 @@ func (this*AppWebSocket) Init(wsRoute string) {
 
 
 func (this*AppWebSocket) globalBroadcaster() {
-	for bts := range this.globaOut {
+	for out := range this.globaOut {
+		bts := out.frame
 		this.userLock.RLock()
-		for _, u := range this.users {
-			u := u // For closure.
-			this.pool.Schedule(func() {
-				u.internalWrite(bts)
-			})
+		for uuid, u := range this.users {
+			if out.exclude[uuid] {
+				continue
+			}
+			_ = u.enqueue(bts)
 		}
 		this.userLock.RUnlock()
 	}
 }
 
+// upgrade authenticate request when auth is used then upgrade connection
+func (this*AppWebSocket) upgrade(c echo.Context) (net.Conn, *UserAuthData, error) {
+	upgrader := ws.HTTPUpgrader{}
+	var user *UserAuthData
+	if this.auth != nil {
+		var err error
+		if user, err = this.auth.authenticate(c); err != nil {
+			Log().Info().Err(err).Str("ip", c.RealIP()).Msg("WS authentication rejected")
+			return nil, nil, err
+		}
+		upgrader = this.auth.upgrader()
+	}
+	conn, _, _, err := upgrader.Upgrade(c.Request(), c.Response().Writer)
+	if err != nil {
+		Log().Error().Err(err).Msg("Upgrade WS Error")
+		return nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "Upgrade WS Error")
+	}
+	return conn, user, nil
+}
+
 func (this*AppWebSocket) initWindows(wsRoute string) {
 	this.app.Echo().GET(wsRoute, func(c echo.Context) error{
-		conn, _, _, err := ws.UpgradeHTTP(c.Request(), c.Response().Writer)
+		conn, user, err := this.upgrade(c)
 		if err != nil {
-			Log().Error().Err(err).Msg("Upgrade WS Error")
-			return echo.NewHTTPError(http.StatusInternalServerError, "Upgrade WS Error")
+			return err
 		}
 		// register new client connected to this websocket
-		this.registerClient(conn)
+		this.registerClient(conn, user, nil)
 		return nil
 	})
 
 	go func() {
 		for {
-			this.userLock.Lock()
+			// read outside userLock, removing a client take it
+			this.userLock.RLock()
+			clients := make([]*WSClient, 0, len(this.users))
 			for _, client := range this.users {
+				clients = append(clients, client)
+			}
+			this.userLock.RUnlock()
+			for _, client := range clients {
 				if !client.IsReading() {
 					safeConn := deadliner{client.conn.(net.Conn), time.Nanosecond}
 					buf := make([]byte, 0)
@@ -115,11 +198,7 @@ func (this*AppWebSocket) initWindows(wsRoute string) {
 						if this.singleThreadProcess {
 							data, err := c.Read()
 							if err != nil {
-								removed := this.internalRemove(c.uuid)
-								if removed {
-									this.OnClose(c.uuid)
-									Log().Info().Str("uuid", c.uuid ).Msg("Client disconnected")
-								}
+								this.remove(c.uuid, c.closeReason(err))
 							}else if data != nil {
 								this.OnMessage(c, data)
 							}
@@ -127,7 +206,7 @@ func (this*AppWebSocket) initWindows(wsRoute string) {
 							this.pool.Schedule(func() {
 								data, err := c.Read()
 								if err != nil {
-									this.Remove(c.uuid)
+									this.remove(c.uuid, c.closeReason(err))
 								}else if data != nil {
 									this.OnMessage(c, data)
 								}
@@ -136,7 +215,6 @@ func (this*AppWebSocket) initWindows(wsRoute string) {
 					}
 				}
 			}
-			this.userLock.Unlock()
 		}
 	}()
 }
@@ -151,15 +229,16 @@ func (this*AppWebSocket) initLinux(wsRoute string) {
 
 	// init route
 	this.app.Echo().GET(wsRoute, func(c echo.Context) error {
-		conn, _, _, err := ws.UpgradeHTTP(c.Request(), c.Response().Writer)
+		conn, user, err := this.upgrade(c)
 		if err != nil {
-			Log().Error().Err(err).Msg("Upgrade WS Error")
-			return echo.NewHTTPError(http.StatusInternalServerError, "Upgrade WS Error")
+			return err
 		}
-		// register new client connected to this websocket
-		client := this.registerClient(conn)
 		// create netpoll event descriptor for conn
 		readDesc := netpoll.Must(netpoll.HandleRead(conn))
+		// register new client connected to this websocket
+		client := this.registerClient(conn, user, func() {
+			_ = poller.Stop(readDesc)
+		})
 		_ = poller.Start(readDesc, func(ev netpoll.Event) {
 			if ev & (netpoll.EventReadHup | netpoll.EventHup) != 0 {
 				// When ReadHup or Hup received, this mean that client has
@@ -167,7 +246,7 @@ func (this*AppWebSocket) initLinux(wsRoute string) {
 				// itself. So we want to stop receive events about such conn
 				// and remove it from the chat registry.
 				_ = poller.Stop(readDesc)
-				this.Remove(client.uuid)
+				this.remove(client.uuid, client.closeReason(io.EOF))
 				return
 			}
 			// Here we can read some new message from connection.
@@ -179,11 +258,7 @@ func (this*AppWebSocket) initLinux(wsRoute string) {
 				data, err := client.Read()
 				if err != nil {
 					_ = poller.Stop(readDesc)
-					removed := this.internalRemove(client.uuid)
-					if removed {
-						this.OnClose(client.uuid)
-						Log().Info().Str("uuid", client.uuid ).Msg("Client disconnected")
-					}
+					this.remove(client.uuid, client.closeReason(err))
 				}else if data != nil {
 					this.OnMessage(client, data)
 				}
@@ -192,7 +267,7 @@ func (this*AppWebSocket) initLinux(wsRoute string) {
 					data, err := client.Read()
 					if err != nil {
 						_ = poller.Stop(readDesc)
-						this.Remove(client.uuid)
+						this.remove(client.uuid, client.closeReason(err))
 					}else if data != nil {
 						this.OnMessage(client, data)
 					}
@@ -305,103 +380,297 @@ func (this*AppWebSocket) BroadcastAllChannelH(data echo.Map) {
 }
 
 func (this*AppWebSocket) BroadcastGlobal(data []byte) {
-	var buf bytes.Buffer
-	w := wsutil.NewWriter(&buf, ws.StateServerSide, ws.OpText)
-	w.Write(data)
-	w.Flush()
-	this.globaOut <- buf.Bytes()
+	this.BroadcastGlobalExcept(data)
 }
 
 func (this*AppWebSocket) BroadcastGlobalH(data echo.Map) {
-	var buf bytes.Buffer
-	w := wsutil.NewWriter(&buf, ws.StateServerSide, ws.OpText)
 	b, err := json.Marshal(data)
 	if err != nil {
 		Log().Error().Err(err).Msg("Encode error")
 		return
 	}
-	w.Write(b)
+	this.BroadcastGlobal(b)
+}
+
+// BroadcastGlobalExcept send to every client except given uuids
+func (this*AppWebSocket) BroadcastGlobalExcept(data []byte, exclude ...string) {
+	this.globaOut <- wsBroadcast{frame: wsTextFrame(data), exclude: wsExcludeSet(exclude)}
+	if this.backplane != nil {
+		this.backplane.publish(WS_BACKPLANE_GLOBAL, "", nil, exclude, data)
+	}
+}
+
+// BroadcastInChannelExcept send to clients of channel except given uuids, ex: everyone but the sender
+func (this*AppWebSocket) BroadcastInChannelExcept(data []byte, channelName string, exclude ...string) {
+	this.channelLock.RLock()
+	channel, has := this.nameChannels[channelName]
+	this.channelLock.RUnlock()
+	if has {
+		channel.BroadcastExcept(data, exclude...)
+	}
+}
+
+//-------------------------------------------------------------
+// Targeted delivery
+//-------------------------------------------------------------
+
+// WSDeliveryResult report what happened to a targeted send
+type WSDeliveryResult struct {
+	// uuids whose queue accepted the message
+	Delivered 					[]string
+	// uuids whose queue dropped the message, which are closing, or when message could not be encoded
+	Failed 						[]string
+	// uuids not connected to this node
+	Missing 					[]string
+	// message was published to other nodes through backplane, their deliveries are not reported
+	Forwarded 					bool
+}
+
+// Ok is true when every target received the message
+func (this WSDeliveryResult) Ok() bool {
+	return len(this.Delivered) > 0 && len(this.Failed) == 0 && len(this.Missing) == 0
+}
+
+// SendToClient write to one connection
+func (this*AppWebSocket) SendToClient(uuid string, data []byte) WSDeliveryResult {
+	return this.SendToMany([]string{uuid}, data)
+}
+
+func (this*AppWebSocket) SendToClientH(uuid string, data echo.Map) WSDeliveryResult {
+	return this.SendToManyH([]string{uuid}, data)
+}
+
+// SendToUser write to all connections of an authenticated user, Delivered is empty when user is offline
+func (this*AppWebSocket) SendToUser(userID string, data []byte) WSDeliveryResult {
+	result := this.deliver(this.ClientsOfUser(userID), nil, wsTextFrame(data))
+	if this.backplane != nil {
+		this.backplane.publish(WS_BACKPLANE_USER, userID, nil, nil, data)
+		result.Forwarded = true
+	}
+	return result
+}
+
+func (this*AppWebSocket) SendToUserH(userID string, data echo.Map) WSDeliveryResult {
+	b, err := json.Marshal(data)
+	if err != nil {
+		Log().Error().Err(err).Msg("Encode error")
+		return WSDeliveryResult{}
+	}
+	return this.SendToUser(userID, b)
+}
+
+// SendToMany write to a set of connections, with backplane missing uuids are forwarded to other nodes
+func (this*AppWebSocket) SendToMany(uuids []string, data []byte) WSDeliveryResult {
+	clients, missing := this.localClients(uuids)
+	result := this.deliver(clients, missing, wsTextFrame(data))
+	if this.backplane != nil && len(missing) > 0 {
+		this.backplane.publish(WS_BACKPLANE_CLIENTS, "", missing, nil, data)
+		result.Forwarded = true
+	}
+	return result
+}
+
+// localClients split uuids in clients connected to this node and missing uuids
+func (this*AppWebSocket) localClients(uuids []string) ([]*WSClient, []string) {
+	clients := make([]*WSClient, 0, len(uuids))
+	var missing []string
+	this.userLock.RLock()
+	for _, uuid := range uuids {
+		if client, has := this.users[uuid]; has {
+			clients = append(clients, client)
+		} else {
+			missing = append(missing, uuid)
+		}
+	}
+	this.userLock.RUnlock()
+	return clients, missing
+}
+
+func (this*AppWebSocket) SendToManyH(uuids []string, data echo.Map) WSDeliveryResult {
+	b, err := json.Marshal(data)
+	if err != nil {
+		Log().Error().Err(err).Msg("Encode error")
+		return WSDeliveryResult{Failed: uuids}
+	}
+	return this.SendToMany(uuids, b)
+}
+
+// deliver queue frame to clients
+func (this*AppWebSocket) deliver(clients []*WSClient, missing []string, frame []byte) WSDeliveryResult {
+	result := WSDeliveryResult{Missing: missing}
+	for _, client := range clients {
+		if err := client.enqueue(frame); err != nil {
+			Log().Info().Err(err).Str("uuid", client.uuid).Msg("Message to client dropped")
+			result.Failed = append(result.Failed, client.uuid)
+		} else {
+			result.Delivered = append(result.Delivered, client.uuid)
+		}
+	}
+	return result
+}
+
+// wsBroadcast is a frame queued for broadcasters
+type wsBroadcast struct {
+	frame 						[]byte
+	exclude 					map[string]bool
+}
+
+func wsTextFrame(data []byte) []byte {
+	var buf bytes.Buffer
+	w := wsutil.NewWriter(&buf, ws.StateServerSide, ws.OpText)
+	w.Write(data)
 	w.Flush()
-	this.globaOut <- buf.Bytes()
+	return buf.Bytes()
 }
 
-func (this*AppWebSocket) ClientJoinChannel(client *WSClient, channelName string) bool{
-	client.io.RLock()
-	if client.channel != nil {
-		// remove client from old channel before add to new one
-		client.channel.Remove(client.id)
+func wsExcludeSet(uuids []string) map[string]bool {
+	if len(uuids) == 0 {
+		return nil
+	}
+	exclude := make(map[string]bool, len(uuids))
+	for _, uuid := range uuids {
+		exclude[uuid] = true
 	}
-	client.io.RUnlock()
+	return exclude
+}
 
+// ClientJoinChannel add client to channel, client stay in channels it already joined
+func (this*AppWebSocket) ClientJoinChannel(client *WSClient, channelName string) bool{
 	// check if channel name is available
 	this.channelLock.RLock()
-	if _, has := this.nameChannels[channelName]; !has {
-		this.channelLock.RUnlock()
+	channel, has := this.nameChannels[channelName]
+	this.channelLock.RUnlock()
+	if !has {
 		return false
 	}
-	this.channelLock.RUnlock()
-
-	// add to new channel
-	this.channelLock.Lock()
-	this.nameChannels[channelName].AddClient(client)
-	this.channelLock.Unlock()
-
-	this.OnJoinChannel(client, this.nameChannels[channelName])
 
+	if channel.addClient(client) {
+		this.OnJoinChannel(client, channel)
+	}
 	return true
 }
 
-func (this*AppWebSocket) registerClient(conn net.Conn) *WSClient {
+// ClientLeaveChannel remove client from one channel
+func (this*AppWebSocket) ClientLeaveChannel(client *WSClient, channelName string) bool{
+	return client.Leave(channelName)
+}
+
+func (this*AppWebSocket) registerClient(conn net.Conn, user *UserAuthData, release func()) *WSClient {
 	client := &WSClient{
 		server: this,
 		conn: conn,
 		RemoteAddress: conn.RemoteAddr().String(),
+		auth: user,
+		release: release,
 	}
+	now := time.Now().UnixNano()
+	client.messageAt, client.pingAt, client.pongAt = now, now, now
 	// save client to map
 	this.userLock.Lock()
 	{
 		client.uuid = GetUniqueCode(16)
 		this.users[client.uuid] = client
+		if user != nil {
+			if this.userClients[user.UserID] == nil {
+				this.userClients[user.UserID] = make(map[string]*WSClient)
+			}
+			this.userClients[user.UserID][client.uuid] = client
+		}
+		if this.backplane != nil {
+			this.backplane.trackConnect(client)
+			this.backplane.trackUser(client.UserID(), len(this.userClients[client.UserID()]))
+		}
 	}
 	this.userLock.Unlock()
 
 	this.OnOpen(client)
-	Log().Info().Int("ID", client.id ).Msg("Client connected")
+	Log().Info().Str("uuid", client.uuid ).Msg("Client connected")
 
 	return client
 }
 
+// GetClient return connected client, nil when not found
+func (this*AppWebSocket) GetClient(uuid string) *WSClient {
+	this.userLock.RLock()
+	defer this.userLock.RUnlock()
+	return this.users[uuid]
+}
+
+// ClientsOfUser return all connections ( devices, tabs ) of an authenticated user
+func (this*AppWebSocket) ClientsOfUser(userID string) []*WSClient {
+	this.userLock.RLock()
+	defer this.userLock.RUnlock()
+	clients := make([]*WSClient, 0, len(this.userClients[userID]))
+	for _, client := range this.userClients[userID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+func (this*AppWebSocket) IsUserOnline(userID string) bool {
+	this.userLock.RLock()
+	defer this.userLock.RUnlock()
+	return len(this.userClients[userID]) > 0
+}
+
 // remove user from global list
 // it already take care if user in a channel then channel will remove user too
 func (this*AppWebSocket) Remove(uuid string) bool{
+	return this.remove(uuid, WSCloseReason{Cause: WS_CLOSE_REMOVED, Code: ws.StatusNoStatusRcvd, Initiator: WS_CLOSE_BY_SERVER})
+}
+
+// Kick remove all connections of user from their channels and close them with code and reason.
+// with backplane connections of user on other nodes are kicked too
+func (this*AppWebSocket) Kick(userID string, code ws.StatusCode, reason string) int {
+	kicked := this.kick(userID, code, reason)
+	if this.backplane != nil {
+		this.backplane.publishKick(userID, code, reason)
+	}
+	return kicked
+}
+
+func (this*AppWebSocket) kick(userID string, code ws.StatusCode, reason string) int {
+	clients := this.ClientsOfUser(userID)
+	for _, client := range clients {
+		client.LeaveAll()
+		_ = this.closeClient(client, WSCloseReason{Cause: WS_CLOSE_KICKED, Code: code, Reason: reason, Initiator: WS_CLOSE_BY_SERVER})
+	}
+	return len(clients)
+}
+
+func (this*AppWebSocket) remove(uuid string, reason WSCloseReason) bool{
 	this.userLock.Lock()
-	removed := this.internalRemove(uuid)
+	user := this.internalRemove(uuid)
 	this.userLock.Unlock()
-	if removed {
-		this.OnClose(uuid)
-		Log().Info().Str("uuid", uuid ).Msg("Client disconnected")
+	if user == nil {
+		return false
 	}
-	return removed
+	// remove in channels, outside userLock as leaving may call backplane and OnLeaveChannel
+	user.LeaveAll()
+	this.OnClose(uuid, reason)
+	Log().Info().Str("uuid", uuid ).Str("cause", reason.Cause).Msg("Client disconnected")
+	return true
 }
 
-func (this*AppWebSocket) internalRemove(uuid string) bool{
+// internalRemove remove client from global list and return it, nil when not found. userLock must be held
+func (this*AppWebSocket) internalRemove(uuid string) *WSClient{
 	// remove in global list
-	if _, has := this.users[uuid]; !has {
-		return false
+	user, has := this.users[uuid]
+	if !has {
+		return nil
 	}
-	user := this.users[uuid]
-	defer func() { user = nil }()
 	delete(this.users, uuid)
-	// remove in channel
-	channel := user.channel
-	if channel != nil {
-		idInChannel := user.id
-		if _, has := this.nameChannels[channel.name]; !has {
-			return false
+	if user.auth != nil {
+		delete(this.userClients[user.auth.UserID], uuid)
+		if len(this.userClients[user.auth.UserID]) == 0 {
+			delete(this.userClients, user.auth.UserID)
 		}
-		return channel.Remove(idInChannel)
 	}
-	return true
+	if this.backplane != nil {
+		this.backplane.trackDisconnect(uuid)
+		this.backplane.trackUser(user.UserID(), len(this.userClients[user.UserID()]))
+	}
+	return user
 }
 
 
@@ -433,23 +702,56 @@ type WSClient struct {
 
 	RemoteAddress 				string
 
-	id 							int
 	uuid 						string
 	server 						*AppWebSocket
 
-	channel 					*WSChannel
+	// joined channels with id of client in each channel
+	memberLock 					sync.RWMutex
+	channels 					map[*WSChannel]int
 
 	io   						sync.RWMutex
 	conn 						io.ReadWriteCloser
 	reading 					bool
 
 	context 					interface{}
+	// authenticated user, nil for anonymous client
+	auth 						*UserAuthData
+
+	// keepalive, unix nanoseconds of last message received, last ping sent and last pong received
+	messageAt 					int64
+	pingAt 						int64
+	pongAt 						int64
+	// stop watching connection
+	release 					func()
+	// set when server started closing handshake
+	closeLock 					sync.Mutex
+	closing 					*WSCloseReason
+
+	// outbound queue drained by a single writer
+	outLock 					sync.Mutex
+	out 						[][]byte
+	writing 					bool
+	sent 						uint64
+	dropped 					uint64
 }
 
 func (c*WSClient) GetUUID() string{
 	return c.uuid
 }
 
+// Auth return user authenticated during handshake, nil for anonymous client
+func (c*WSClient) Auth() *UserAuthData{
+	return c.auth
+}
+
+// UserID of authenticated user, empty for anonymous client
+func (c*WSClient) UserID() string{
+	if c.auth == nil {
+		return ""
+	}
+	return c.auth.UserID
+}
+
 func (c*WSClient) GetContext() interface{}{
 	return c.context
 }
@@ -484,6 +786,40 @@ func (c*WSClient) ClearReading() {
 }
 
 
+// Close send close frame with code and reason, connection is dropped when client answer or after close timeout.
+// OnClose receive code and reason with WS_CLOSE_BY_SERVER initiator
+func (c*WSClient) Close(code ws.StatusCode, reason string) error {
+	return c.server.closeClient(c, WSCloseReason{Cause: WS_CLOSE_SERVER, Code: code, Reason: reason, Initiator: WS_CLOSE_BY_SERVER})
+}
+
+// IsClosing is true once server sent close frame
+func (c*WSClient) IsClosing() bool {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	return c.closing != nil
+}
+
+// closeReason of a read error, closing handshake started by server keep its reason
+func (c*WSClient) closeReason(err error) WSCloseReason {
+	c.closeLock.Lock()
+	closing := c.closing
+	c.closeLock.Unlock()
+	if closing != nil {
+		return *closing
+	}
+	reason := WSCloseReason{
+		Cause: WS_CLOSE_DISCONNECTED,
+		Code: ws.StatusAbnormalClosure,
+		Initiator: WS_CLOSE_BY_CLIENT,
+		Err: err,
+	}
+	if closed, ok := err.(wsutil.ClosedError); ok {
+		reason.Code = closed.Code
+		reason.Reason = closed.Reason
+	}
+	return reason
+}
+
 func (c*WSClient) Read() ([]byte, error){
 	data, err := c.internalRead()
 	if err != nil {
@@ -493,6 +829,9 @@ func (c*WSClient) Read() ([]byte, error){
 		return nil, err
 	}
 	c.ClearReading()
+	if c.server.presence != nil {
+		c.server.presence.seen(c, false)
+	}
 	return data, nil
 }
 
@@ -500,19 +839,23 @@ func (c*WSClient) internalRead() ([]byte, error){
 	c.io.Lock()
 	defer c.io.Unlock()
 
-	c.conn.(net.Conn).SetDeadline(time.Now().Add(WS_DEADLINE_DURATION_READ))
+	c.conn.(net.Conn).SetDeadline(time.Now().Add(c.server.keepAliveConfig().ReadDeadline))
 
 	h, r, err := wsutil.NextReader(c.conn, ws.StateServerSide)
 	if err != nil {
 		return nil, err
 	}
 	if h.OpCode.IsControl() {
+		if h.OpCode == ws.OpPong {
+			atomic.StoreInt64(&c.pongAt, time.Now().UnixNano())
+		}
 		return nil, wsutil.ControlFrameHandler(c.conn, ws.StateServerSide)(h, r)
 	}
 	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
+	atomic.StoreInt64(&c.messageAt, time.Now().UnixNano())
 	return data, nil
 }
 
@@ -520,7 +863,7 @@ func (c *WSClient) internalWrite(p []byte) error {
 	c.io.Lock()
 	defer c.io.Unlock()
 
-	c.conn.(net.Conn).SetDeadline(time.Now().Add(WS_DEADLINE_DURATION_WRITE))
+	c.conn.(net.Conn).SetDeadline(time.Now().Add(c.server.keepAliveConfig().WriteDeadline))
 
 	_, err := c.conn.Write(p)
 	return err
@@ -535,54 +878,110 @@ func (c *WSClient) WriteH(data echo.Map) {
 	c.Write(ret)
 }
 
+// Write queue data, frames are written in order by the writer of client
 func (c *WSClient) Write(data []byte) {
-	var buf bytes.Buffer
-	w := wsutil.NewWriter(&buf, ws.StateServerSide, ws.OpText)
-	w.Write(data)
-	w.Flush()
-	c.server.pool.Schedule(func() {
-		c.internalWrite(buf.Bytes())
-	})
+	_ = c.enqueue(wsTextFrame(data))
 }
 
+// BroadcastInChannel send to every channel client joined
 func (c *WSClient) BroadcastInChannel(p []byte)  {
-	c.io.RLock()
-	if c.channel != nil {
-		c.io.RUnlock()
-		c.channel.Broadcast(p)
-	}else{
-		c.io.RUnlock()
+	for _, channel := range c.Channels() {
+		channel.Broadcast(p)
 	}
 }
 
 func (c *WSClient) BroadcastInChannelH(data echo.Map)  {
-	c.io.RLock()
-	if c.channel != nil {
-		c.io.RUnlock()
-		ret, err := json.Marshal(data)
-		if err != nil {
-			Log().Error().Err(err).Msg("Error when marshal data")
-			return
+	ret, err := json.Marshal(data)
+	if err != nil {
+		Log().Error().Err(err).Msg("Error when marshal data")
+		return
+	}
+	c.BroadcastInChannel(ret)
+}
+
+// BroadcastToOthers send to the other clients of every channel client joined
+func (c *WSClient) BroadcastToOthers(p []byte)  {
+	for _, channel := range c.Channels() {
+		channel.BroadcastExcept(p, c.uuid)
+	}
+}
+
+// BroadcastIn send to the other clients of one joined channel, false when client is not member
+func (c *WSClient) BroadcastIn(channelName string, p []byte) bool {
+	channel := c.Channel(channelName)
+	if channel == nil {
+		return false
+	}
+	channel.BroadcastExcept(p, c.uuid)
+	return true
+}
+
+// Channels joined by client
+func (c *WSClient) Channels() []*WSChannel {
+	c.memberLock.RLock()
+	defer c.memberLock.RUnlock()
+	channels := make([]*WSChannel, 0, len(c.channels))
+	for channel := range c.channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// Channel return joined channel by name, nil when client is not member
+func (c *WSClient) Channel(name string) *WSChannel {
+	c.memberLock.RLock()
+	defer c.memberLock.RUnlock()
+	for channel := range c.channels {
+		if channel.name == name {
+			return channel
 		}
-		c.channel.Broadcast(ret)
-	}else{
-		c.io.RUnlock()
 	}
+	return nil
+}
+
+func (c *WSClient) InChannel(name string) bool {
+	return c.Channel(name) != nil
 }
 
 func (c *WSClient) OnAnyChannel() bool {
-	c.io.RLock()
-	defer c.io.RUnlock()
-	return c.channel != nil
+	c.memberLock.RLock()
+	defer c.memberLock.RUnlock()
+	return len(c.channels) > 0
 }
 
-func (c *WSClient) LeaveChannel()  {
-	c.io.RLock()
-	defer c.io.RUnlock()
-	if c.channel != nil {
-		c.channel.Remove(c.id)
-		c.channel = nil
+// Leave one channel
+func (c *WSClient) Leave(name string) bool {
+	c.memberLock.RLock()
+	var channel *WSChannel
+	id := 0
+	for joined, idInChannel := range c.channels {
+		if joined.name == name {
+			channel, id = joined, idInChannel
+		}
 	}
+	c.memberLock.RUnlock()
+	if channel == nil {
+		return false
+	}
+	return channel.Remove(id)
+}
+
+// LeaveAll channels
+func (c *WSClient) LeaveAll() {
+	c.memberLock.RLock()
+	memberships := make(map[*WSChannel]int, len(c.channels))
+	for channel, id := range c.channels {
+		memberships[channel] = id
+	}
+	c.memberLock.RUnlock()
+	for channel, id := range memberships {
+		channel.Remove(id)
+	}
+}
+
+// LeaveChannel leave all channels
+func (c *WSClient) LeaveChannel()  {
+	c.LeaveAll()
 }
 //-------------------------------------------------------------
 // PRIVATE FUNCTIONS
@@ -595,8 +994,10 @@ type WSChannel struct {
 	clients 					[]*WSClient
 	mapClients 					map[int]*WSClient
 	seq							int
-	// channel for broadcast
-	out 						chan []byte
+	// channel for broadcast, closed is set under outLock before out is closed
+	outLock 					sync.RWMutex
+	closed 						bool
+	out 						chan wsBroadcast
 }
 
 func NewChannel(server *AppWebSocket, name string) *WSChannel{
@@ -604,7 +1005,7 @@ func NewChannel(server *AppWebSocket, name string) *WSChannel{
 	instance.name = name
 	instance.server = server
 	instance.mapClients = make(map[int]*WSClient)
-	instance.out = make(chan []byte, 1)
+	instance.out = make(chan wsBroadcast, 1)
 
 	go instance.broadcaster()
 
@@ -622,13 +1023,14 @@ func (this*WSChannel) Users() int {
 }
 
 func (this*WSChannel) broadcaster() {
-	for bts := range this.out {
+	for out := range this.out {
+		bts := out.frame
 		this.clientLock.RLock()
 		for _, u := range this.mapClients {
-			u := u // For closure.
-			this.server.pool.Schedule(func() {
-				u.internalWrite(bts)
-			})
+			if out.exclude[u.uuid] {
+				continue
+			}
+			_ = u.enqueue(bts)
 		}
 		this.clientLock.RUnlock()
 	}
@@ -637,53 +1039,106 @@ func (this*WSChannel) broadcaster() {
 func (this*WSChannel) Close() {
 	this.clientLock.Lock()
 	for _, u := range this.clients {
-		u.io.Lock()
-		u.channel = nil
-		u.io.Unlock()
+		u.memberLock.Lock()
+		delete(u.channels, this)
+		u.memberLock.Unlock()
 	}
 	this.clientLock.Unlock()
+	this.outLock.Lock()
+	if this.closed {
+		this.outLock.Unlock()
+		return
+	}
+	this.closed = true
 	close(this.out)
+	this.outLock.Unlock()
+	if this.server.backplane != nil {
+		this.server.backplane.trackClose(this)
+	}
+	if this.server.presence != nil {
+		this.server.presence.closeChannel(this)
+	}
 }
 
 func (this*WSChannel) Broadcast(data []byte) {
-	var buf bytes.Buffer
-	w := wsutil.NewWriter(&buf, ws.StateServerSide, ws.OpText)
-	w.Write(data)
-	w.Flush()
-
-	this.out <- buf.Bytes()
+	this.BroadcastExcept(data)
 }
 
 
 func (this*WSChannel) BroadcastH(data echo.Map) {
-	var buf bytes.Buffer
-	w := wsutil.NewWriter(&buf, ws.StateServerSide, ws.OpText)
 	b, err := json.Marshal(data)
 	if err != nil {
 		Log().Error().Err(err).Msg("Encode error")
 		return
 	}
-	w.Write(b)
-	w.Flush()
-	this.out <- buf.Bytes()
+	this.Broadcast(b)
+}
+
+// BroadcastExcept send to clients of channel except given uuids
+func (this*WSChannel) BroadcastExcept(data []byte, exclude ...string) {
+	if !this.push(wsBroadcast{frame: wsTextFrame(data), exclude: wsExcludeSet(exclude)}) {
+		return
+	}
+	if this.server.backplane != nil {
+		this.server.backplane.publish(WS_BACKPLANE_CHANNEL, this.name, nil, exclude, data)
+	}
 }
 
+// push queue broadcast for local clients, false when channel is closed
+func (this*WSChannel) push(broadcast wsBroadcast) bool {
+	this.outLock.RLock()
+	defer this.outLock.RUnlock()
+	if this.closed {
+		return false
+	}
+	this.out <- broadcast
+	return true
+}
 
 func (this*WSChannel) AddClient(client *WSClient) {
+	this.addClient(client)
+}
+
+// addClient return false when client is already member
+func (this*WSChannel) addClient(client *WSClient) bool {
 	// save client to map
 	this.clientLock.Lock()
+	client.memberLock.Lock()
+	if _, has := client.channels[this]; has {
+		client.memberLock.Unlock()
+		this.clientLock.Unlock()
+		return false
+	}
+	id := this.seq
 	{
-		client.id = this.seq
-		client.channel = this
+		if client.channels == nil {
+			client.channels = make(map[*WSChannel]int)
+		}
+		client.channels[this] = id
 
 		this.clients = append(this.clients, client)
-		this.mapClients[client.id] = client
+		this.mapClients[id] = client
 
 		this.seq++
 	}
+	client.memberLock.Unlock()
 	this.clientLock.Unlock()
 
-	Log().Info().Int("ID", client.id ).Str("Channel Name", this.name).Msg("Client added to channel")
+	if this.server.backplane != nil {
+		this.server.backplane.trackJoin(this, client)
+	}
+	if this.server.presence != nil {
+		this.server.presence.join(this, client)
+	}
+	Log().Info().Int("ID", id ).Str("Channel Name", this.name).Msg("Client added to channel")
+	return true
+}
+
+// Clients of channel on this node
+func (this*WSChannel) Clients() []*WSClient {
+	this.clientLock.RLock()
+	defer this.clientLock.RUnlock()
+	return append([]*WSClient(nil), this.clients...)
 }
 
 
@@ -692,6 +1147,12 @@ func (this*WSChannel) Remove(id int) bool{
 	uuid, removed := this.internalRemove(id)
 	this.clientLock.Unlock()
 	if removed {
+		if this.server.backplane != nil {
+			this.server.backplane.trackLeave(this, uuid)
+		}
+		if this.server.presence != nil {
+			this.server.presence.leave(this, uuid)
+		}
 		this.server.OnLeaveChannel(uuid, this)
 		Log().Info().Int("ID", id ).Str("Channel Name", this.name).Msg("Client leave Channel")
 	}
@@ -702,12 +1163,17 @@ func (this*WSChannel) internalRemove(id int) (string, bool){
 	if _, has := this.mapClients[id]; !has {
 		return "", false
 	}
-	uuid :=  this.mapClients[id].uuid
+	client := this.mapClients[id]
+	uuid := client.uuid
 	delete(this.mapClients, id)
+	client.memberLock.Lock()
+	delete(client.channels, this)
+	client.memberLock.Unlock()
 
-	i := sort.Search(len(this.clients), func(i int) bool {
-		return this.clients[i].id >= id
-	})
+	i := 0
+	for i < len(this.clients) && this.clients[i] != client {
+		i++
+	}
 	if i >= len(this.clients) {
 		panic("chat: inconsistent state")
 	}
@@ -0,0 +1,145 @@
+package gocore
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gobwas/ws"
+	"github.com/labstack/echo/v4"
+)
+
+// WSAuthConfig defines how AppWebSocket authenticate the handshake request
+type WSAuthConfig struct {
+	// Validator check credentials. Optional. Default TokkorRedis() sessions.
+	Validator 					AuthValidator
+
+	// Authenticator replace Validator when custom logic is needed.
+	// return *echo.HTTPError to reject upgrade with its status
+	Authenticator 				func(c echo.Context, credentials AuthCredentials) (*UserAuthData, error)
+
+	// TokenLookup is a comma separated list of "<source>:<name>" where token is searched in order.
+	// source: header, cookie, query or protocol.
+	// "protocol:access_token" read token sent by browsers as subprotocols "access_token, <token>"
+	// and negotiate "access_token" as subprotocol of connection.
+	// Optional. Default value "query:access_token,header:Authorization,cookie:access_token,protocol:access_token".
+	TokenLookup 				string
+
+	// AuthScheme stripped from Authorization header. Optional. Default value "Bearer".
+	AuthScheme 					string
+
+	// UserIDLookup same format as TokenLookup. Optional. Default value "query:user_id,header:X-User-ID".
+	UserIDLookup 				string
+
+	// Optional let anonymous clients connect, WSClient.Auth() is nil for them
+	Optional 					bool
+
+	// FailStatus of rejected upgrade when error is not *echo.HTTPError. Optional. Default 401.
+	FailStatus 					int
+
+	tokenExtractors 			[]authExtractor
+	userIDExtractors 			[]authExtractor
+	protocol 					string
+}
+
+var DefaultWSAuthConfig = WSAuthConfig{
+	TokenLookup: "query:access_token,header:" + echo.HeaderAuthorization + ",cookie:access_token,protocol:access_token",
+	AuthScheme: "Bearer",
+	UserIDLookup: "query:user_id,header:X-User-ID",
+	FailStatus: http.StatusUnauthorized,
+}
+
+// UseAuth authenticate every websocket handshake, rejected clients are never upgraded
+func (this*AppWebSocket) UseAuth(config WSAuthConfig) {
+	if config.Authenticator == nil {
+		if config.Validator == nil {
+			config.Validator = TokkorRedis()
+		}
+		validator := config.Validator
+		config.Authenticator = func(c echo.Context, credentials AuthCredentials) (*UserAuthData, error) {
+			return validator.ValidateCredentials(credentials)
+		}
+	}
+	if config.TokenLookup == "" {
+		config.TokenLookup = DefaultWSAuthConfig.TokenLookup
+	}
+	if config.AuthScheme == "" {
+		config.AuthScheme = DefaultWSAuthConfig.AuthScheme
+	}
+	if config.UserIDLookup == "" {
+		config.UserIDLookup = DefaultWSAuthConfig.UserIDLookup
+	}
+	if config.FailStatus == 0 {
+		config.FailStatus = DefaultWSAuthConfig.FailStatus
+	}
+	config.tokenExtractors = config.extractors(config.TokenLookup, config.AuthScheme)
+	config.userIDExtractors = config.extractors(config.UserIDLookup, "")
+	this.auth = &config
+}
+
+// extractors of AuthConfig plus the websocket subprotocol source
+func (config *WSAuthConfig) extractors(lookup string, scheme string) []authExtractor {
+	var extractors []authExtractor
+	for _, part := range strings.Split(lookup, ",") {
+		parts := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if parts[0] != "protocol" {
+			extractors = append(extractors, authExtractors(part, scheme)...)
+			continue
+		}
+		name := parts[1]
+		config.protocol = name
+		extractors = append(extractors, func(c echo.Context) string {
+			var protocols []string
+			for _, header := range c.Request().Header[http.CanonicalHeaderKey("Sec-WebSocket-Protocol")] {
+				for _, protocol := range strings.Split(header, ",") {
+					protocols = append(protocols, strings.TrimSpace(protocol))
+				}
+			}
+			for i := 0; i < len(protocols) - 1; i++ {
+				if protocols[i] == name {
+					return protocols[i + 1]
+				}
+			}
+			return ""
+		})
+	}
+	return extractors
+}
+
+// authenticate handshake request, user is nil for anonymous clients when auth is optional
+func (config *WSAuthConfig) authenticate(c echo.Context) (*UserAuthData, error) {
+	credentials := AuthCredentials{
+		Token: authExtract(c, config.tokenExtractors),
+		UserID: authExtract(c, config.userIDExtractors),
+		IP: c.RealIP(),
+	}
+	if credentials.Token == "" {
+		if config.Optional {
+			return nil, nil
+		}
+		return nil, echo.NewHTTPError(config.FailStatus, ErrAuthMissing.Error())
+	}
+	user, err := config.Authenticator(c, credentials)
+	if err == nil && user == nil {
+		err = ErrAuthInvalid
+	}
+	if err != nil {
+		if httpErr, ok := err.(*echo.HTTPError); ok {
+			return nil, httpErr
+		}
+		return nil, echo.NewHTTPError(config.FailStatus, err.Error())
+	}
+	return user, nil
+}
+
+func (config *WSAuthConfig) upgrader() ws.HTTPUpgrader {
+	upgrader := ws.HTTPUpgrader{}
+	if protocol := config.protocol; protocol != "" {
+		upgrader.Protocol = func(p string) bool {
+			return p == protocol
+		}
+	}
+	return upgrader
+}
@@ -0,0 +1,99 @@
+package gocore
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/labstack/echo/v4"
+)
+
+func TestWSHandshakeAuth(t *testing.T) {
+	server := testWSServer()
+	server.UseAuth(WSAuthConfig{Validator: testAuthValidator{"t1": {UserID: "u1"}}})
+	httpServer := testWSHTTP(server)
+	defer httpServer.Close()
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws"
+
+	rejected := []struct {
+		name 					string
+		dialer 					ws.Dialer
+		target 					string
+	}{
+		{"no token", ws.Dialer{}, url},
+		{"wrong token", ws.Dialer{}, url + "?access_token=nope"},
+		{"wrong protocol token", ws.Dialer{Protocols: []string{"access_token", "nope"}}, url},
+	}
+	for _, tt := range rejected {
+		conn, _, _, err := tt.dialer.Dial(context.Background(), tt.target)
+		if conn != nil {
+			conn.Close()
+		}
+		if err != ws.StatusError(http.StatusUnauthorized) {
+			t.Errorf("%s: err %v, want 401", tt.name, err)
+		}
+	}
+	if n := len(server.ClientsOfUser("u1")); n != 0 {
+		t.Fatalf("%d clients registered by rejected handshakes", n)
+	}
+
+	conn, _, _, err := ws.Dial(context.Background(), url + "?access_token=t1")
+	if err != nil {
+		t.Fatalf("query token: %v", err)
+	}
+	conn.Close()
+	conn, _, handshake, err := ws.Dialer{Protocols: []string{"access_token", "t1"}}.Dial(context.Background(), url)
+	if err != nil || handshake.Protocol != "access_token" {
+		t.Fatalf("protocol token: %v %q", err, handshake.Protocol)
+	}
+	conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for len(server.ClientsOfUser("u1")) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients of u1", len(server.ClientsOfUser("u1")))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWSHandshakeAuthenticator(t *testing.T) {
+	server := testWSServer()
+	server.UseAuth(WSAuthConfig{
+		Optional: true,
+		Authenticator: func(c echo.Context, credentials AuthCredentials) (*UserAuthData, error) {
+			if credentials.Token == "banned" {
+				return nil, echo.NewHTTPError(http.StatusForbidden, "banned")
+			}
+			return &UserAuthData{UserID: credentials.UserID}, nil
+		},
+	})
+	httpServer := testWSHTTP(server)
+	defer httpServer.Close()
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/ws"
+
+	if _, _, _, err := ws.Dial(context.Background(), url + "?access_token=banned"); err != ws.StatusError(http.StatusForbidden) {
+		t.Errorf("banned: err %v, want 403", err)
+	}
+	// optional auth let anonymous client in
+	conn, _, _, err := ws.Dial(context.Background(), url)
+	if err != nil {
+		t.Fatalf("anonymous: %v", err)
+	}
+	conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		server.userLock.RLock()
+		n, users := len(server.users), len(server.userClients)
+		server.userLock.RUnlock()
+		if n == 1 && users == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients, %d users", n, users)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
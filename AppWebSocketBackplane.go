@@ -0,0 +1,583 @@
+package gocore
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/gobwas/ws"
+)
+
+const (
+	WS_BACKPLANE_GLOBAL = "global"
+	WS_BACKPLANE_CHANNEL = "channel"
+	WS_BACKPLANE_USER = "user"
+	WS_BACKPLANE_CLIENTS = "clients"
+	WS_BACKPLANE_KICK = "kick"
+)
+
+type WSBackplaneConfig struct {
+	// prefix of redis keys and pub/sub channel, nodes of same cluster must share it ( default: "ws" )
+	Prefix 						string
+	// identify this node, empty use hostname and pid
+	NodeID 						string
+	// how often node refresh its presence, node is considered dead after 3 missed heartbeats ( default: 10 seconds )
+	HeartbeatInterval 			time.Duration
+	// pending presence updates, updates are dropped when full and node is resynchronized on next heartbeat ( default: 1024 )
+	QueueSize 					int
+	// messages from other nodes waiting for local delivery, messages are dropped when full ( default: 1024 )
+	InboxSize 					int
+}
+
+var DefaultWSBackplaneConfig = WSBackplaneConfig{
+	Prefix: "ws",
+	HeartbeatInterval: 10 * time.Second,
+	QueueSize: 1024,
+	InboxSize: 1024,
+}
+
+// WSClusterMember is a connection on any node of the cluster
+type WSClusterMember struct {
+	Node 						string
+	UUID 						string
+	// empty for anonymous client
+	UserID 						string
+}
+
+// wsBackplaneMessage is published on the bus for every fan-out
+type wsBackplaneMessage struct {
+	ID 							string			`json:"id"`
+	Node 						string			`json:"node"`
+	Kind 						string			`json:"kind"`
+	// channel name or user id
+	Target 						string			`json:"target,omitempty"`
+	// client uuids
+	Targets 					[]string		`json:"targets,omitempty"`
+	Exclude 					[]string		`json:"exclude,omitempty"`
+	Data 						[]byte			`json:"data"`
+	// close code of kick
+	Code 						int				`json:"code,omitempty"`
+}
+
+// WSBackplane fan out broadcasts and targeted sends of AppWebSocket to every node through redis pub/sub,
+// and keep connections and channel membership of nodes in redis for cluster wide queries
+type WSBackplane struct {
+	server 						*AppWebSocket
+	redis 						*AppRedis
+	config 						WSBackplaneConfig
+	bus 						string
+
+	// ids of messages already delivered by this node
+	seenLock 					sync.Mutex
+	seen 						map[string]int64
+
+	// messages of other nodes, delivered by dispatcher so pub/sub workers never wait for local queues
+	inbox 						chan *wsBackplaneMessage
+	dropped 					uint64
+
+	ops 						chan func(pipe redis.Pipeliner)
+	dirty 						int32
+	stop 						chan struct{}
+	wg 							sync.WaitGroup
+	closeOnce 					sync.Once
+}
+
+// UseBackplane connect this websocket server to other nodes sharing the same redis.
+// channels must be added with the same names on every node
+func (this*AppWebSocket) UseBackplane(app *AppRedis, config WSBackplaneConfig) *WSBackplane {
+	if config.Prefix == "" {
+		config.Prefix = DefaultWSBackplaneConfig.Prefix
+	}
+	if config.NodeID == "" {
+		host, _ := os.Hostname()
+		config.NodeID = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), randomHex(4))
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DefaultWSBackplaneConfig.HeartbeatInterval
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultWSBackplaneConfig.QueueSize
+	}
+	if config.InboxSize <= 0 {
+		config.InboxSize = DefaultWSBackplaneConfig.InboxSize
+	}
+	backplane := &WSBackplane{
+		server: this,
+		redis: app,
+		config: config,
+		bus: config.Prefix + "|bus",
+		seen: make(map[string]int64),
+		inbox: make(chan *wsBackplaneMessage, config.InboxSize),
+		ops: make(chan func(pipe redis.Pipeliner), config.QueueSize),
+		stop: make(chan struct{}),
+	}
+	this.backplane = backplane
+	// connections opened before backplane
+	backplane.markDirty()
+	backplane.heartbeat()
+
+	app.SubscribeFunc(backplane.bus, backplane.onMessage)
+	backplane.wg.Add(3)
+	go backplane.dispatcher()
+	go backplane.writer()
+	go backplane.heartbeater()
+	if AppManagerInstance != nil {
+		AppManagerInstance.AddGracefulCallback("ws_backplane_" + config.NodeID, backplane.Close)
+	}
+	Log().Info().Str("node", config.NodeID).Msg("Websocket backplane started")
+	return backplane
+}
+
+func (this *WSBackplane) NodeID() string {
+	return this.config.NodeID
+}
+
+// DroppedMessages count messages of other nodes dropped because inbox was full
+func (this *WSBackplane) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&this.dropped)
+}
+
+// Close leave the cluster, connections of this node disappear from cluster queries
+func (this *WSBackplane) Close() {
+	this.closeOnce.Do(func() {
+		this.redis.Unsubscribe(this.bus)
+		close(this.stop)
+		this.wg.Wait()
+		pipe := this.redis.Client.TxPipeline()
+		pipe.ZRem(this.nodesKey(), this.config.NodeID)
+		pipe.Del(this.connKey(this.config.NodeID), this.usersKey(this.config.NodeID))
+		for _, name := range this.channelNames() {
+			pipe.Del(this.channelKey(name, this.config.NodeID))
+		}
+		if _, err := pipe.Exec(); err != nil {
+			Log().Error().Err(err).Str("node", this.config.NodeID).Msg("Error when remove websocket node")
+		}
+		Log().Info().Str("node", this.config.NodeID).Msg("Websocket backplane stopped")
+	})
+}
+
+//-------------------------------------------------------------
+// Fan-out
+//-------------------------------------------------------------
+
+func (this *WSBackplane) publish(kind string, target string, targets []string, exclude []string, data []byte) {
+	this.send(&wsBackplaneMessage{
+		Kind: kind,
+		Target: target,
+		Targets: targets,
+		Exclude: exclude,
+		Data: data,
+	})
+}
+
+func (this *WSBackplane) publishKick(userID string, code ws.StatusCode, reason string) {
+	this.send(&wsBackplaneMessage{
+		Kind: WS_BACKPLANE_KICK,
+		Target: userID,
+		Data: []byte(reason),
+		Code: int(code),
+	})
+}
+
+func (this *WSBackplane) send(msg *wsBackplaneMessage) {
+	kind := msg.Kind
+	msg.ID = randomHex(8)
+	msg.Node = this.config.NodeID
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		Log().Error().Err(err).Msg("Error when encode websocket backplane message")
+		return
+	}
+	if err = this.redis.Client.Publish(this.bus, payload).Err(); err != nil {
+		Log().Error().Err(err).Str("kind", kind).Msg("Error when publish websocket backplane message")
+	}
+}
+
+func (this *WSBackplane) onMessage(raw *redis.Message) {
+	var msg wsBackplaneMessage
+	if err := json.UnmarshalFromString(raw.Payload, &msg); err != nil {
+		Log().Error().Err(err).Msg("Error when decode websocket backplane message")
+		return
+	}
+	// delivered locally when published
+	if msg.Node == this.config.NodeID || !this.markSeen(msg.ID) {
+		return
+	}
+	select {
+	case this.inbox <- &msg:
+	default:
+		atomic.AddUint64(&this.dropped, 1)
+		Log().Warn().Str("node", msg.Node).Str("kind", msg.Kind).Msg("Websocket backplane inbox full, message dropped")
+	}
+}
+
+// dispatcher deliver messages of other nodes in order they were received
+func (this *WSBackplane) dispatcher() {
+	defer this.wg.Done()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case msg := <-this.inbox:
+			this.deliver(msg)
+		}
+	}
+}
+
+func (this *WSBackplane) deliver(msg *wsBackplaneMessage) {
+	server := this.server
+	if msg.Kind == WS_BACKPLANE_KICK {
+		server.kick(msg.Target, ws.StatusCode(msg.Code), string(msg.Data))
+		return
+	}
+	frame := wsTextFrame(msg.Data)
+	switch msg.Kind {
+	case WS_BACKPLANE_GLOBAL:
+		server.globaOut <- wsBroadcast{frame: frame, exclude: wsExcludeSet(msg.Exclude)}
+	case WS_BACKPLANE_CHANNEL:
+		server.channelLock.RLock()
+		channel, has := server.nameChannels[msg.Target]
+		server.channelLock.RUnlock()
+		if has {
+			channel.push(wsBroadcast{frame: frame, exclude: wsExcludeSet(msg.Exclude)})
+		}
+	case WS_BACKPLANE_USER:
+		server.deliver(server.ClientsOfUser(msg.Target), nil, frame)
+	case WS_BACKPLANE_CLIENTS:
+		clients, _ := server.localClients(msg.Targets)
+		if len(clients) > 0 {
+			server.deliver(clients, nil, frame)
+		}
+	}
+}
+
+// markSeen return false when message was already delivered
+func (this *WSBackplane) markSeen(id string) bool {
+	this.seenLock.Lock()
+	defer this.seenLock.Unlock()
+	if _, has := this.seen[id]; has {
+		return false
+	}
+	this.seen[id] = time.Now().Unix()
+	return true
+}
+
+//-------------------------------------------------------------
+// Presence of node
+//-------------------------------------------------------------
+
+func (this *WSBackplane) nodesKey() string {
+	return this.config.Prefix + "|nodes"
+}
+
+// keys of a node share the node hash tag, so they can be deleted together in cluster
+func (this *WSBackplane) connKey(node string) string {
+	return this.config.Prefix + "|conn|{" + node + "}"
+}
+
+func (this *WSBackplane) usersKey(node string) string {
+	return this.config.Prefix + "|users|{" + node + "}"
+}
+
+func (this *WSBackplane) channelKey(name string, node string) string {
+	return this.config.Prefix + "|chan|" + name + "|{" + node + "}"
+}
+
+func (this *WSBackplane) ttl() time.Duration {
+	return 3 * this.config.HeartbeatInterval
+}
+
+// aliveSince return min heartbeat score of alive nodes
+func (this *WSBackplane) aliveSince(now time.Time) string {
+	return strconv.FormatInt(now.Add(-this.ttl()).UnixNano() / int64(time.Millisecond), 10)
+}
+
+func (this *WSBackplane) channelNames() []string {
+	var names []string
+	this.server.RangeChannel(func(channel *WSChannel) {
+		names = append(names, channel.name)
+	})
+	return names
+}
+
+// queue presence update, when queue is full node is resynchronized on next heartbeat
+func (this *WSBackplane) queue(op func(pipe redis.Pipeliner)) {
+	select {
+	case this.ops <- op:
+	default:
+		this.markDirty()
+	}
+}
+
+func (this *WSBackplane) markDirty() {
+	atomic.StoreInt32(&this.dirty, 1)
+}
+
+func (this *WSBackplane) trackConnect(client *WSClient) {
+	uuid, userID := client.uuid, client.UserID()
+	this.queue(func(pipe redis.Pipeliner) {
+		pipe.HSet(this.connKey(this.config.NodeID), uuid, userID)
+	})
+}
+
+// trackUser save number of connections of user on this node
+func (this *WSBackplane) trackUser(userID string, count int) {
+	if userID == "" {
+		return
+	}
+	this.queue(func(pipe redis.Pipeliner) {
+		if count > 0 {
+			pipe.HSet(this.usersKey(this.config.NodeID), userID, count)
+		} else {
+			pipe.HDel(this.usersKey(this.config.NodeID), userID)
+		}
+	})
+}
+
+func (this *WSBackplane) trackDisconnect(uuid string) {
+	this.queue(func(pipe redis.Pipeliner) {
+		pipe.HDel(this.connKey(this.config.NodeID), uuid)
+	})
+}
+
+func (this *WSBackplane) trackJoin(channel *WSChannel, client *WSClient) {
+	key, uuid, userID := this.channelKey(channel.name, this.config.NodeID), client.uuid, client.UserID()
+	this.queue(func(pipe redis.Pipeliner) {
+		pipe.HSet(key, uuid, userID)
+		pipe.Expire(key, this.ttl())
+	})
+}
+
+func (this *WSBackplane) trackLeave(channel *WSChannel, uuid string) {
+	key := this.channelKey(channel.name, this.config.NodeID)
+	this.queue(func(pipe redis.Pipeliner) {
+		pipe.HDel(key, uuid)
+	})
+}
+
+func (this *WSBackplane) trackClose(channel *WSChannel) {
+	key := this.channelKey(channel.name, this.config.NodeID)
+	this.queue(func(pipe redis.Pipeliner) {
+		pipe.Del(key)
+	})
+}
+
+// writer apply presence updates in batches
+func (this *WSBackplane) writer() {
+	defer this.wg.Done()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case op := <-this.ops:
+			pipe := this.redis.Client.Pipeline()
+			op(pipe)
+			for more := true; more; {
+				select {
+				case op = <-this.ops:
+					op(pipe)
+				default:
+					more = false
+				}
+			}
+			if _, err := pipe.Exec(); err != nil {
+				Log().Error().Err(err).Str("node", this.config.NodeID).Msg("Error when update websocket presence")
+				this.markDirty()
+			}
+			_ = pipe.Close()
+		}
+	}
+}
+
+func (this *WSBackplane) heartbeater() {
+	defer this.wg.Done()
+	ticker := time.NewTicker(this.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+			this.heartbeat()
+			this.pruneSeen()
+		}
+	}
+}
+
+// heartbeat refresh expiry of node keys, rewrite them when updates were lost
+func (this *WSBackplane) heartbeat() {
+	node := this.config.NodeID
+	now := time.Now()
+	channels := this.channelNames()
+	pipe := this.redis.Client.TxPipeline()
+	defer pipe.Close()
+	if atomic.CompareAndSwapInt32(&this.dirty, 1, 0) {
+		this.resync(pipe, channels)
+	}
+	// score is unix milliseconds of last heartbeat
+	pipe.ZAdd(this.nodesKey(), &redis.Z{Score: float64(now.UnixNano() / int64(time.Millisecond)), Member: node})
+	pipe.ZRemRangeByScore(this.nodesKey(), "-inf", "(" + this.aliveSince(now))
+	pipe.Expire(this.connKey(node), this.ttl())
+	pipe.Expire(this.usersKey(node), this.ttl())
+	for _, name := range channels {
+		pipe.Expire(this.channelKey(name, node), this.ttl())
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		Log().Error().Err(err).Str("node", node).Msg("Error when send websocket node heartbeat")
+		this.markDirty()
+	}
+}
+
+func (this *WSBackplane) resync(pipe redis.Pipeliner, channels []string) {
+	node := this.config.NodeID
+	server := this.server
+	conns := make(map[string]interface{})
+	users := make(map[string]interface{})
+	server.userLock.RLock()
+	for uuid, client := range server.users {
+		conns[uuid] = client.UserID()
+	}
+	for userID, clients := range server.userClients {
+		users[userID] = len(clients)
+	}
+	server.userLock.RUnlock()
+
+	pipe.Del(this.connKey(node), this.usersKey(node))
+	if len(conns) > 0 {
+		pipe.HMSet(this.connKey(node), conns)
+	}
+	if len(users) > 0 {
+		pipe.HMSet(this.usersKey(node), users)
+	}
+	server.RangeChannel(func(channel *WSChannel) {
+		members := make(map[string]interface{})
+		for _, client := range channel.Clients() {
+			members[client.uuid] = client.UserID()
+		}
+		pipe.Del(this.channelKey(channel.name, node))
+		if len(members) > 0 {
+			pipe.HMSet(this.channelKey(channel.name, node), members)
+		}
+	})
+}
+
+func (this *WSBackplane) pruneSeen() {
+	expired := time.Now().Add(-this.ttl()).Unix()
+	this.seenLock.Lock()
+	for id, at := range this.seen {
+		if at < expired {
+			delete(this.seen, id)
+		}
+	}
+	this.seenLock.Unlock()
+}
+
+//-------------------------------------------------------------
+// Cluster queries
+//-------------------------------------------------------------
+
+// Nodes alive in the cluster
+func (this *WSBackplane) Nodes() ([]string, error) {
+	min := this.aliveSince(time.Now())
+	return this.redis.Client.ZRangeByScore(this.nodesKey(), &redis.ZRangeBy{Min: min, Max: "+inf"}).Result()
+}
+
+// Connections count of all nodes
+func (this *WSBackplane) Connections() (int64, error) {
+	nodes, err := this.Nodes()
+	if err != nil {
+		return 0, err
+	}
+	pipe := this.redis.Client.Pipeline()
+	defer pipe.Close()
+	counts := make([]*redis.IntCmd, len(nodes))
+	for i, node := range nodes {
+		counts[i] = pipe.HLen(this.connKey(node))
+	}
+	if _, err = pipe.Exec(); err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, count := range counts {
+		total += count.Val()
+	}
+	return total, nil
+}
+
+// UserConnections count connections of user on all nodes
+func (this *WSBackplane) UserConnections(userID string) (int64, error) {
+	nodes, err := this.Nodes()
+	if err != nil {
+		return 0, err
+	}
+	pipe := this.redis.Client.Pipeline()
+	defer pipe.Close()
+	counts := make([]*redis.StringCmd, len(nodes))
+	for i, node := range nodes {
+		counts[i] = pipe.HGet(this.usersKey(node), userID)
+	}
+	if _, err = pipe.Exec(); err != nil && err != redis.Nil {
+		return 0, err
+	}
+	var total int64
+	for _, count := range counts {
+		n, _ := count.Int64()
+		total += n
+	}
+	return total, nil
+}
+
+func (this *WSBackplane) IsUserOnline(userID string) (bool, error) {
+	count, err := this.UserConnections(userID)
+	return count > 0, err
+}
+
+// ChannelMembers return connections of channel on all nodes
+func (this *WSBackplane) ChannelMembers(name string) ([]WSClusterMember, error) {
+	nodes, err := this.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	pipe := this.redis.Client.Pipeline()
+	defer pipe.Close()
+	members := make([]*redis.StringStringMapCmd, len(nodes))
+	for i, node := range nodes {
+		members[i] = pipe.HGetAll(this.channelKey(name, node))
+	}
+	if _, err = pipe.Exec(); err != nil {
+		return nil, err
+	}
+	var result []WSClusterMember
+	for i, node := range nodes {
+		for uuid, userID := range members[i].Val() {
+			result = append(result, WSClusterMember{Node: node, UUID: uuid, UserID: userID})
+		}
+	}
+	return result, nil
+}
+
+// ChannelCount count connections of channel on all nodes
+func (this *WSBackplane) ChannelCount(name string) (int64, error) {
+	nodes, err := this.Nodes()
+	if err != nil {
+		return 0, err
+	}
+	pipe := this.redis.Client.Pipeline()
+	defer pipe.Close()
+	counts := make([]*redis.IntCmd, len(nodes))
+	for i, node := range nodes {
+		counts[i] = pipe.HLen(this.channelKey(name, node))
+	}
+	if _, err = pipe.Exec(); err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, count := range counts {
+		total += count.Val()
+	}
+	return total, nil
+}
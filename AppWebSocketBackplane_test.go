@@ -0,0 +1,169 @@
+package gocore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+)
+
+// testWSNode return a websocket server joined to the backplane of mr
+func testWSNode(t *testing.T, mr *miniredis.Miniredis, node string, channels ...string) (*AppWebSocket, *WSBackplane) {
+	app := NewRedisApp(mr.Addr(), "")
+	server := testWSServer(channels...)
+	backplane := server.UseBackplane(app, WSBackplaneConfig{NodeID: node})
+	if !app.WaitSubscribed(backplane.bus, time.Second) {
+		t.Fatalf("node %s not subscribed", node)
+	}
+	return server, backplane
+}
+
+func testWSBackplaneMessage(msg wsBackplaneMessage) *redis.Message {
+	payload, _ := json.MarshalToString(msg)
+	return &redis.Message{Payload: payload}
+}
+
+// waitWSCount poll count until it is want
+func waitWSCount(t *testing.T, name string, count func() (int64, error), want int64) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n, err := count()
+		if err == nil && n == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s = %d %v, want %d", name, n, err, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWSBackplaneFanOut(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	serverA, backA := testWSNode(t, mr, "a", "room")
+	defer backA.redis.Close()
+	defer backA.Close()
+	serverB, backB := testWSNode(t, mr, "b", "room")
+	defer backB.redis.Close()
+	defer backB.Close()
+	_, peerA := testWSConnect(serverA, nil)
+	defer peerA.Close()
+	clientB, peerB := testWSConnect(serverB, &UserAuthData{UserID: "u1"})
+	defer peerB.Close()
+	serverB.ClientJoinChannel(clientB, "room")
+
+	serverA.BroadcastGlobal([]byte("global"))
+	if got := testWSRead(peerB, time.Second); got != "global" {
+		t.Errorf("other node got %q", got)
+	}
+	// own message coming back from bus is not delivered twice
+	if got := testWSRead(peerA, time.Second); got != "global" {
+		t.Errorf("local node got %q", got)
+	}
+	if got := testWSRead(peerA, 100 * time.Millisecond); got != "" {
+		t.Errorf("local node got %q twice", got)
+	}
+
+	serverA.BroadcastInChannel([]byte("room"), "room")
+	if got := testWSRead(peerB, time.Second); got != "room" {
+		t.Errorf("channel member got %q", got)
+	}
+	if result := serverA.SendToUser("u1", []byte("user")); !result.Forwarded || len(result.Delivered) != 0 {
+		t.Errorf("SendToUser result %+v", result)
+	}
+	if got := testWSRead(peerB, time.Second); got != "user" {
+		t.Errorf("user got %q", got)
+	}
+	serverA.SendToClient(clientB.GetUUID(), []byte("direct"))
+	if got := testWSRead(peerB, time.Second); got != "direct" {
+		t.Errorf("client got %q", got)
+	}
+
+	waitWSCount(t, "connections", backA.Connections, 2)
+	waitWSCount(t, "user connections", func() (int64, error) { return backA.UserConnections("u1") }, 1)
+	waitWSCount(t, "channel count", func() (int64, error) { return backA.ChannelCount("room") }, 1)
+}
+
+func TestWSBackplaneDedup(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	server, backplane := testWSNode(t, mr, "b")
+	defer backplane.redis.Close()
+	defer backplane.Close()
+	_, peer := testWSConnect(server, &UserAuthData{UserID: "u1"})
+	defer peer.Close()
+
+	msg := wsBackplaneMessage{ID: "m1", Node: "a", Kind: WS_BACKPLANE_USER, Target: "u1", Data: []byte("once")}
+	backplane.onMessage(testWSBackplaneMessage(msg))
+	backplane.onMessage(testWSBackplaneMessage(msg))
+	msg.ID, msg.Node, msg.Data = "m2", "b", []byte("own")
+	backplane.onMessage(testWSBackplaneMessage(msg))
+	if got := testWSRead(peer, time.Second); got != "once" {
+		t.Errorf("got %q", got)
+	}
+	if got := testWSRead(peer, 100 * time.Millisecond); got != "" {
+		t.Errorf("duplicate or own message delivered: %q", got)
+	}
+}
+
+func TestWSBackplaneResync(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	server, backplane := testWSNode(t, mr, "a", "room")
+	defer backplane.redis.Close()
+	defer backplane.Close()
+	client, peer := testWSConnect(server, &UserAuthData{UserID: "u1"})
+	defer peer.Close()
+	server.ClientJoinChannel(client, "room")
+	waitWSCount(t, "channel count", func() (int64, error) { return backplane.ChannelCount("room") }, 1)
+
+	// redis lost presence of node, next heartbeat after a failed update rewrite it
+	mr.FlushAll()
+	backplane.markDirty()
+	backplane.heartbeat()
+	if nodes, err := backplane.Nodes(); err != nil || len(nodes) != 1 || nodes[0] != "a" {
+		t.Errorf("nodes %v %v", nodes, err)
+	}
+	waitWSCount(t, "connections", backplane.Connections, 1)
+	waitWSCount(t, "user connections", func() (int64, error) { return backplane.UserConnections("u1") }, 1)
+	members, err := backplane.ChannelMembers("room")
+	if err != nil || len(members) != 1 || members[0] != (WSClusterMember{Node: "a", UUID: client.GetUUID(), UserID: "u1"}) {
+		t.Errorf("members %+v %v", members, err)
+	}
+}
+
+func TestWSBackplaneInboxFull(t *testing.T) {
+	// no dispatcher, inbox stay full
+	backplane := &WSBackplane{
+		server: testWSServer(),
+		config: WSBackplaneConfig{NodeID: "b"},
+		seen: make(map[string]int64),
+		inbox: make(chan *wsBackplaneMessage, 1),
+	}
+	done := make(chan struct{})
+	go func() {
+		for _, id := range []string{"m1", "m2", "m3"} {
+			backplane.onMessage(testWSBackplaneMessage(wsBackplaneMessage{ID: id, Node: "a", Kind: WS_BACKPLANE_GLOBAL}))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("onMessage blocked on full inbox")
+	}
+	if dropped := backplane.DroppedMessages(); dropped != 2 {
+		t.Errorf("dropped %d", dropped)
+	}
+}
@@ -0,0 +1,163 @@
+package gocore
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// WSKeepAliveConfig detect dead connections of AppWebSocket
+type WSKeepAliveConfig struct {
+	// ping clients after interval without ping, 0 disable pings ( default: 30 seconds )
+	PingInterval 				time.Duration
+	// close client which do not answer ping in time ( default: 10 seconds )
+	PongTimeout 				time.Duration
+	// close client which do not send any message during timeout, pongs do not count, 0 disable ( default: 0 )
+	IdleTimeout 				time.Duration
+	// deadline of each read and write on connection ( default: WS_DEADLINE_DURATION_READ / WS_DEADLINE_DURATION_WRITE )
+	ReadDeadline 				time.Duration
+	WriteDeadline 				time.Duration
+	// wait client answer to close frame before dropping connection ( default: 1 second )
+	CloseTimeout 				time.Duration
+}
+
+var DefaultWSKeepAliveConfig = WSKeepAliveConfig{
+	PingInterval: 30 * time.Second,
+	PongTimeout: 10 * time.Second,
+	ReadDeadline: WS_DEADLINE_DURATION_READ,
+	WriteDeadline: WS_DEADLINE_DURATION_WRITE,
+	CloseTimeout: time.Second,
+}
+
+// SetKeepAlive change pings, timeouts and deadlines of all clients.
+// negative PingInterval disable pings
+func (this*AppWebSocket) SetKeepAlive(config WSKeepAliveConfig) {
+	if config.PingInterval < 0 {
+		config.PingInterval = 0
+	} else if config.PingInterval == 0 {
+		config.PingInterval = DefaultWSKeepAliveConfig.PingInterval
+	}
+	if config.PongTimeout <= 0 {
+		config.PongTimeout = DefaultWSKeepAliveConfig.PongTimeout
+	}
+	if config.IdleTimeout < 0 {
+		config.IdleTimeout = 0
+	}
+	if config.ReadDeadline <= 0 {
+		config.ReadDeadline = DefaultWSKeepAliveConfig.ReadDeadline
+	}
+	if config.WriteDeadline <= 0 {
+		config.WriteDeadline = DefaultWSKeepAliveConfig.WriteDeadline
+	}
+	if config.CloseTimeout <= 0 {
+		config.CloseTimeout = DefaultWSKeepAliveConfig.CloseTimeout
+	}
+	this.keepAliveLock.Lock()
+	this.keepAlive = config
+	this.keepAliveLock.Unlock()
+}
+
+func (this*AppWebSocket) keepAliveConfig() WSKeepAliveConfig {
+	this.keepAliveLock.RLock()
+	defer this.keepAliveLock.RUnlock()
+	return this.keepAlive
+}
+
+// tick is half of shortest timeout so clients are checked in time
+func (config WSKeepAliveConfig) tick() time.Duration {
+	tick := time.Second
+	for _, timeout := range []time.Duration{config.PingInterval, config.PongTimeout, config.IdleTimeout} {
+		if timeout > 0 && timeout / 2 < tick {
+			tick = timeout / 2
+		}
+	}
+	if tick < 10 * time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	return tick
+}
+
+func (this*AppWebSocket) keepAliveLoop() {
+	for {
+		config := this.keepAliveConfig()
+		time.Sleep(config.tick())
+		this.checkKeepAlive(config)
+	}
+}
+
+func (this*AppWebSocket) checkKeepAlive(config WSKeepAliveConfig) {
+	if config.PingInterval <= 0 && config.IdleTimeout <= 0 {
+		return
+	}
+	this.userLock.RLock()
+	clients := make([]*WSClient, 0, len(this.users))
+	for _, client := range this.users {
+		clients = append(clients, client)
+	}
+	this.userLock.RUnlock()
+
+	now := time.Now().UnixNano()
+	for _, client := range clients {
+		pingAt := atomic.LoadInt64(&client.pingAt)
+		waitingPong := pingAt > atomic.LoadInt64(&client.pongAt)
+		switch {
+		case client.IsClosing():
+		case config.PingInterval > 0 && waitingPong && now - pingAt > int64(config.PongTimeout):
+			_ = this.closeClient(client, WSCloseReason{Cause: WS_CLOSE_PONG_TIMEOUT, Code: ws.StatusGoingAway, Reason: "pong timeout", Initiator: WS_CLOSE_BY_SERVER})
+		case config.IdleTimeout > 0 && now - atomic.LoadInt64(&client.messageAt) > int64(config.IdleTimeout):
+			_ = this.closeClient(client, WSCloseReason{Cause: WS_CLOSE_IDLE_TIMEOUT, Code: ws.StatusGoingAway, Reason: "idle timeout", Initiator: WS_CLOSE_BY_SERVER})
+		case config.PingInterval > 0 && !waitingPong && now - pingAt >= int64(config.PingInterval):
+			atomic.StoreInt64(&client.pingAt, now)
+			c := client
+			this.pool.Schedule(func() {
+				_ = c.internalWrite(ws.CompiledPing)
+			})
+		}
+	}
+}
+
+// closeClient start closing handshake, client is removed when it answer or after close timeout
+func (this*AppWebSocket) closeClient(client *WSClient, reason WSCloseReason) error {
+	if !client.markClosing(reason) {
+		return nil
+	}
+	return this.sendClose(client, reason)
+}
+
+// markClosing return false when client is already closing
+func (c *WSClient) markClosing(reason WSCloseReason) bool {
+	c.closeLock.Lock()
+	defer c.closeLock.Unlock()
+	if c.closing != nil {
+		return false
+	}
+	c.closing = &reason
+	return true
+}
+
+// sendClose write close frame of client marked as closing
+func (this*AppWebSocket) sendClose(client *WSClient, reason WSCloseReason) error {
+	frame, err := ws.CompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(reason.Code, reason.Reason)))
+	if err == nil {
+		err = client.internalWrite(frame)
+	}
+	if err != nil {
+		// client is gone, drop now
+		this.dropClient(client, reason)
+		return err
+	}
+	time.AfterFunc(this.keepAliveConfig().CloseTimeout, func() {
+		this.dropClient(client, reason)
+	})
+	return nil
+}
+
+// dropClient close connection without handshake
+func (this*AppWebSocket) dropClient(client *WSClient, reason WSCloseReason) {
+	if client.release != nil {
+		client.release()
+	}
+	_ = client.conn.Close()
+	this.remove(client.uuid, reason)
+}
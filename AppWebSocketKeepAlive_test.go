@@ -0,0 +1,180 @@
+package gocore
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+func TestWSKeepAlivePong(t *testing.T) {
+	server := testWSServer()
+	closed := make(chan WSCloseReason, 2)
+	server.OnClose = func(uuid string, reason WSCloseReason) { closed <- reason }
+	server.SetKeepAlive(WSKeepAliveConfig{PingInterval: 200 * time.Millisecond, PongTimeout: 50 * time.Millisecond, CloseTimeout: 50 * time.Millisecond})
+	config := server.keepAliveConfig()
+	client, peer := testWSConnect(server, nil)
+	defer peer.Close()
+
+	// ping is sent after interval
+	past := time.Now().Add(-300 * time.Millisecond).UnixNano()
+	atomic.StoreInt64(&client.pingAt, past)
+	atomic.StoreInt64(&client.pongAt, past)
+	server.checkKeepAlive(config)
+	if frame, ok := testWSReadFrame(peer, time.Second); !ok || frame.Header.OpCode != ws.OpPing {
+		t.Fatalf("no ping: %v %v", frame.Header.OpCode, ok)
+	}
+	testWSWrite(peer, ws.NewPongFrame(nil))
+	if data, err := client.Read(); err != nil || data != nil {
+		t.Fatalf("read pong: %q %v", data, err)
+	}
+	// pong timeout elapsed, ping interval not
+	time.Sleep(60 * time.Millisecond)
+	server.checkKeepAlive(config)
+	if client.IsClosing() {
+		t.Fatalf("client answering ping closed")
+	}
+
+	// next ping is not answered
+	atomic.StoreInt64(&client.pingAt, time.Now().Add(-100 * time.Millisecond).UnixNano())
+	atomic.StoreInt64(&client.pongAt, time.Now().Add(-200 * time.Millisecond).UnixNano())
+	// close frame is written by check, pipe has no buffer
+	go server.checkKeepAlive(config)
+	frame, ok := testWSReadFrame(peer, time.Second)
+	if !ok || frame.Header.OpCode != ws.OpClose {
+		t.Fatalf("no close frame: %v %v", frame.Header.OpCode, ok)
+	}
+	if code, reason := ws.ParseCloseFrameData(frame.Payload); code != ws.StatusGoingAway || reason != "pong timeout" {
+		t.Errorf("close frame %d %q", code, reason)
+	}
+	select {
+	case reason := <-closed:
+		if reason.Cause != WS_CLOSE_PONG_TIMEOUT || reason.Initiator != WS_CLOSE_BY_SERVER {
+			t.Errorf("close reason %+v", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client not dropped after close timeout")
+	}
+}
+
+func TestWSKeepAliveIdle(t *testing.T) {
+	server := testWSServer()
+	closed := make(chan WSCloseReason, 2)
+	server.OnClose = func(uuid string, reason WSCloseReason) { closed <- reason }
+	server.SetKeepAlive(WSKeepAliveConfig{PingInterval: -1, IdleTimeout: 50 * time.Millisecond, CloseTimeout: 50 * time.Millisecond})
+	config := server.keepAliveConfig()
+	idle, idlePeer := testWSConnect(server, nil)
+	defer idlePeer.Close()
+	active, activePeer := testWSConnect(server, nil)
+	defer activePeer.Close()
+
+	time.Sleep(60 * time.Millisecond)
+	testWSWrite(activePeer, ws.NewTextFrame([]byte("hi")))
+	if data, err := active.Read(); err != nil || string(data) != "hi" {
+		t.Fatalf("read message: %q %v", data, err)
+	}
+	go server.checkKeepAlive(config)
+	frame, ok := testWSReadFrame(idlePeer, time.Second)
+	if code, reason := ws.ParseCloseFrameData(frame.Payload); !ok || code != ws.StatusGoingAway || reason != "idle timeout" {
+		t.Errorf("close frame %d %q", code, reason)
+	}
+	if active.IsClosing() || !idle.IsClosing() {
+		t.Fatalf("active closing %v, idle closing %v", active.IsClosing(), idle.IsClosing())
+	}
+	select {
+	case reason := <-closed:
+		if reason.Cause != WS_CLOSE_IDLE_TIMEOUT {
+			t.Errorf("close reason %+v", reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("idle client not dropped")
+	}
+	if server.GetClient(active.GetUUID()) == nil {
+		t.Errorf("active client removed")
+	}
+}
+
+func TestWSCloseReasons(t *testing.T) {
+	server := testWSServer()
+	closed := make(chan WSCloseReason, 4)
+	server.OnClose = func(uuid string, reason WSCloseReason) { closed <- reason }
+	server.SetKeepAlive(WSKeepAliveConfig{CloseTimeout: 50 * time.Millisecond})
+	next := func() WSCloseReason {
+		select {
+		case reason := <-closed:
+			return reason
+		case <-time.After(time.Second):
+			t.Fatal("client not removed")
+		}
+		return WSCloseReason{}
+	}
+	readClose := func(peer net.Conn) (ws.StatusCode, string) {
+		frame, ok := testWSReadFrame(peer, time.Second)
+		if !ok || frame.Header.OpCode != ws.OpClose {
+			t.Fatalf("no close frame: %v %v", frame.Header.OpCode, ok)
+		}
+		return ws.ParseCloseFrameData(frame.Payload)
+	}
+
+	// closed by server, client never answer
+	client, peer := testWSConnect(server, nil)
+	go client.Close(4001, "bye")
+	if code, reason := readClose(peer); code != 4001 || reason != "bye" {
+		t.Errorf("close frame %d %q", code, reason)
+	}
+	if reason := next(); reason.Cause != WS_CLOSE_SERVER || reason.Code != 4001 || reason.Reason != "bye" || reason.Initiator != WS_CLOSE_BY_SERVER {
+		t.Errorf("server close %+v", reason)
+	}
+	peer.Close()
+
+	// closed by client, server answer with same code
+	client, peer = testWSConnect(server, nil)
+	testWSWrite(peer, ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "done")))
+	answered := make(chan ws.StatusCode, 1)
+	go func() {
+		frame, _ := testWSReadFrame(peer, time.Second)
+		code, _ := ws.ParseCloseFrameData(frame.Payload)
+		answered <- code
+	}()
+	_, err := client.Read()
+	reason := client.closeReason(err)
+	if reason.Cause != WS_CLOSE_DISCONNECTED || reason.Code != ws.StatusNormalClosure || reason.Reason != "done" || reason.Initiator != WS_CLOSE_BY_CLIENT {
+		t.Errorf("client close %+v", reason)
+	}
+	if code := <-answered; code != ws.StatusNormalClosure {
+		t.Errorf("answer code %d", code)
+	}
+	server.remove(client.GetUUID(), reason)
+	next()
+
+	// dropped without close frame
+	client, peer = testWSConnect(server, nil)
+	peer.Close()
+	_, err = client.Read()
+	if reason = client.closeReason(err); reason.Code != ws.StatusAbnormalClosure || reason.Err == nil || reason.Initiator != WS_CLOSE_BY_CLIENT {
+		t.Errorf("dropped %+v", reason)
+	}
+	server.remove(client.GetUUID(), reason)
+	next()
+
+	// kicked user
+	_, peer = testWSConnect(server, &UserAuthData{UserID: "u1"})
+	defer peer.Close()
+	go server.Kick("u1", 4003, "banned")
+	if code, text := readClose(peer); code != 4003 || text != "banned" {
+		t.Errorf("kick frame %d %q", code, text)
+	}
+	if reason = next(); reason.Cause != WS_CLOSE_KICKED || reason.Code != 4003 || reason.Reason != "banned" {
+		t.Errorf("kick %+v", reason)
+	}
+
+	// removed without handshake
+	client, peer = testWSConnect(server, nil)
+	defer peer.Close()
+	server.Remove(client.GetUUID())
+	if reason = next(); reason.Cause != WS_CLOSE_REMOVED || reason.Code != ws.StatusNoStatusRcvd {
+		t.Errorf("remove %+v", reason)
+	}
+}
@@ -0,0 +1,539 @@
+package gocore
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+const (
+	PRESENCE_JOIN = "join"
+	PRESENCE_LEAVE = "leave"
+	PRESENCE_UPDATE = "update"
+)
+
+var ErrPresenceNotMember = errors.New("presence: client is not member of channel")
+
+// PresenceMember is a connection present in a channel
+type PresenceMember struct {
+	UUID 						string						`json:"uuid"`
+	// empty for anonymous client
+	UserID 						string						`json:"user_id,omitempty"`
+	Meta 						map[string]interface{}		`json:"meta,omitempty"`
+	// unix milliseconds
+	JoinedAt 					int64						`json:"joined_at"`
+	SeenAt 						int64						`json:"seen_at"`
+}
+
+// PresenceEvent is broadcast to channel when members join, leave or update their metadata
+type PresenceEvent struct {
+	Type 						string						`json:"type"`
+	Event 						string						`json:"event"`
+	Channel 					string						`json:"channel"`
+	Member 						PresenceMember				`json:"member"`
+}
+
+// PresenceStore keep members of channels, Redis store share them between nodes
+type PresenceStore interface {
+	// Set add or replace member
+	Set(channel string, member PresenceMember) error
+	// Touch refresh seen time, false when member is not present
+	Touch(channel string, uuid string, seenAt int64) (bool, error)
+	// Remove member, false when member was not present
+	Remove(channel string, uuid string) (bool, error)
+	Members(channel string) ([]PresenceMember, error)
+	// Expire remove members not seen since before and return them
+	Expire(channel string, before int64) ([]PresenceMember, error)
+}
+
+type PresenceConfig struct {
+	// Optional. Default memory store, use RedisPresenceStore with backplane
+	Store 						PresenceStore
+	// members not seen during timeout are removed, any frame received from client count as heartbeat ( default: 60 seconds )
+	Timeout 					time.Duration
+	// ( default: Timeout / 3 )
+	SweepInterval 				time.Duration
+	// type field of events sent to clients ( default: "presence" )
+	EventType 					string
+	// do not broadcast events to channels
+	DisableEvents 				bool
+	// Optional. metadata of member when client join a channel
+	Meta 						func(client *WSClient, channel *WSChannel) map[string]interface{}
+	// Optional. called for every event, also when events are not broadcast
+	OnEvent 					func(event PresenceEvent)
+}
+
+var DefaultPresenceConfig = PresenceConfig{
+	Timeout: 60 * time.Second,
+	EventType: "presence",
+}
+
+// WSPresence track members of channels of AppWebSocket
+type WSPresence struct {
+	server 						*AppWebSocket
+	config 						PresenceConfig
+	store 						PresenceStore
+
+	// members connected to this node by channel and uuid
+	lock 						sync.Mutex
+	local 						map[string]map[string]*PresenceMember
+
+	stop 						chan struct{}
+	closeOnce 					sync.Once
+}
+
+// UsePresence track presence of clients in channels
+func (this*AppWebSocket) UsePresence(config PresenceConfig) *WSPresence {
+	if config.Store == nil {
+		config.Store = NewMemoryPresenceStore()
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultPresenceConfig.Timeout
+	}
+	if config.SweepInterval <= 0 {
+		config.SweepInterval = config.Timeout / 3
+	}
+	if config.EventType == "" {
+		config.EventType = DefaultPresenceConfig.EventType
+	}
+	presence := &WSPresence{
+		server: this,
+		config: config,
+		store: config.Store,
+		local: make(map[string]map[string]*PresenceMember),
+		stop: make(chan struct{}),
+	}
+	this.presence = presence
+	// clients which joined before presence
+	this.RangeChannel(func(channel *WSChannel) {
+		for _, client := range channel.Clients() {
+			presence.join(channel, client)
+		}
+	})
+	go presence.sweeper()
+	return presence
+}
+
+// Presence return presence tracker, nil when not used
+func (this*AppWebSocket) Presence() *WSPresence {
+	return this.presence
+}
+
+func (this *WSPresence) Close() {
+	this.closeOnce.Do(func() {
+		close(this.stop)
+	})
+}
+
+//-------------------------------------------------------------
+// Query API
+//-------------------------------------------------------------
+
+// Members present in channel, on all nodes with a shared store
+func (this *WSPresence) Members(channel string) ([]PresenceMember, error) {
+	return this.store.Members(channel)
+}
+
+func (this *WSPresence) Count(channel string) (int, error) {
+	members, err := this.store.Members(channel)
+	return len(members), err
+}
+
+// IsPresent check a user has at least one connection in channel
+func (this *WSPresence) IsPresent(channel string, userID string) (bool, error) {
+	members, err := this.store.Members(channel)
+	if err != nil {
+		return false, err
+	}
+	for _, member := range members {
+		if member.UserID == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Update replace metadata of client in channel and broadcast update event
+func (this *WSPresence) Update(client *WSClient, channel string, meta map[string]interface{}) error {
+	this.lock.Lock()
+	local := this.local[channel][client.uuid]
+	if local == nil {
+		this.lock.Unlock()
+		return ErrPresenceNotMember
+	}
+	local.Meta = meta
+	local.SeenAt = presenceNow()
+	member := *local
+	this.lock.Unlock()
+	if err := this.store.Set(channel, member); err != nil {
+		Log().Error().Err(err).Str("channel", channel).Str("uuid", client.uuid).Msg("Error when update presence")
+		return err
+	}
+	this.emit(PRESENCE_UPDATE, channel, member)
+	return nil
+}
+
+// Heartbeat mark client as alive in all its channels, frames received from client already do it
+func (this *WSPresence) Heartbeat(client *WSClient) {
+	this.seen(client, true)
+}
+
+//-------------------------------------------------------------
+// Tracking
+//-------------------------------------------------------------
+
+func presenceNow() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func (this *WSPresence) join(channel *WSChannel, client *WSClient) {
+	now := presenceNow()
+	member := PresenceMember{
+		UUID: client.uuid,
+		UserID: client.UserID(),
+		JoinedAt: now,
+		SeenAt: now,
+	}
+	if this.config.Meta != nil {
+		member.Meta = this.config.Meta(client, channel)
+	}
+	this.lock.Lock()
+	if this.local[channel.name] == nil {
+		this.local[channel.name] = make(map[string]*PresenceMember)
+	}
+	local := member
+	this.local[channel.name][client.uuid] = &local
+	this.lock.Unlock()
+	if err := this.store.Set(channel.name, member); err != nil {
+		Log().Error().Err(err).Str("channel", channel.name).Str("uuid", client.uuid).Msg("Error when save presence")
+		return
+	}
+	this.emit(PRESENCE_JOIN, channel.name, member)
+}
+
+func (this *WSPresence) leave(channel *WSChannel, uuid string) {
+	this.lock.Lock()
+	local := this.local[channel.name][uuid]
+	delete(this.local[channel.name], uuid)
+	this.lock.Unlock()
+	if local == nil {
+		return
+	}
+	removed, err := this.store.Remove(channel.name, uuid)
+	if err != nil {
+		Log().Error().Err(err).Str("channel", channel.name).Str("uuid", uuid).Msg("Error when remove presence")
+		return
+	}
+	// already expired by sweeper
+	if removed {
+		this.emit(PRESENCE_LEAVE, channel.name, *local)
+	}
+}
+
+// forget members of a removed channel, clients are not notified
+func (this *WSPresence) closeChannel(channel *WSChannel) {
+	this.lock.Lock()
+	members := this.local[channel.name]
+	delete(this.local, channel.name)
+	this.lock.Unlock()
+	for uuid := range members {
+		if _, err := this.store.Remove(channel.name, uuid); err != nil {
+			Log().Error().Err(err).Str("channel", channel.name).Msg("Error when remove presence")
+		}
+	}
+}
+
+// seen refresh member in store at most a few times per timeout, expired member join again
+func (this *WSPresence) seen(client *WSClient, force bool) {
+	now := presenceNow()
+	throttle := int64(this.config.Timeout / time.Millisecond) / 4
+	touch := make(map[string]PresenceMember)
+	this.lock.Lock()
+	for channel, members := range this.local {
+		if local := members[client.uuid]; local != nil && (force || now - local.SeenAt >= throttle) {
+			local.SeenAt = now
+			touch[channel] = *local
+		}
+	}
+	this.lock.Unlock()
+	for channel, member := range touch {
+		this.touch(channel, member)
+	}
+}
+
+func (this *WSPresence) touch(channel string, member PresenceMember) {
+	this.lock.Lock()
+	_, tracked := this.local[channel][member.UUID]
+	this.lock.Unlock()
+	if !tracked {
+		return
+	}
+	present, err := this.store.Touch(channel, member.UUID, member.SeenAt)
+	if err != nil {
+		Log().Error().Err(err).Str("channel", channel).Str("uuid", member.UUID).Msg("Error when refresh presence")
+		return
+	}
+	if !present {
+		// expired while connected, join again
+		if err = this.store.Set(channel, member); err == nil {
+			this.emit(PRESENCE_JOIN, channel, member)
+		}
+	}
+}
+
+func (this *WSPresence) sweeper() {
+	ticker := time.NewTicker(this.config.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+			this.sweep()
+		}
+	}
+}
+
+// sweep remove members not seen during timeout, with shared store members of dead nodes are removed too
+func (this *WSPresence) sweep() {
+	before := presenceNow() - int64(this.config.Timeout / time.Millisecond)
+	for _, name := range this.channelNames() {
+		expired, err := this.store.Expire(name, before)
+		if err != nil {
+			Log().Error().Err(err).Str("channel", name).Msg("Error when expire presence")
+			continue
+		}
+		for _, member := range expired {
+			this.emit(PRESENCE_LEAVE, name, member)
+		}
+	}
+}
+
+func (this *WSPresence) channelNames() []string {
+	var names []string
+	this.server.RangeChannel(func(channel *WSChannel) {
+		names = append(names, channel.name)
+	})
+	return names
+}
+
+func (this *WSPresence) emit(event string, channel string, member PresenceMember) {
+	e := PresenceEvent{
+		Type: this.config.EventType,
+		Event: event,
+		Channel: channel,
+		Member: member,
+	}
+	if this.config.OnEvent != nil {
+		this.config.OnEvent(e)
+	}
+	if this.config.DisableEvents {
+		return
+	}
+	data, err := json.Marshal(&e)
+	if err != nil {
+		Log().Error().Err(err).Str("channel", channel).Msg("Error when encode presence event")
+		return
+	}
+	this.server.channelLock.RLock()
+	target, has := this.server.nameChannels[channel]
+	this.server.channelLock.RUnlock()
+	if has {
+		target.Broadcast(data)
+	}
+}
+
+//-------------------------------------------------------------
+// Memory store
+//-------------------------------------------------------------
+type MemoryPresenceStore struct {
+	lock 						sync.RWMutex
+	channels 					map[string]map[string]PresenceMember
+}
+
+func NewMemoryPresenceStore() *MemoryPresenceStore {
+	return &MemoryPresenceStore{
+		channels: make(map[string]map[string]PresenceMember),
+	}
+}
+
+func (this *MemoryPresenceStore) Set(channel string, member PresenceMember) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.channels[channel] == nil {
+		this.channels[channel] = make(map[string]PresenceMember)
+	}
+	this.channels[channel][member.UUID] = member
+	return nil
+}
+
+func (this *MemoryPresenceStore) Touch(channel string, uuid string, seenAt int64) (bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	member, has := this.channels[channel][uuid]
+	if !has {
+		return false, nil
+	}
+	member.SeenAt = seenAt
+	this.channels[channel][uuid] = member
+	return true, nil
+}
+
+func (this *MemoryPresenceStore) Remove(channel string, uuid string) (bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	_, has := this.channels[channel][uuid]
+	delete(this.channels[channel], uuid)
+	return has, nil
+}
+
+func (this *MemoryPresenceStore) Members(channel string) ([]PresenceMember, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	members := make([]PresenceMember, 0, len(this.channels[channel]))
+	for _, member := range this.channels[channel] {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (this *MemoryPresenceStore) Expire(channel string, before int64) ([]PresenceMember, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	var expired []PresenceMember
+	for uuid, member := range this.channels[channel] {
+		if member.SeenAt < before {
+			expired = append(expired, member)
+			delete(this.channels[channel], uuid)
+		}
+	}
+	return expired, nil
+}
+
+//-------------------------------------------------------------
+// Redis store
+//-------------------------------------------------------------
+
+// members are a hash of uuid -> member and a sorted set of uuid by seen time
+var presenceTouchScript = redis.NewScript(`
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then return 0 end
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+return 1
+`)
+
+var presenceRemoveScript = redis.NewScript(`
+redis.call('ZREM', KEYS[2], ARGV[1])
+return redis.call('HDEL', KEYS[1], ARGV[1])
+`)
+
+// remove atomically so only one node report a member as expired
+var presenceExpireScript = redis.NewScript(`
+local uuids = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', '(' .. ARGV[1])
+local expired = {}
+for _, uuid in ipairs(uuids) do
+	local member = redis.call('HGET', KEYS[1], uuid)
+	if member then
+		table.insert(expired, member)
+		redis.call('HDEL', KEYS[1], uuid)
+	end
+	redis.call('ZREM', KEYS[2], uuid)
+end
+return expired
+`)
+
+type RedisPresenceStore struct {
+	client 						redis.UniversalClient
+	prefix 						string
+}
+
+// NewRedisPresenceStore keep members in redis, prefix default "ws_presence"
+func NewRedisPresenceStore(client redis.UniversalClient, prefix string) *RedisPresenceStore {
+	if prefix == "" {
+		prefix = "ws_presence"
+	}
+	return &RedisPresenceStore{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+// keys of channel share a hash tag to stay on one cluster slot
+func (this *RedisPresenceStore) keys(channel string) []string {
+	base := this.prefix + "|{" + channel + "}"
+	return []string{base + "|members", base + "|seen"}
+}
+
+func (this *RedisPresenceStore) Set(channel string, member PresenceMember) error {
+	data, err := json.Marshal(&member)
+	if err != nil {
+		return err
+	}
+	keys := this.keys(channel)
+	_, err = this.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(keys[0], member.UUID, data)
+		pipe.ZAdd(keys[1], &redis.Z{Score: float64(member.SeenAt), Member: member.UUID})
+		return nil
+	})
+	return err
+}
+
+func (this *RedisPresenceStore) Touch(channel string, uuid string, seenAt int64) (bool, error) {
+	present, err := presenceTouchScript.Run(this.client, this.keys(channel), uuid, seenAt).Int()
+	return present == 1, err
+}
+
+func (this *RedisPresenceStore) Remove(channel string, uuid string) (bool, error) {
+	removed, err := presenceRemoveScript.Run(this.client, this.keys(channel), uuid).Int()
+	return removed == 1, err
+}
+
+func (this *RedisPresenceStore) Members(channel string) ([]PresenceMember, error) {
+	keys := this.keys(channel)
+	pipe := this.client.Pipeline()
+	defer pipe.Close()
+	all := pipe.HGetAll(keys[0])
+	seen := pipe.ZRangeWithScores(keys[1], 0, -1)
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+	seenAt := make(map[string]int64)
+	for _, z := range seen.Val() {
+		seenAt[z.Member.(string)] = int64(z.Score)
+	}
+	members := make([]PresenceMember, 0, len(all.Val()))
+	for uuid, data := range all.Val() {
+		var member PresenceMember
+		if err := json.Unmarshal([]byte(data), &member); err != nil {
+			Log().Error().Err(err).Str("channel", channel).Str("uuid", uuid).Msg("Error when decode presence member")
+			continue
+		}
+		if at, has := seenAt[uuid]; has {
+			member.SeenAt = at
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (this *RedisPresenceStore) Expire(channel string, before int64) ([]PresenceMember, error) {
+	values, err := presenceExpireScript.Run(this.client, this.keys(channel), before).Result()
+	if err != nil {
+		return nil, err
+	}
+	list, _ := values.([]interface{})
+	expired := make([]PresenceMember, 0, len(list))
+	for _, value := range list {
+		data, _ := value.(string)
+		var member PresenceMember
+		if err := json.Unmarshal([]byte(data), &member); err != nil {
+			continue
+		}
+		expired = append(expired, member)
+	}
+	return expired, nil
+}
+
+var _ PresenceStore = (*MemoryPresenceStore)(nil)
+var _ PresenceStore = (*RedisPresenceStore)(nil)
@@ -0,0 +1,140 @@
+package gocore
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+)
+
+func TestPresenceEvents(t *testing.T) {
+	server := testWSServer("room")
+	events := make(chan PresenceEvent, 8)
+	presence := server.UsePresence(PresenceConfig{
+		Timeout: time.Minute,
+		OnEvent: func(event PresenceEvent) { events <- event },
+	})
+	defer presence.Close()
+	client, peer := testWSConnect(server, &UserAuthData{UserID: "u1"})
+	defer peer.Close()
+	messages := testWSMessages(peer)
+	next := func(want string) PresenceEvent {
+		select {
+		case event := <-events:
+			if event.Event != want || event.Channel != "room" || event.Member.UUID != client.GetUUID() {
+				t.Errorf("event %+v, want %s", event, want)
+			}
+			return event
+		case <-time.After(time.Second):
+			t.Fatalf("no %s event", want)
+		}
+		return PresenceEvent{}
+	}
+
+	server.ClientJoinChannel(client, "room")
+	if event := next(PRESENCE_JOIN); event.Member.UserID != "u1" || event.Type != "presence" {
+		t.Errorf("join event %+v", event)
+	}
+	select {
+	case message := <-messages:
+		if !strings.Contains(message, `"event":"join"`) || !strings.Contains(message, `"user_id":"u1"`) {
+			t.Errorf("broadcast event %s", message)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("join event not broadcast to channel")
+	}
+	if present, _ := presence.IsPresent("room", "u1"); !present {
+		t.Errorf("u1 not present")
+	}
+
+	// member not seen during timeout is swept, its next heartbeat join again
+	if _, err := presence.store.Touch("room", client.GetUUID(), 1); err != nil {
+		t.Fatal(err)
+	}
+	presence.sweep()
+	next(PRESENCE_LEAVE)
+	if count, _ := presence.Count("room"); count != 0 {
+		t.Errorf("count after sweep %d", count)
+	}
+	presence.Heartbeat(client)
+	next(PRESENCE_JOIN)
+	if err := presence.Update(client, "room", map[string]interface{}{"typing": true}); err != nil {
+		t.Fatal(err)
+	}
+	if event := next(PRESENCE_UPDATE); event.Member.Meta["typing"] != true {
+		t.Errorf("update event %+v", event)
+	}
+
+	client.Leave("room")
+	next(PRESENCE_LEAVE)
+	if count, _ := presence.Count("room"); count != 0 {
+		t.Errorf("count after leave %d", count)
+	}
+	if err := presence.Update(client, "room", nil); err != ErrPresenceNotMember {
+		t.Errorf("update after leave: %v", err)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %+v", event)
+	default:
+	}
+}
+
+func TestRedisPresenceStore(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	store := NewRedisPresenceStore(client, "")
+
+	for _, member := range []PresenceMember{
+		{UUID: "c1", UserID: "u1", Meta: map[string]interface{}{"name": "bob"}, JoinedAt: 100, SeenAt: 100},
+		{UUID: "c2", UserID: "u2", JoinedAt: 200, SeenAt: 200},
+	} {
+		if err = store.Set("room", member); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if present, err := store.Touch("room", "c1", 300); !present || err != nil {
+		t.Errorf("Touch c1 = %v %v", present, err)
+	}
+	if present, _ := store.Touch("room", "c3", 300); present {
+		t.Errorf("Touch of absent member")
+	}
+	members, err := store.Members("room")
+	if err != nil || len(members) != 2 {
+		t.Fatalf("members %+v %v", members, err)
+	}
+	for _, member := range members {
+		if member.UUID == "c1" && (member.SeenAt != 300 || member.Meta["name"] != "bob") {
+			t.Errorf("c1 %+v", member)
+		}
+	}
+
+	expired, err := store.Expire("room", 250)
+	if err != nil || len(expired) != 1 || expired[0].UUID != "c2" || expired[0].UserID != "u2" {
+		t.Errorf("expired %+v %v", expired, err)
+	}
+	if expired, _ = store.Expire("room", 250); len(expired) != 0 {
+		t.Errorf("expired twice %+v", expired)
+	}
+	if removed, _ := store.Remove("room", "c1"); !removed {
+		t.Errorf("c1 not removed")
+	}
+	if removed, _ := store.Remove("room", "c1"); removed {
+		t.Errorf("c1 removed twice")
+	}
+	if members, _ = store.Members("room"); len(members) != 0 {
+		t.Errorf("members left %+v", members)
+	}
+	for _, key := range mr.Keys() {
+		if !strings.Contains(key, "{room}") {
+			t.Errorf("key %s without hash tag", key)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package gocore
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/gobwas/ws"
+)
+
+const (
+	// discard oldest queued frame to accept the new one
+	WS_QUEUE_DROP_OLDEST = "drop_oldest"
+	// discard the new frame
+	WS_QUEUE_DROP_NEWEST = "drop_newest"
+	// close slow client
+	WS_QUEUE_DISCONNECT = "disconnect"
+
+	// client closed because its queue was full with WS_QUEUE_DISCONNECT policy
+	WS_CLOSE_SLOW_CLIENT = "slow_client"
+)
+
+var (
+	ErrWSQueueFull = errors.New("websocket: client queue is full")
+	ErrWSClientClosed = errors.New("websocket: client is closing")
+)
+
+// WSQueueConfig bound frames waiting to be written to each client
+type WSQueueConfig struct {
+	// max frames waiting per client ( default: 256 )
+	Size 						int
+	// what to do when queue is full, one of WS_QUEUE_* ( default: WS_QUEUE_DROP_OLDEST )
+	Policy 						string
+}
+
+var DefaultWSQueueConfig = WSQueueConfig{
+	Size: 256,
+	Policy: WS_QUEUE_DROP_OLDEST,
+}
+
+// WSQueueStats of one client or of all clients of AppWebSocket
+type WSQueueStats struct {
+	// frames waiting to be written
+	Depth 						int
+	// deepest client queue, only for AppWebSocket
+	MaxDepth 					int
+	Sent 						uint64
+	Dropped 					uint64
+	// clients closed by WS_QUEUE_DISCONNECT policy, only for AppWebSocket
+	Disconnected 				uint64
+}
+
+// SetQueue change outbound queue of all clients
+func (this*AppWebSocket) SetQueue(config WSQueueConfig) {
+	if config.Size <= 0 {
+		config.Size = DefaultWSQueueConfig.Size
+	}
+	switch config.Policy {
+	case WS_QUEUE_DROP_OLDEST, WS_QUEUE_DROP_NEWEST, WS_QUEUE_DISCONNECT:
+	default:
+		config.Policy = DefaultWSQueueConfig.Policy
+	}
+	this.queueLock.Lock()
+	this.queueConfig = config
+	this.queueLock.Unlock()
+}
+
+func (this*AppWebSocket) getQueueConfig() WSQueueConfig {
+	this.queueLock.RLock()
+	defer this.queueLock.RUnlock()
+	return this.queueConfig
+}
+
+// QueueStats sum queues of connected clients, Sent and Dropped include closed clients
+func (this*AppWebSocket) QueueStats() WSQueueStats {
+	stats := WSQueueStats{
+		Sent: atomic.LoadUint64(&this.queueSent),
+		Dropped: atomic.LoadUint64(&this.queueDropped),
+		Disconnected: atomic.LoadUint64(&this.queueDisconnected),
+	}
+	this.userLock.RLock()
+	for _, client := range this.users {
+		depth := client.QueueDepth()
+		stats.Depth += depth
+		if depth > stats.MaxDepth {
+			stats.MaxDepth = depth
+		}
+	}
+	this.userLock.RUnlock()
+	return stats
+}
+
+// QueueDepth is number of frames waiting to be written
+func (c *WSClient) QueueDepth() int {
+	c.outLock.Lock()
+	defer c.outLock.Unlock()
+	return len(c.out)
+}
+
+func (c *WSClient) QueueStats() WSQueueStats {
+	return WSQueueStats{
+		Depth: c.QueueDepth(),
+		Sent: atomic.LoadUint64(&c.sent),
+		Dropped: atomic.LoadUint64(&c.dropped),
+	}
+}
+
+// enqueue frame for the writer of client, start writer when idle.
+// never block, caller may hold locks of server or channel
+func (c *WSClient) enqueue(frame []byte) error {
+	if c.IsClosing() {
+		return ErrWSClientClosed
+	}
+	config := c.server.getQueueConfig()
+	c.outLock.Lock()
+	if len(c.out) >= config.Size {
+		switch config.Policy {
+		case WS_QUEUE_DROP_NEWEST:
+			c.outLock.Unlock()
+			c.drop(1)
+			return ErrWSQueueFull
+		case WS_QUEUE_DISCONNECT:
+			dropped := len(c.out) + 1
+			c.out = nil
+			c.outLock.Unlock()
+			c.drop(dropped)
+			// mark now so following frames are refused, handshake write may block
+			reason := WSCloseReason{Cause: WS_CLOSE_SLOW_CLIENT, Code: ws.StatusPolicyViolation, Reason: "too slow", Initiator: WS_CLOSE_BY_SERVER}
+			if !c.markClosing(reason) {
+				return ErrWSClientClosed
+			}
+			atomic.AddUint64(&c.server.queueDisconnected, 1)
+			Log().Info().Str("uuid", c.uuid).Int("queue", config.Size).Msg("Closing slow websocket client")
+			go c.server.sendClose(c, reason)
+			return ErrWSQueueFull
+		default:
+			c.out[0] = nil
+			c.out = c.out[1:]
+			defer c.drop(1)
+		}
+	}
+	c.out = append(c.out, frame)
+	start := !c.writing
+	c.writing = true
+	c.outLock.Unlock()
+	if start {
+		go c.writer()
+	}
+	return nil
+}
+
+func (c *WSClient) drop(count int) {
+	atomic.AddUint64(&c.dropped, uint64(count))
+	atomic.AddUint64(&c.server.queueDropped, uint64(count))
+}
+
+// writer write queued frames in order, exit when queue is empty
+func (c *WSClient) writer() {
+	for {
+		c.outLock.Lock()
+		if len(c.out) == 0 || c.IsClosing() {
+			// frames behind a close frame would be ignored by peer
+			c.drop(len(c.out))
+			c.out = nil
+			c.writing = false
+			c.outLock.Unlock()
+			return
+		}
+		frame := c.out[0]
+		c.out[0] = nil
+		c.out = c.out[1:]
+		c.outLock.Unlock()
+
+		if err := c.internalWrite(frame); err != nil {
+			// a partial frame break the stream, drop connection
+			c.outLock.Lock()
+			c.drop(len(c.out) + 1)
+			c.out = nil
+			c.writing = false
+			c.outLock.Unlock()
+			c.server.dropClient(c, c.closeReason(err))
+			return
+		}
+		atomic.AddUint64(&c.sent, 1)
+		atomic.AddUint64(&c.server.queueSent, 1)
+	}
+}
@@ -0,0 +1,81 @@
+package gocore
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// testWSClient return a client whose writer is considered running, so queued frames stay queued.
+// closing its conn stop the peer reader
+func testWSClient(config WSQueueConfig) *WSClient {
+	server := &AppWebSocket{
+		users: make(map[string]*WSClient),
+		userClients: make(map[string]map[string]*WSClient),
+		keepAlive: DefaultWSKeepAliveConfig,
+		OnClose: func(uuid string, reason WSCloseReason) {},
+	}
+	server.SetQueue(config)
+	conn, peer := net.Pipe()
+	go func() { _, _ = io.Copy(ioutil.Discard, peer) }()
+	return &WSClient{server: server, uuid: "c1", conn: conn, writing: true}
+}
+
+func TestWSClientEnqueue(t *testing.T) {
+	tests := []struct {
+		policy 					string
+		errs 					[]error
+		queued 					[]string
+		dropped 				uint64
+		closing 				bool
+	}{
+		{WS_QUEUE_DROP_OLDEST, []error{nil, nil, nil, nil}, []string{"3", "4"}, 2, false},
+		{WS_QUEUE_DROP_NEWEST, []error{nil, nil, ErrWSQueueFull, ErrWSQueueFull}, []string{"1", "2"}, 2, false},
+		{WS_QUEUE_DISCONNECT, []error{nil, nil, ErrWSQueueFull, ErrWSClientClosed}, nil, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			c := testWSClient(WSQueueConfig{Size: 2, Policy: tt.policy})
+			defer c.conn.Close()
+			for i, want := range tt.errs {
+				if err := c.enqueue([]byte{byte('1' + i)}); err != want {
+					t.Errorf("frame %d: err %v, want %v", i + 1, err, want)
+				}
+			}
+			c.outLock.Lock()
+			var queued []string
+			for _, frame := range c.out {
+				queued = append(queued, string(frame))
+			}
+			c.outLock.Unlock()
+			if len(queued) != len(tt.queued) || (len(queued) > 0 && (queued[0] != tt.queued[0] || queued[1] != tt.queued[1])) {
+				t.Errorf("queued %v, want %v", queued, tt.queued)
+			}
+			if stats := c.QueueStats(); stats.Dropped != tt.dropped || stats.Depth != len(tt.queued) {
+				t.Errorf("stats %+v", stats)
+			}
+			if c.IsClosing() != tt.closing {
+				t.Errorf("closing %v", c.IsClosing())
+			}
+			if stats := c.server.QueueStats(); stats.Dropped != tt.dropped {
+				t.Errorf("server stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestWSClientWriterDropOnClose(t *testing.T) {
+	c := testWSClient(WSQueueConfig{Size: 8})
+	defer c.conn.Close()
+	for i := 0; i < 3; i++ {
+		if err := c.enqueue([]byte("frame")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.markClosing(WSCloseReason{Cause: WS_CLOSE_SERVER, Initiator: WS_CLOSE_BY_SERVER})
+	c.writer()
+	if stats := c.QueueStats(); stats.Depth != 0 || stats.Dropped != 3 || stats.Sent != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+}
@@ -0,0 +1,237 @@
+package gocore
+
+import (
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/labstack/echo/v4"
+)
+
+// testWSServer return a server without http route, clients are registered with testWSConnect
+func testWSServer(channels ...string) *AppWebSocket {
+	server := &AppWebSocket{
+		pool: NewPool(4, 1, 1),
+		nameChannels: make(map[string]*WSChannel),
+		users: make(map[string]*WSClient),
+		userClients: make(map[string]map[string]*WSClient),
+		globaOut: make(chan wsBroadcast, 1),
+		keepAlive: DefaultWSKeepAliveConfig,
+		OnOpen: func(client *WSClient) {},
+		OnClose: func(uuid string, reason WSCloseReason) {},
+		OnJoinChannel: func(client *WSClient, channel *WSChannel) {},
+		OnLeaveChannel: func(uuid string, channel *WSChannel) {},
+		OnMessage: func(client *WSClient, data []byte) {},
+	}
+	server.SetQueue(DefaultWSQueueConfig)
+	for _, name := range channels {
+		server.AddChannel(NewChannel(server, name))
+	}
+	go server.globalBroadcaster()
+	return server
+}
+
+// testWSConnect register a client of user, nil for anonymous, and return the peer end of its connection
+func testWSConnect(server *AppWebSocket, user *UserAuthData) (*WSClient, net.Conn) {
+	conn, peer := net.Pipe()
+	return server.registerClient(conn, user, nil), peer
+}
+
+// testWSHTTP serve handshake of server like its route, without reading connections
+func testWSHTTP(server *AppWebSocket) *httptest.Server {
+	e := echo.New()
+	e.GET("/ws", func(c echo.Context) error {
+		conn, user, err := server.upgrade(c)
+		if err != nil {
+			return err
+		}
+		server.registerClient(conn, user, nil)
+		return nil
+	})
+	return httptest.NewServer(e)
+}
+
+// testWSRead return next text message written to peer, empty after timeout
+func testWSRead(peer net.Conn, timeout time.Duration) string {
+	_ = peer.SetReadDeadline(time.Now().Add(timeout))
+	data, err := wsutil.ReadServerText(peer)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// testWSReadFrame return next frame written to peer, text or control
+func testWSReadFrame(peer net.Conn, timeout time.Duration) (ws.Frame, bool) {
+	_ = peer.SetReadDeadline(time.Now().Add(timeout))
+	frame, err := ws.ReadFrame(peer)
+	return frame, err == nil
+}
+
+// testWSWrite send frame from peer like a browser, masked
+func testWSWrite(peer net.Conn, frame ws.Frame) {
+	go func() { _ = ws.WriteFrame(peer, ws.MaskFrameInPlace(frame)) }()
+}
+
+// testWSMessages read every text message written to peer until it is closed
+func testWSMessages(peer net.Conn) <-chan string {
+	messages := make(chan string, 16)
+	go func() {
+		defer close(messages)
+		for {
+			message := testWSRead(peer, 5 * time.Second)
+			if message == "" {
+				return
+			}
+			messages <- message
+		}
+	}()
+	return messages
+}
+
+func TestWSChannelBroadcastAfterClose(t *testing.T) {
+	channel := NewChannel(&AppWebSocket{}, "room")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				channel.Broadcast([]byte("hello"))
+			}
+		}()
+	}
+	channel.Close()
+	channel.Close()
+	wg.Wait()
+	if channel.push(wsBroadcast{}) {
+		t.Errorf("push accepted on closed channel")
+	}
+}
+
+func TestWSSendResults(t *testing.T) {
+	server := testWSServer()
+	c1, peer1 := testWSConnect(server, &UserAuthData{UserID: "u1"})
+	defer peer1.Close()
+	c2, peer2 := testWSConnect(server, &UserAuthData{UserID: "u1"})
+	defer peer2.Close()
+	anonymous, peer3 := testWSConnect(server, nil)
+	defer peer3.Close()
+	messages1, messages2, messages3 := testWSMessages(peer1), testWSMessages(peer2), testWSMessages(peer3)
+	receive := func(messages <-chan string, want string) {
+		select {
+		case got := <-messages:
+			if got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%q not received", want)
+		}
+	}
+
+	result := server.SendToUser("u1", []byte("user"))
+	if !result.Ok() || len(result.Delivered) != 2 || result.Forwarded {
+		t.Errorf("SendToUser %+v", result)
+	}
+	receive(messages1, "user")
+	receive(messages2, "user")
+	if result = server.SendToUser("offline", []byte("user")); result.Ok() || len(result.Delivered) != 0 {
+		t.Errorf("SendToUser offline %+v", result)
+	}
+
+	result = server.SendToMany([]string{c1.GetUUID(), anonymous.GetUUID(), "gone"}, []byte("many"))
+	if result.Ok() || len(result.Delivered) != 2 || len(result.Missing) != 1 || result.Missing[0] != "gone" {
+		t.Errorf("SendToMany %+v", result)
+	}
+	receive(messages1, "many")
+	receive(messages3, "many")
+
+	// closing client refuse messages
+	c2.markClosing(WSCloseReason{Cause: WS_CLOSE_SERVER, Initiator: WS_CLOSE_BY_SERVER})
+	result = server.SendToClientH(c2.GetUUID(), echo.Map{"n": 1})
+	if result.Ok() || len(result.Failed) != 1 || result.Failed[0] != c2.GetUUID() {
+		t.Errorf("SendToClient closing %+v", result)
+	}
+	if result = server.SendToClientH(c1.GetUUID(), echo.Map{"n": 1}); !result.Ok() {
+		t.Errorf("SendToClientH %+v", result)
+	}
+	receive(messages1, `{"n":1}`)
+}
+
+func TestWSClientChannels(t *testing.T) {
+	server := testWSServer("a", "b", "c")
+	var lock sync.Mutex
+	var left []string
+	server.OnLeaveChannel = func(uuid string, channel *WSChannel) {
+		lock.Lock()
+		left = append(left, channel.Name())
+		lock.Unlock()
+	}
+	leftChannels := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), left...)
+	}
+	client, peer := testWSConnect(server, nil)
+	defer peer.Close()
+	other, otherPeer := testWSConnect(server, nil)
+	defer otherPeer.Close()
+	messages, otherMessages := testWSMessages(peer), testWSMessages(otherPeer)
+	for _, name := range []string{"a", "b", "c"} {
+		server.ClientJoinChannel(client, name)
+		server.ClientJoinChannel(other, name)
+	}
+	if len(client.Channels()) != 3 {
+		t.Fatalf("joined %d channels", len(client.Channels()))
+	}
+
+	if !client.Leave("b") || client.Leave("b") || client.Leave("unknown") {
+		t.Errorf("Leave results")
+	}
+	if client.InChannel("b") || !client.InChannel("a") || !client.InChannel("c") {
+		t.Errorf("memberships after leave: %d channels", len(client.Channels()))
+	}
+	if got := leftChannels(); len(got) != 1 || got[0] != "b" {
+		t.Errorf("left %v", got)
+	}
+
+	// other member still receive channels client left
+	other.BroadcastIn("b", []byte("to b"))
+	select {
+	case got := <-messages:
+		t.Errorf("left member got %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	client.BroadcastToOthers([]byte("hello"))
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-otherMessages:
+			if got != "hello" {
+				t.Errorf("other got %q", got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("broadcast %d of joined channels not received", i + 1)
+		}
+	}
+
+	client.LeaveAll()
+	if client.OnAnyChannel() {
+		t.Errorf("still member after LeaveAll")
+	}
+	if got := leftChannels(); len(got) != 3 {
+		t.Errorf("left %v", got)
+	}
+	// disconnect leave nothing more
+	server.Remove(client.GetUUID())
+	if got := leftChannels(); len(got) != 3 {
+		t.Errorf("left after remove %v", got)
+	}
+	server.Remove(other.GetUUID())
+	if got := leftChannels(); len(got) != 6 {
+		t.Errorf("disconnect did not leave channels %v", got)
+	}
+}
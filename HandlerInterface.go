@@ -69,6 +69,25 @@ func (this *HandlerBase) ResultSuccess(c echo.Context, message string, data inte
 	}
 }
 
+//----------------------------------------------------------------------
+// Authentication helper
+//----------------------------------------------------------------------
+// AuthUser return user authenticated by Auth middleware, nil when anonymous
+func (this *HandlerBase) AuthUser(c echo.Context) *UserAuthData {
+	return AuthUser(c)
+}
+// AuthUserID return id of authenticated user, empty when anonymous
+func (this *HandlerBase) AuthUserID(c echo.Context) string {
+	if user := AuthUser(c); user != nil {
+		return user.UserID
+	}
+	return ""
+}
+// Can check authenticated user has permission, see Authorization()
+func (this *HandlerBase) Can(c echo.Context, permission string) bool {
+	return Authorization().HasPermission(AuthUser(c), permission)
+}
+
 //----------------------------------------------------------------------
 // Resources helper
 //----------------------------------------------------------------------
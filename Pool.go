@@ -2,12 +2,17 @@ package gocore
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
 type Pool struct {
 	sem  chan struct{}
 	work chan func()
+	done chan struct{}
+	// held for reading while a task is sent, so no task land in work after Stop
+	lock    sync.RWMutex
+	stopped bool
 }
 
 // ErrScheduleTimeout returned by Pool to indicate that there no free
@@ -27,6 +32,7 @@ func NewPool(size, queue, spawn int) *Pool {
 	p := &Pool{
 		sem:  make(chan struct{}, size),
 		work: make(chan func(), queue),
+		done: make(chan struct{}),
 	}
 	for i := 0; i < spawn; i++ {
 		p.sem <- struct{}{}
@@ -47,7 +53,24 @@ func (p *Pool) ScheduleTimeout(timeout time.Duration, task func()) error {
 	return p.schedule(task, time.After(timeout))
 }
 
+// Stop let workers exit once the queue is empty.
+// tasks scheduled after Stop run in their own goroutine.
+func (p *Pool) Stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.stopped {
+		p.stopped = true
+		close(p.done)
+	}
+}
+
 func (p *Pool) schedule(task func(), timeout <-chan time.Time) error {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.stopped {
+		go task()
+		return nil
+	}
 	select {
 	case <-timeout:
 		return ErrScheduleTimeout
@@ -62,7 +85,19 @@ func (p *Pool) schedule(task func(), timeout <-chan time.Time) error {
 func (p *Pool) worker(task func()) {
 	defer func() { <-p.sem }()
 	task()
-	for task := range p.work {
-		task()
+	for {
+		select {
+		case task := <-p.work:
+			task()
+		case <-p.done:
+			for {
+				select {
+				case task := <-p.work:
+					task()
+				default:
+					return
+				}
+			}
+		}
 	}
 }
@@ -0,0 +1,46 @@
+package gocore
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolStop(t *testing.T) {
+	for round := 0; round < 50; round++ {
+		p := NewPool(4, 8, 1)
+		var ran int32
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					p.Schedule(func() { atomic.AddInt32(&ran, 1) })
+				}
+			}()
+		}
+		time.Sleep(time.Duration(round % 5) * 100 * time.Microsecond)
+		p.Stop()
+		wg.Wait()
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt32(&ran) != 160 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if n := atomic.LoadInt32(&ran); n != 160 {
+			t.Fatalf("round %d: %d of 160 tasks ran", round, n)
+		}
+	}
+}
+
+func TestPoolScheduleTimeout(t *testing.T) {
+	p := NewPool(1, 0, 1)
+	defer p.Stop()
+	release := make(chan struct{})
+	p.Schedule(func() { <-release })
+	if err := p.ScheduleTimeout(10 * time.Millisecond, func() {}); err != ErrScheduleTimeout {
+		t.Errorf("busy pool: err %v", err)
+	}
+	close(release)
+}
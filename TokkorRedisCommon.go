@@ -1,8 +1,9 @@
 package gocore
 
 import (
+	"sync"
+
 	"github.com/go-redis/redis/v7"
-	"time"
 )
 
 const (
@@ -16,6 +17,10 @@ const (
 var _sharedRedis *TokkorRedisCommon
 type TokkorRedisCommon struct {
 	app 						*AppRedis
+	messenger 					*RedisMessenger
+	sessions 					*SessionStore
+	sessionsOnce 				sync.Once
+	sessionConfig 				SessionConfig
 }
 
 func TokkorRedis() *TokkorRedisCommon{
@@ -27,6 +32,33 @@ func TokkorRedis() *TokkorRedisCommon{
 
 func (this* TokkorRedisCommon) Setup(address string, password string){
 	this.app = NewRedisApp(address, password)
+	this.resetSessions()
+}
+
+// SetupWithOptions connect to single node, sentinel or cluster redis
+func (this* TokkorRedisCommon) SetupWithOptions(options AppRedisOptions){
+	this.app = NewRedisAppWithOptions(options)
+	this.resetSessions()
+}
+
+// SetupSessions change expiry and limits of sessions, call it after Setup
+func (this* TokkorRedisCommon) SetupSessions(config SessionConfig){
+	this.sessionConfig = config
+	this.resetSessions()
+}
+
+// setup functions are called at startup, before Sessions is used concurrently
+func (this* TokkorRedisCommon) resetSessions() {
+	this.sessionsOnce = sync.Once{}
+	this.sessions = nil
+}
+
+// Sessions store used by authentication functions
+func (this* TokkorRedisCommon) Sessions() *SessionStore {
+	this.sessionsOnce.Do(func() {
+		this.sessions = NewSessionStore(this.app.Client, this.sessionConfig)
+	})
+	return this.sessions
 }
 
 
@@ -34,7 +66,7 @@ func (this* TokkorRedisCommon) App() *AppRedis {
 	return this.app
 }
 
-func (this* TokkorRedisCommon) Do() *redis.Client {
+func (this* TokkorRedisCommon) Do() redis.UniversalClient {
 	return this.app.Client
 }
 
@@ -51,27 +83,62 @@ func (this*TokkorRedisCommon) Publish(channel string, data interface{}) error {
 	return err
 }
 
+// UseMessenger enable typed messaging, source identify this instance ( empty: hostname + pid )
+func (this*TokkorRedisCommon) UseMessenger(source string) *RedisMessenger {
+	this.messenger = NewRedisMessenger(this.app, source)
+	return this.messenger
+}
+
+func (this*TokkorRedisCommon) Messenger() *RedisMessenger {
+	return this.messenger
+}
+
 //======================================================================================
 // Authentication functions
 //======================================================================================
+// SetAuthentication create a new session with data.AccessToken ( see NewAccessToken ) as access token,
+// only its hash is stored. other sessions of the user stay valid
 func (this* TokkorRedisCommon) SetAuthentication(data *UserAuthData) bool{
-	if data == nil {
+	if data == nil || data.AccessToken == "" {
 		return false
 	}
-	ret, err := json.MarshalToString(data)
+	_, err := this.Sessions().create(data, SessionDevice{}, data.AccessToken)
 	if err != nil {
-		Log().Error().Err(err).Msg("Error when Marschal to string")
+		Log().Error().Err(err).Str("user", data.UserID).Msg("Error when create session")
+		return false
+	}
+	return true
+}
+
+// ValidateAuthentication check access token belong to user, ip is checked when not empty
+func (this* TokkorRedisCommon) ValidateAuthentication(userID string, accessToken string, ip string) *UserAuthData {
+	session, err := this.Sessions().Validate(accessToken, ip)
+	if err == nil {
+		if session.UserID != userID || (ip != "" && session.IP != ip) {
+			return nil
+		}
+		return &session.Auth
+	}
+	if err != ErrSessionNotFound {
+		return nil
+	}
+	return this.validateLegacyAuthentication(userID, accessToken, ip)
+}
+
+// DeleteAuthentication revoke all sessions of user
+func (this* TokkorRedisCommon) DeleteAuthentication(userID string) bool{
+	if _, err := this.Sessions().RevokeAll(userID); err != nil {
 		return false
 	}
-	err = this.Do().Set(KEY_AUTHENTICAITON + data.UserID, ret, 3 * time.Hour).Err()
+	err := this.Do().Del(KEY_AUTHENTICAITON + userID).Err()
 	if err != nil {
-		Log().Error().Err(err).Msg("Error when update to redis")
 		return false
 	}
 	return true
 }
 
-func (this* TokkorRedisCommon) ValidateAuthentication(userID string, accessToken string, ip string) *UserAuthData {
+// single key authentication stored before sessions, accepted until it expire
+func (this* TokkorRedisCommon) validateLegacyAuthentication(userID string, accessToken string, ip string) *UserAuthData {
 	data, err := this.Do().Get(KEY_AUTHENTICAITON + userID).Bytes()
 	if err != nil {
 		return nil
@@ -82,7 +149,7 @@ func (this* TokkorRedisCommon) ValidateAuthentication(userID string, accessToken
 		Log().Error().Err(err).Str("data", string(data)).Msg("Error when unmarshal UserAuthData")
 		return nil
 	}
-	if authData.UserID == userID && authData.AccessToken == accessToken{
+	if authData.UserID == userID && TokenEqual(authData.AccessToken, accessToken) {
 		if ip != "" {
 			if authData.IP == ip {
 				return &authData
@@ -94,14 +161,6 @@ func (this* TokkorRedisCommon) ValidateAuthentication(userID string, accessToken
 	return nil
 }
 
-func (this* TokkorRedisCommon) DeleteAuthentication(userID string) bool{
-	err := this.Do().Del(KEY_AUTHENTICAITON + userID).Err()
-	if err != nil {
-		return false
-	}
-	return true
-}
-
 //======================================================================================
 // Common structure for redis that we can share in other server
 //======================================================================================
@@ -112,4 +171,7 @@ type UserAuthData struct {
 	Avatar 								string 			`json:"avatar"`
 	AccessToken							string 			`json:"access_token"`
 	IP 									string 			`json:"ip"`
+	Roles 								[]string 		`json:"roles,omitempty"`
+	// granted directly, roles grant more through Authorizer
+	Permissions 						[]string 		`json:"permissions,omitempty"`
 }
\ No newline at end of file
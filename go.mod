@@ -5,6 +5,7 @@ go 1.12
 require (
 	github.com/NaySoftware/go-fcm v0.0.0-20190516140123-808e978ddcd2
 	github.com/akyoto/cache v1.0.3
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/buckket/go-blurhash v1.0.3
 	github.com/chai2010/webp v1.1.0
 	github.com/go-redis/redis/v7 v7.0.0-beta.4
@@ -15,19 +16,22 @@ require (
 	github.com/jinzhu/gorm v1.9.10
 	github.com/json-iterator/go v1.1.6
 	github.com/labstack/echo/v4 v4.1.11
+	github.com/labstack/gommon v0.3.0
 	github.com/mailru/easygo v0.0.0-20190618140210-3c14a0dc985f
 	github.com/metal3d/go-slugify v0.0.0-20160607203414-7ac2014b2f23
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
-	github.com/modern-go/reflect2 v1.0.1 // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
 	github.com/oliamb/cutter v0.2.2
 	github.com/panjf2000/ants v1.0.0 // indirect
 	github.com/rs/zerolog v1.15.0
 	github.com/siddontang/go v0.0.0-20180604090527-bdc77568d726
 	github.com/sideshow/apns2 v0.19.0
+	github.com/valyala/fasttemplate v1.0.1
 	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c // indirect
 	github.com/xdg/stringprep v1.0.0 // indirect
 	go.mongodb.org/mongo-driver v1.1.1
+	golang.org/x/crypto v0.0.0-20190701094942-4def268fd1a4
 	golang.org/x/image v0.0.0-20190910094157-69e4b8554b2a
 	golang.org/x/net v0.0.0-20190503192946-f4e77d36d62c
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df